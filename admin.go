@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// newAdminHandler returns the handler of the control plane API. It must only be
+// served on a listener that containers can not reach.
+func newAdminHandler(c *metaproxy.CredentialsProvider) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/credentials", logHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleListCredentials(c, w, r)
+	}))
+	mux.HandleFunc("/credentials/invalidate", logHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleInvalidate(c, w, r)
+	}))
+	return mux
+}
+
+// adminTLSConfig configures the admin API to serve TLS with the certificate and to
+// verify client certificates against the CA.
+func adminTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error loading admin API certificate %s: %s", certFile, err)
+	}
+
+	ca, err := ioutil.ReadFile(clientCAFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error reading admin API client CA file %s: %s", clientCAFile, err)
+	}
+
+	clientCAs := x509.NewCertPool()
+
+	if !clientCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in admin API client CA file %s", clientCAFile)
+	}
+
+	// Invalid certificates fail the handshake. Requests without a certificate are
+	// rejected by requireClientCert, so they get a response.
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// requireClientCert responds with 401 to requests without a verified client certificate.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.Warn("Rejected admin API request without a client certificate from ", r.RemoteAddr, ": ", r.Method, " ", r.URL.Path)
+			http.Error(w, "A client certificate is required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListCredentials responds with the cached credentials of all container IPs.
+// The access keys are masked and the secret keys and tokens are left out.
+func handleListCredentials(c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]metaproxy.CachedEntry{"credentials": c.CachedEntries()})
+}
+
+// handleInvalidate removes cached credentials so the next request assumes the role
+// again. Exactly one of the ip, container_id, role_arn or all parameters selects
+// the entries to remove.
+func handleInvalidate(c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	var match func(containerIP string, entry metaproxy.ContainerCredentials) bool
+
+	switch {
+	case len(query.Get("ip")) > 0:
+		ip := query.Get("ip")
+		match = func(containerIP string, entry metaproxy.ContainerCredentials) bool { return containerIP == ip }
+	case len(query.Get("container_id")) > 0:
+		id := query.Get("container_id")
+		match = func(containerIP string, entry metaproxy.ContainerCredentials) bool {
+			return entry.ContainerInfo.ID == id
+		}
+	case len(query.Get("role_arn")) > 0:
+		arn := query.Get("role_arn")
+		match = func(containerIP string, entry metaproxy.ContainerCredentials) bool {
+			return entry.Credentials.RoleArn.String() == arn
+		}
+	case query.Get("all") == "true":
+		match = func(containerIP string, entry metaproxy.ContainerCredentials) bool { return true }
+	default:
+		http.Error(w, "One of ip, container_id, role_arn or all=true is required", http.StatusBadRequest)
+		return
+	}
+
+	count := c.Invalidate(match)
+	log.Info("Invalidated ", count, " cached credentials: ", r.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"invalidated": count})
+}
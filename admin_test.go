@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleListCredentialsOmitsSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Image: "app"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	w := httptest.NewRecorder()
+	newAdminHandler(provider).ServeHTTP(w, httptest.NewRequest("GET", "/credentials", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.False(strings.Contains(w.Body.String(), "secret1"))
+	assert.False(strings.Contains(w.Body.String(), "token1"))
+
+	var resp struct {
+		Credentials []metaproxy.CachedEntry `json:"credentials"`
+	}
+
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(resp.Credentials, 1)
+
+	entry := resp.Credentials[0]
+	assert.Equal("172.17.0.2", entry.ContainerIP)
+	assert.Equal("app", entry.Image)
+	assert.Equal("ASIA*EST1", entry.AccessKey)
+	assert.True(entry.RefreshIn > 0)
+	assert.False(entry.Expiration.IsZero())
+}
+
+func TestHandleInvalidate(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	appRole, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/app")
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamRole: appRole},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", IamRole: appRole},
+	})
+	provider := newTestProvider(stsServer, containers)
+	handler := newAdminHandler(provider)
+
+	cache := func() {
+		for _, ip := range containers.IPs() {
+			_, err := provider.CredentialsForIP(context.Background(), ip)
+			assert.Nil(err)
+		}
+	}
+
+	invalidate := func(method, query string) (int, int) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/credentials/invalidate?"+query, nil))
+
+		var resp map[string]int
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp["invalidated"]
+	}
+
+	cache()
+
+	status, count := invalidate("POST", "ip=172.17.0.2")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(1, count)
+	_, found := provider.ContainerIDForIP("172.17.0.2")
+	assert.False(found)
+
+	_, count = invalidate("POST", "container_id=bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	assert.Equal(1, count)
+
+	_, count = invalidate("POST", "role_arn=arn:aws:iam::123456789012:role/app")
+	assert.Equal(1, count, "only 172.17.0.4 is left with the role")
+
+	// the next request assumes the role again
+	calls := stsServer.Calls()
+	cache()
+	assert.Equal(calls+3, stsServer.Calls())
+
+	_, count = invalidate("POST", "all=true")
+	assert.Equal(3, count)
+	assert.Empty(provider.CachedEntries())
+
+	status, _ = invalidate("POST", "")
+	assert.Equal(http.StatusBadRequest, status)
+	status, _ = invalidate("GET", "all=true")
+	assert.Equal(http.StatusMethodNotAllowed, status)
+}
+
+// testCert is a certificate for the admin API tests, signed by parent or self-signed.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) TLSCertificate() tls.Certificate {
+	cert, _ := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	return cert
+}
+
+func TestAdminRequiresClientCert(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "admin")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	serverCert := newTestCert(t, "server", false, ca)
+	clientCert := newTestCert(t, "client", false, ca)
+	otherCert := newTestCert(t, "other", false, newTestCert(t, "other-ca", true, nil))
+
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca.certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "server.pem"), serverCert.certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "server-key.pem"), serverCert.keyPEM, 0600)
+
+	tlsConfig, err := adminTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	assert.Nil(err)
+
+	server := httptest.NewUnstartedServer(requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(certs ...tls.Certificate) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := client.Get(server.URL + "/credentials")
+
+		if err != nil {
+			return 0, err
+		}
+
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	status, err := get(clientCert.TLSCertificate())
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, status)
+
+	status, err = get()
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	// certificates of other CAs are not sent or fail the handshake
+	status, err = get(otherCert.TLSCertificate())
+	assert.True(err != nil || status == http.StatusUnauthorized, "%d %v", status, err)
+
+	_, err = adminTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "server-key.pem"))
+	assert.NotNil(err)
+}
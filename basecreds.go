@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	ecsCredentialsHost = "http://169.254.170.2"
+	ecsProviderName    = "ECSProvider"
+)
+
+// baseCredentials returns the credentials that the container roles are assumed with.
+// Returns nil for the default credential chain of the SDK: the environment, the shared
+// credentials file and the instance profile.
+func baseCredentials(source, profile, file, metadataURL string) (*awscredentials.Credentials, error) {
+	switch source {
+	case "default":
+		return nil, nil
+	case "env":
+		return awscredentials.NewEnvCredentials(), nil
+	case "profile":
+		return awscredentials.NewSharedCredentials(file, profile), nil
+	case "instance-profile":
+		client := ec2metadata.New(session.New(&aws.Config{Endpoint: aws.String(metadataURL + "/latest")}))
+		return ec2rolecreds.NewCredentialsWithClient(client, func(p *ec2rolecreds.EC2RoleProvider) {
+			p.ExpiryWindow = 5 * time.Minute
+		}), nil
+	case "ecs":
+		provider, err := newECSCredentialsProvider()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return awscredentials.NewCredentials(provider), nil
+	default:
+		return nil, fmt.Errorf("Unknown base credentials source: %s", source)
+	}
+}
+
+// ecsCredentialsProvider provides the credentials of the task role of the ECS task the
+// proxy runs in, from the container credentials endpoint of the ECS agent.
+type ecsCredentialsProvider struct {
+	awscredentials.Expiry
+	url    string
+	token  string
+	client *http.Client
+}
+
+// newECSCredentialsProvider reads the endpoint from the environment variables that ECS
+// sets in the containers of a task with a task role.
+func newECSCredentialsProvider() (*ecsCredentialsProvider, error) {
+	provider := &ecsCredentialsProvider{
+		token:  os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); len(uri) > 0 {
+		provider.url = ecsCredentialsHost + uri
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); len(uri) > 0 {
+		provider.url = uri
+	} else {
+		return nil, fmt.Errorf("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is not set, the proxy does not run in an ECS task with a task role")
+	}
+
+	return provider, nil
+}
+
+func (p *ecsCredentialsProvider) Retrieve() (awscredentials.Value, error) {
+	req, err := http.NewRequest("GET", p.url, nil)
+
+	if err != nil {
+		return awscredentials.Value{}, err
+	}
+
+	if len(p.token) > 0 {
+		req.Header.Set("Authorization", p.token)
+	}
+
+	resp, err := p.client.Do(req)
+
+	if err != nil {
+		return awscredentials.Value{}, fmt.Errorf("Error requesting ECS task credentials: %s", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return awscredentials.Value{}, fmt.Errorf("Error requesting ECS task credentials: %s: %s", resp.Status, body)
+	}
+
+	var creds ecsCredentials
+
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return awscredentials.Value{}, fmt.Errorf("Error decoding ECS task credentials: %s", err)
+	}
+
+	expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+
+	if err != nil {
+		return awscredentials.Value{}, fmt.Errorf("Error decoding ECS task credentials: invalid expiration %q", creds.Expiration)
+	}
+
+	p.SetExpiration(expiration, 5*time.Minute)
+
+	return awscredentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		ProviderName:    ecsProviderName,
+	}, nil
+}
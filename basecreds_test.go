@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestECSCredentialsProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v2/credentials/task", r.URL.Path)
+		assert.Equal("secret-token", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"AccessKeyId":"ASIATASK","SecretAccessKey":"task-secret","Token":"task-token","Expiration":"` + expiration.Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", server.URL+"/v2/credentials/task")
+	os.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "secret-token")
+	defer os.Unsetenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	defer os.Unsetenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+
+	creds, err := baseCredentials("ecs", "", "", "")
+	assert.Nil(err)
+
+	value, err := creds.Get()
+	assert.Nil(err)
+	assert.Equal("ASIATASK", value.AccessKeyID)
+	assert.Equal("task-secret", value.SecretAccessKey)
+	assert.Equal("task-token", value.SessionToken)
+	assert.False(creds.IsExpired())
+}
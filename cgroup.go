@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// cgroupContainerIDRegexp matches the container ID in the cgroup paths of docker and
+// podman, like /docker/<id> and /system.slice/docker-<id>.scope.
+var cgroupContainerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// tcpListenState is the state of listening sockets in /proc/net/tcp.
+const tcpListenState = "0A"
+
+// containerIDService is a container service that can also look up containers by ID.
+type containerIDService interface {
+	metaproxy.ContainerService
+	ContainerForID(containerID string) (metaproxy.ContainerInfo, error)
+}
+
+type cgroupContainerInfo struct {
+	metaproxy.ContainerInfo
+	RefreshTime time.Time
+}
+
+// cgroupContainerService identifies containers from the cgroup of the process that
+// opened the connection, which works for containers that share the network of the host.
+// The process is only found if the connection was opened in the network namespace of
+// the proxy, so it falls back to the IP of the connection for other containers.
+type cgroupContainerService struct {
+	containers containerIDService
+	procDir    string
+	cacheTTL   time.Duration
+	byID       map[string]cgroupContainerInfo
+	lock       sync.Mutex
+}
+
+func newCgroupContainerService(containers containerIDService, procDir string, cacheTTL time.Duration) *cgroupContainerService {
+	return &cgroupContainerService{
+		containers: containers,
+		procDir:    procDir,
+		cacheTTL:   cacheTTL,
+		byID:       make(map[string]cgroupContainerInfo),
+	}
+}
+
+func (s *cgroupContainerService) TypeName() string {
+	return s.containers.TypeName()
+}
+
+func (s *cgroupContainerService) Ping() error {
+	return s.containers.Ping()
+}
+
+// ContainerKeyForConn returns the ID of the container of the process that opened the
+// connection, or the remote IP if the process is not found or not in a container.
+// Connections to the Unix socket have no IP to fall back to, so they fail instead.
+func (s *cgroupContainerService) ContainerKeyForConn(conn net.Conn) (string, error) {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		return s.unixContainerKey(unixConn)
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+
+	if !ok {
+		return remoteIP(conn.RemoteAddr().String()), nil
+	}
+
+	clientIP := remoteIP(addr.String())
+	inode, found, err := socketInode(s.procDir, addr)
+
+	if err != nil {
+		return "", err
+	} else if !found {
+		return clientIP, nil
+	}
+
+	pid, found, err := socketPid(s.procDir, inode)
+
+	if err != nil {
+		return "", err
+	} else if !found {
+		return clientIP, nil
+	}
+
+	containerID, found, err := cgroupContainerID(s.procDir, pid)
+
+	if err != nil {
+		return "", err
+	} else if !found {
+		log.Debug("Process ", pid, " of connection from ", addr, " is not in a container")
+		return clientIP, nil
+	}
+
+	return containerID, nil
+}
+
+// unixContainerKey returns the ID of the container of the process that connected to
+// the Unix socket, from the peer credentials of the connection.
+func (s *cgroupContainerService) unixContainerKey(conn *net.UnixConn) (string, error) {
+	pid, err := peerPid(conn)
+
+	if err != nil {
+		return "", fmt.Errorf("Error reading the peer credentials of a Unix socket connection: %s", err)
+	}
+
+	containerID, found, err := cgroupContainerID(s.procDir, pid)
+
+	if err != nil {
+		return "", err
+	} else if !found {
+		return "", fmt.Errorf("Process %d of a Unix socket connection is not in a container", pid)
+	}
+
+	return containerID, nil
+}
+
+// ContainerForIP looks up the container by the key of ContainerKeyForConn, which is
+// either a container ID or an IP.
+func (s *cgroupContainerService) ContainerForIP(key string) (metaproxy.ContainerInfo, error) {
+	if net.ParseIP(key) != nil {
+		return s.containers.ContainerForIP(key)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	if info, found := s.byID[key]; found && now.Before(info.RefreshTime) {
+		return info.ContainerInfo, nil
+	}
+
+	for id, info := range s.byID {
+		if !now.Before(info.RefreshTime) {
+			delete(s.byID, id)
+		}
+	}
+
+	container, err := s.containers.ContainerForID(key)
+
+	if err != nil {
+		return metaproxy.ContainerInfo{}, fmt.Errorf("No container found for ID %s: %s", key, err)
+	}
+
+	s.byID[key] = cgroupContainerInfo{container, now.Add(s.cacheTTL)}
+	return container, nil
+}
+
+// socketInode finds the inode of the TCP socket whose local address is the address,
+// that is the client end of a connection to the proxy.
+func socketInode(procDir string, addr *net.TCPAddr) (string, bool, error) {
+	for _, name := range []string{"tcp", "tcp6"} {
+		data, err := ioutil.ReadFile(filepath.Join(procDir, "net", name))
+
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", false, err
+		}
+
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		scanner.Scan() // header
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) < 10 || fields[3] == tcpListenState {
+				continue
+			}
+
+			ip, port, err := parseProcNetAddr(fields[1])
+
+			if err == nil && port == addr.Port && ip.Equal(addr.IP) {
+				return fields[9], true, nil
+			}
+		}
+	}
+
+	return "", false, nil
+}
+
+// parseProcNetAddr parses an address of /proc/net/tcp, like 0100007F:1F40. The IP is
+// hex encoded 32-bit words in host byte order.
+func parseProcNetAddr(value string) (net.IP, int, error) {
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 || (len(parts[0]) != 8 && len(parts[0]) != 32) {
+		return nil, 0, fmt.Errorf("Invalid address %s", value)
+	}
+
+	words, err := hex.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := make(net.IP, len(words))
+
+	for i := 0; i < len(words); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(words[i:]))
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ip, int(port), nil
+}
+
+// socketPid finds the process that has the socket open.
+func socketPid(procDir, inode string) (int, bool, error) {
+	entries, err := ioutil.ReadDir(procDir)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	target := "socket:[" + inode + "]"
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join(procDir, entry.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+
+		if err != nil {
+			// the process exited or is not accessible
+			continue
+		}
+
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				return pid, true, nil
+			}
+		}
+	}
+
+	return 0, false, nil
+}
+
+// cgroupContainerID reads the container ID from the cgroups of the process.
+func cgroupContainerID(procDir string, pid int) (string, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if ids := cgroupContainerIDRegexp.FindAllString(line, -1); len(ids) > 0 {
+			return ids[len(ids)-1], true, nil
+		}
+	}
+
+	return "", false, nil
+}
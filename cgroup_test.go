@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+const cgroupTestID = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+type testConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c testConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type testIDService struct {
+	*metaproxy.MemoryContainerService
+}
+
+func (s *testIDService) ContainerForID(containerID string) (metaproxy.ContainerInfo, error) {
+	return metaproxy.ContainerInfo{ID: containerID}, nil
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	ip, port, err := parseProcNetAddr("0200000A:C350")
+	assert.Nil(err)
+	assert.Equal("10.0.0.2", ip.String())
+	assert.Equal(50000, port)
+
+	ip, port, err = parseProcNetAddr("0000000000000000FFFF00000100007F:1F40")
+	assert.Nil(err)
+	assert.Equal("127.0.0.1", ip.String())
+	assert.Equal(8000, port)
+
+	_, _, err = parseProcNetAddr("0A:1F40")
+	assert.NotNil(err)
+}
+
+func TestCgroupContainerKeyForConn(t *testing.T) {
+	assert := assert.New(t)
+
+	procDir, err := ioutil.TempDir("", "proc")
+	assert.Nil(err)
+	defer os.RemoveAll(procDir)
+
+	os.MkdirAll(filepath.Join(procDir, "net"), 0700)
+	ioutil.WriteFile(filepath.Join(procDir, "net", "tcp"), []byte(
+		"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"+
+			"   0: 00000000:4650 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 100 1\n"+
+			"   1: 0200000A:C350 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 4567 1\n"+
+			"   2: 0200000A:C351 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 4568 1\n"), 0600)
+
+	os.MkdirAll(filepath.Join(procDir, "123", "fd"), 0700)
+	os.Symlink("socket:[4567]", filepath.Join(procDir, "123", "fd", "3"))
+	ioutil.WriteFile(filepath.Join(procDir, "123", "cgroup"), []byte("0::/system.slice/docker-"+cgroupTestID+".scope\n"), 0600)
+
+	os.MkdirAll(filepath.Join(procDir, "456", "fd"), 0700)
+	os.Symlink("socket:[4568]", filepath.Join(procDir, "456", "fd", "4"))
+	ioutil.WriteFile(filepath.Join(procDir, "456", "cgroup"), []byte("0::/user.slice/user-1000.slice\n"), 0600)
+
+	service := newCgroupContainerService(&testIDService{metaproxy.NewMemoryContainerService("test", nil)}, procDir, 0)
+
+	key, err := service.ContainerKeyForConn(testConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000}})
+	assert.Nil(err)
+	assert.Equal(cgroupTestID, key)
+
+	// not in a container
+	key, err = service.ContainerKeyForConn(testConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50001}})
+	assert.Nil(err)
+	assert.Equal("10.0.0.2", key)
+
+	// opened in another network namespace
+	key, err = service.ContainerKeyForConn(testConn{remote: &net.TCPAddr{IP: net.ParseIP("172.17.0.2"), Port: 50000}})
+	assert.Nil(err)
+	assert.Equal("172.17.0.2", key)
+
+	container, err := service.ContainerForIP(cgroupTestID)
+	assert.Nil(err)
+	assert.Equal(cgroupTestID, container.ID)
+}
+
+func TestCgroupContainerKeyForUnixConn(t *testing.T) {
+	assert := assert.New(t)
+
+	procDir, err := ioutil.TempDir("", "proc")
+	assert.Nil(err)
+	defer os.RemoveAll(procDir)
+
+	listener, err := net.Listen("unix", filepath.Join(procDir, "metadata.sock"))
+	assert.Nil(err)
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	assert.Nil(err)
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	assert.Nil(err)
+	defer conn.Close()
+
+	service := newCgroupContainerService(&testIDService{metaproxy.NewMemoryContainerService("test", nil)}, procDir, 0)
+
+	// the peer is this process, which is not in a container
+	_, err = service.ContainerKeyForConn(conn)
+	assert.NotNil(err)
+
+	pidDir := filepath.Join(procDir, strconv.Itoa(os.Getpid()))
+	os.MkdirAll(pidDir, 0700)
+	ioutil.WriteFile(filepath.Join(pidDir, "cgroup"), []byte("0::/system.slice/docker-"+cgroupTestID+".scope\n"), 0600)
+
+	key, err := service.ContainerKeyForConn(conn)
+	assert.Nil(err)
+	assert.Equal(cgroupTestID, key)
+}
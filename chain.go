@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// newAccountSessions creates the sessions that assume the roles of the accounts with
+// their own base credentials, by account ID. Intermediate roles are assumed through
+// the STS endpoint of the config.
+func newAccountSessions(accounts []accountCredentials, base *session.Session, credentialsFile string, stsConfig *aws.Config, stsTimeout time.Duration) map[string]*session.Session {
+	sessions := make(map[string]*session.Session)
+
+	for _, account := range accounts {
+		if account.Role.Empty() {
+			log.Infof("Assuming the roles of account %s with profile %s", account.AccountID, account.Profile)
+			sessions[account.AccountID] = base.Copy(&aws.Config{Credentials: awscredentials.NewSharedCredentials(credentialsFile, account.Profile)})
+		} else {
+			log.Infof("Assuming the roles of account %s through intermediate role %s", account.AccountID, account.Role)
+			sessions[account.AccountID] = metaproxy.NewChainedSession(base, stsConfig, stsTimeout, account.Role, account.ExternalID)
+		}
+	}
+
+	return sessions
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testIntermediateRole = "arn:aws:iam::111111111111:role/gateway"
+
+// newTestChainedProvider creates a provider that assumes the roles of the containers
+// through the intermediate role, limited like main does.
+func newTestChainedProvider(stsServer *ststest.Server, containers metaproxy.ContainerService) *metaproxy.CredentialsProvider {
+	defaultRole, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/default")
+	intermediateRole, _ := metaproxy.NewRoleArn(testIntermediateRole)
+
+	return metaproxy.NewCredentialsProvider(metaproxy.NewChainedSession(stsServer.Session(), nil, time.Second, intermediateRole, "hub-external-id"), containers, metaproxy.CredentialsProviderConfig{
+		Defaults:           metaproxy.RoleDefaults{RoleArn: defaultRole},
+		SessionDuration:    metaproxy.MaxChainedSessionDuration,
+		MaxSessionDuration: metaproxy.MaxChainedSessionDuration,
+		Retry:              metaproxy.Backoff{MaxAttempts: 1},
+	})
+}
+
+func TestChainedSessionAssumesIntermediateRoleFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestChainedProvider(stsServer, containers)
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/default", creds.RoleArn.String(), "the last role of the chain")
+	assert.Equal("ASIATEST2", creds.AccessKey)
+
+	forms, signers := stsServer.Forms(), stsServer.Signers()
+	assert.Len(forms, 2)
+	assert.Equal(testIntermediateRole, forms[0].Get("RoleArn"))
+	assert.Equal("hub-external-id", forms[0].Get("ExternalId"))
+	assert.Equal("ec2metaproxy-chain", forms[0].Get("RoleSessionName"))
+	assert.Equal("AKIDBASE", signers[0])
+
+	// the container role is assumed with the credentials of the intermediate role
+	assert.Equal("arn:aws:iam::123456789012:role/default", forms[1].Get("RoleArn"))
+	assert.Empty(forms[1].Get("ExternalId"))
+	assert.Equal("ASIATEST1", signers[1])
+
+	// the intermediate credentials are reused until they expire
+	containers.Set("172.17.0.3", metaproxy.ContainerInfo{ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"})
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+
+	forms, signers = stsServer.Forms(), stsServer.Signers()
+	assert.Len(forms, 3)
+	assert.Equal("ASIATEST1", signers[2])
+}
+
+func TestChainedSessionIntermediateRoleError(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.Deny(testIntermediateRole)
+
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestChainedProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+
+	awsErr, ok := err.(awserr.Error)
+	assert.True(ok)
+	assert.Equal("AccessDenied", awsErr.Code())
+
+	// the container role is never assumed
+	forms := stsServer.Forms()
+	assert.Len(forms, 1)
+	assert.Equal(testIntermediateRole, forms[0].Get("RoleArn"))
+}
+
+func TestChainedSessionDurationLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", SessionDuration: 12 * time.Hour},
+	})
+	provider := newTestChainedProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	// AWS limits chained sessions to one hour, including the intermediate session
+	forms := stsServer.Forms()
+	assert.Len(forms, 2)
+	assert.Equal("3600", forms[0].Get("DurationSeconds"))
+	assert.Equal("3600", forms[1].Get("DurationSeconds"))
+}
+
+func TestChainedSessionUsesStsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	// the base session points at an endpoint that is down
+	unreachable := ststest.NewServer()
+	unreachable.Close()
+
+	stsConfig := &aws.Config{Endpoint: aws.String(stsServer.URL), Region: aws.String("us-east-1")}
+	intermediateRole, _ := metaproxy.NewRoleArn(testIntermediateRole)
+	defaultRole, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/default")
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := metaproxy.NewCredentialsProvider(metaproxy.NewChainedSession(unreachable.Session(), stsConfig, time.Second, intermediateRole, ""), containers, metaproxy.CredentialsProviderConfig{
+		Defaults:        metaproxy.RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: metaproxy.MaxChainedSessionDuration,
+		Sts:             stsConfig,
+		Retry:           metaproxy.Backoff{MaxAttempts: 1},
+	})
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	forms := stsServer.Forms()
+	assert.Len(forms, 2)
+	assert.Equal(testIntermediateRole, forms[0].Get("RoleArn"))
+}
+
+func TestChainedSessionStsTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetDelay(200 * time.Millisecond)
+
+	intermediateRole, _ := metaproxy.NewRoleArn(testIntermediateRole)
+	chained := metaproxy.NewChainedSession(stsServer.Session(), nil, 20*time.Millisecond, intermediateRole, "")
+
+	_, err := chained.Config.Credentials.Get()
+	assert.NotNil(err)
+	assert.True(metaproxy.IsTimeoutError(err), "%v", err)
+}
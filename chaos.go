@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+var chaosErrors = metaproxy.Metrics.CounterVec(
+	"chaos_errors_total",
+	"Number of credentials requests that chaos mode failed.",
+	"code")
+
+// chaosFailures are the errors that chaos mode responds with, in the formats of the
+// errors of STS outages: throttling, unavailable and internal errors.
+var chaosFailures = []error{
+	awserr.New("Throttling", "Rate exceeded (chaos mode)", nil),
+	awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Service unavailable (chaos mode)", nil), http.StatusServiceUnavailable, ""),
+	awserr.New("InternalFailure", "Internal failure (chaos mode)", nil),
+}
+
+// chaos degrades the credentials responses if chaos mode is enabled. Nil otherwise.
+var chaos *chaosInjector
+
+// chaosInjector delays the credentials responses and fails a share of them, to test the
+// timeouts and retries of the SDKs in the containers against a degraded metadata
+// service. It is not meant for production.
+type chaosInjector struct {
+	delay     time.Duration
+	jitter    time.Duration
+	errorRate float64
+	random    func() float64
+}
+
+// newChaosInjector returns nil if neither a delay nor an error rate is set.
+func newChaosInjector(delay, jitter time.Duration, errorRate float64) (*chaosInjector, error) {
+	if delay < 0 || jitter < 0 {
+		return nil, fmt.Errorf("Chaos delay and jitter must not be negative")
+	}
+
+	if errorRate < 0 || errorRate > 1 {
+		return nil, fmt.Errorf("Chaos error rate %g is not between 0 and 1", errorRate)
+	}
+
+	if delay == 0 && jitter == 0 && errorRate == 0 {
+		return nil, nil
+	}
+
+	log.Warnf("Chaos mode: delaying credentials responses by %s plus up to %s and failing %g%% of them. Do not use in production", delay, jitter, errorRate*100)
+	return &chaosInjector{delay: delay, jitter: jitter, errorRate: errorRate, random: rand.Float64}, nil
+}
+
+// Inject delays the request and fails it at the error rate. Returns true if the request
+// was answered or the client went away while it was delayed.
+func (c *chaosInjector) Inject(w http.ResponseWriter, r *http.Request) bool {
+	if c == nil {
+		return false
+	}
+
+	delay := c.delay
+
+	if c.jitter > 0 {
+		delay += time.Duration(c.random() * float64(c.jitter))
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return true
+		}
+	}
+
+	if c.errorRate == 0 || c.random() >= c.errorRate {
+		return false
+	}
+
+	err := chaosFailures[int(c.random()*float64(len(chaosFailures)))%len(chaosFailures)]
+	chaosErrors.Inc(err.(awserr.Error).Code())
+	log.Debug("Chaos mode failed the credentials request of ", remoteIP(r.RemoteAddr), ": ", err)
+	writeCredentialsError(w, err)
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewChaosInjector(t *testing.T) {
+	assert := assert.New(t)
+
+	injector, err := newChaosInjector(0, 0, 0)
+	assert.Nil(err)
+	assert.Nil(injector)
+	assert.False(injector.Inject(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)))
+
+	_, err = newChaosInjector(0, 0, 1.5)
+	assert.NotNil(err)
+
+	_, err = newChaosInjector(-time.Second, 0, 0)
+	assert.NotNil(err)
+}
+
+func TestChaosInjectorErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	injector, err := newChaosInjector(0, 0, 0.5)
+	assert.Nil(err)
+
+	for _, tc := range []struct {
+		random []float64
+		status int
+		code   string
+	}{
+		{[]float64{0.6}, 0, ""},
+		{[]float64{0.4, 0}, http.StatusServiceUnavailable, "Throttling"},
+		{[]float64{0.4, 0.5}, http.StatusServiceUnavailable, "ServiceUnavailable"},
+		{[]float64{0.4, 0.9}, http.StatusInternalServerError, "InternalError"},
+	} {
+		random := tc.random
+		injector.random = func() float64 {
+			value := random[0]
+			random = random[1:]
+			return value
+		}
+
+		w := httptest.NewRecorder()
+		injected := injector.Inject(w, httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil))
+		assert.Equal(tc.status != 0, injected, tc.code)
+
+		if !injected {
+			continue
+		}
+
+		var body metadataError
+		assert.Nil(json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(tc.status, w.Code)
+		assert.Equal(tc.code, body.Code)
+		assert.NotEmpty(body.LastUpdated)
+	}
+}
+
+func TestChaosInjectorDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	injector, err := newChaosInjector(50*time.Millisecond, 0, 0)
+	assert.Nil(err)
+
+	start := time.Now()
+	assert.False(injector.Inject(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)))
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	// a client that goes away is not delayed further
+	injector.delay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.True(injector.Inject(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx)))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+var accountIDRegexp = regexp.MustCompile(`^\d{12}$`)
+
+// proxyConfig is the contents of the configuration file. The file is JSON, which
+// is also valid YAML. The default role settings override the command line flags.
+//
+//	{
+//	  "default_role": "arn:aws:iam::123456789012:role/default",
+//	  "default_policy": "...",
+//	  "images": [
+//	    {"image": "example/app:*", "role": "arn:aws:iam::123456789012:role/app", "policy": "...",
+//	     "session_duration": "4h"}
+//	  ],
+//	  "networks": [
+//	    {"cidr": "172.18.0.0/16", "role": "arn:aws:iam::123456789012:role/tenant-a",
+//	     "allowed_roles": ["arn:aws:iam::123456789012:role/tenant-a/*"]}
+//	  ],
+//	  "static_credentials": [
+//	    {"image": "example/legacy:*", "role": "arn:aws:iam::123456789012:role/legacy",
+//	     "access_key": "AKIA...", "secret_key": "..."}
+//	  ],
+//	  "accounts": [
+//	    {"account_id": "210987654321", "profile": "prod"},
+//	    {"account_id": "345678901234", "role": "arn:aws:iam::345678901234:role/proxy"}
+//	  ],
+//	  "sts_endpoints": [
+//	    {"role": "arn:aws:iam::*:role/compliance/*", "endpoint": "https://sts-fips.us-east-1.amazonaws.com"}
+//	  ]
+//	}
+type proxyConfig struct {
+	DefaultRole       *metaproxy.RoleArn         `json:"default_role"`
+	DefaultPolicy     *string                    `json:"default_policy"`
+	DefaultExternalID *string                    `json:"default_external_id"`
+	Images            metaproxy.ImageRoleTable   `json:"images"`
+	Networks          metaproxy.NetworkRoleTable `json:"networks"`
+
+	StaticCredentials metaproxy.StaticCredentialsTable `json:"static_credentials"`
+
+	// Accounts and STS endpoints are only read at startup.
+	Accounts     []accountCredentials       `json:"accounts"`
+	StsEndpoints metaproxy.StsEndpointTable `json:"sts_endpoints"`
+}
+
+// accountCredentials are the base credentials that assume the roles of an account:
+// a profile of the shared credentials file, or an intermediate role assumed with the
+// base credentials of the proxy.
+type accountCredentials struct {
+	AccountID  string            `json:"account_id"`
+	Profile    string            `json:"profile"`
+	Role       metaproxy.RoleArn `json:"role"`
+	ExternalID string            `json:"external_id"`
+}
+
+// Defaults returns the flag defaults overridden by the values set in the config file.
+func (c *proxyConfig) Defaults(flags metaproxy.RoleDefaults) metaproxy.RoleDefaults {
+	if c.DefaultRole != nil {
+		flags.RoleArn = *c.DefaultRole
+	}
+
+	if c.DefaultPolicy != nil {
+		flags.Policy = *c.DefaultPolicy
+	}
+
+	if c.DefaultExternalID != nil {
+		flags.ExternalID = *c.DefaultExternalID
+	}
+
+	return flags
+}
+
+func loadConfig(filename string) (*proxyConfig, error) {
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var config proxyConfig
+
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %s", filename, err)
+	}
+
+	for _, mapping := range config.Images {
+		if _, err := path.Match(mapping.Image, ""); err != nil || len(mapping.Image) == 0 {
+			return nil, fmt.Errorf("Invalid image pattern in config file %s: %q", filename, mapping.Image)
+		}
+
+		if mapping.Role.Empty() {
+			return nil, fmt.Errorf("Missing role for image %s in config file %s", mapping.Image, filename)
+		}
+
+		if duration := time.Duration(mapping.SessionDuration); duration != 0 {
+			if err := metaproxy.ValidateSessionDuration(duration); err != nil {
+				return nil, fmt.Errorf("Invalid session duration for image %s in config file %s: %s", mapping.Image, filename, err)
+			}
+		}
+	}
+
+	for i, mapping := range config.Networks {
+		_, network, err := net.ParseCIDR(mapping.CIDR)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network CIDR in config file %s: %q", filename, mapping.CIDR)
+		}
+
+		if mapping.Role.Empty() {
+			return nil, fmt.Errorf("Missing role for network %s in config file %s", mapping.CIDR, filename)
+		}
+
+		config.Networks[i].Network = network
+	}
+
+	for _, mapping := range config.StaticCredentials {
+		if _, err := path.Match(mapping.Image, ""); err != nil || (len(mapping.Image) == 0 && len(mapping.Labels) == 0) {
+			return nil, fmt.Errorf("Invalid static credentials image pattern in config file %s: %q", filename, mapping.Image)
+		}
+
+		if mapping.Role.Empty() || len(mapping.AccessKey) == 0 || len(mapping.SecretKey) == 0 {
+			return nil, fmt.Errorf("Missing role, access key or secret key for static credentials of image %q in config file %s", mapping.Image, filename)
+		}
+	}
+
+	accounts := make(map[string]bool)
+
+	for _, account := range config.Accounts {
+		if !accountIDRegexp.MatchString(account.AccountID) || accounts[account.AccountID] {
+			return nil, fmt.Errorf("Invalid or duplicate account ID in config file %s: %q", filename, account.AccountID)
+		}
+
+		if (len(account.Profile) > 0) == !account.Role.Empty() {
+			return nil, fmt.Errorf("Account %s in config file %s must have either a profile or a role", account.AccountID, filename)
+		}
+
+		accounts[account.AccountID] = true
+	}
+
+	for i, override := range config.StsEndpoints {
+		if err := validateEndpoint(override.Endpoint); err != nil {
+			return nil, fmt.Errorf("Invalid STS endpoint for role %s in config file %s: %s", override.Role, filename, err)
+		}
+
+		config.StsEndpoints[i].Region = endpointSigningRegion(override.Endpoint, override.Region)
+
+		if len(config.StsEndpoints[i].Region) == 0 {
+			return nil, fmt.Errorf("Missing region of STS endpoint %s in config file %s", override.Endpoint, filename)
+		}
+	}
+
+	return &config, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkRolesFirstMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "ec2metaproxy-config")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"networks": [
+		{"cidr": "172.18.1.0/24", "role": "arn:aws:iam::123456789012:role/first"},
+		{"cidr": "172.18.0.0/16", "role": "arn:aws:iam::123456789012:role/second"}
+	]}`)
+	file.Close()
+
+	config, err := loadConfig(file.Name())
+	assert.Nil(err)
+
+	role, found := config.Networks.RoleForIP("172.18.1.2")
+	assert.True(found)
+	assert.Equal("arn:aws:iam::123456789012:role/first", role.Role.String())
+
+	role, found = config.Networks.RoleForIP("172.18.2.2")
+	assert.True(found)
+	assert.Equal("arn:aws:iam::123456789012:role/second", role.Role.String())
+
+	_, found = config.Networks.RoleForIP("172.17.0.2")
+	assert.False(found)
+}
+
+func TestLoadConfigInvalidCIDR(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "ec2metaproxy-config")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"networks": [{"cidr": "172.18.0.0", "role": "arn:aws:iam::123456789012:role/app"}]}`)
+	file.Close()
+
+	_, err = loadConfig(file.Name())
+	assert.NotNil(err)
+}
+
+func TestLoadConfigImageSessionDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "ec2metaproxy-config")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"images": [{"image": "example/app", "role": "arn:aws:iam::123456789012:role/app", "session_duration": "4h"}]}`)
+	file.Close()
+
+	config, err := loadConfig(file.Name())
+	assert.Nil(err)
+	assert.Equal(metaproxy.Duration(4*time.Hour), config.Images[0].SessionDuration)
+
+	for _, duration := range []string{`"10m"`, `"13h"`, `"4 hours"`, `14400`} {
+		ioutil.WriteFile(file.Name(), []byte(`{"images": [{"image": "example/app", "role": "arn:aws:iam::123456789012:role/app", "session_duration": `+duration+`}]}`), 0600)
+		_, err = loadConfig(file.Name())
+		assert.NotNil(err, duration)
+	}
+}
+
+func TestLoadConfigAccounts(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "ec2metaproxy-config")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"accounts": [{"account_id": "210987654321", "profile": "prod"},
+		{"account_id": "345678901234", "role": "arn:aws:iam::345678901234:role/proxy"}]}`)
+	file.Close()
+
+	config, err := loadConfig(file.Name())
+	assert.Nil(err)
+	assert.Equal(2, len(config.Accounts))
+	assert.Equal("prod", config.Accounts[0].Profile)
+	assert.Equal("arn:aws:iam::345678901234:role/proxy", config.Accounts[1].Role.String())
+
+	for _, accounts := range []string{
+		`[{"account_id": "2109876543", "profile": "prod"}]`,
+		`[{"account_id": "210987654321"}]`,
+		`[{"account_id": "210987654321", "profile": "prod", "role": "arn:aws:iam::210987654321:role/proxy"}]`,
+	} {
+		ioutil.WriteFile(file.Name(), []byte(`{"accounts": `+accounts+`}`), 0600)
+		_, err = loadConfig(file.Name())
+		assert.NotNil(err, accounts)
+	}
+}
+
+func TestLoadConfigStsEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "ec2metaproxy-config")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"sts_endpoints": [{"role": "arn:aws:iam::*:role/compliance/*", "endpoint": "https://sts-fips.us-east-1.amazonaws.com"},
+		{"role": "arn:aws:iam::123456789012:role/vpc", "endpoint": "https://vpce-0123.sts.eu-west-1.vpce.amazonaws.com", "region": "eu-west-1"}]}`)
+	file.Close()
+
+	config, err := loadConfig(file.Name())
+	assert.Nil(err)
+	assert.Equal(2, len(config.StsEndpoints))
+	assert.Equal("us-east-1", config.StsEndpoints[0].Region)
+	assert.Equal("eu-west-1", config.StsEndpoints[1].Region)
+
+	role, _ := metaproxy.NewRoleArn("arn:aws:iam::210987654321:role/compliance/app")
+	override, found := config.StsEndpoints.EndpointForRole(role)
+	assert.True(found)
+	assert.Equal("https://sts-fips.us-east-1.amazonaws.com", override.Endpoint)
+
+	for _, endpoints := range []string{
+		`[{"role": "arn:aws:iam::*:role/app", "endpoint": "sts-fips.us-east-1.amazonaws.com"}]`,
+		`[{"role": "arn:aws:iam::*:role/app", "endpoint": "https://sts.example.com"}]`,
+		`[{"role": "", "endpoint": "https://sts.us-east-1.amazonaws.com"}]`,
+	} {
+		ioutil.WriteFile(file.Name(), []byte(`{"sts_endpoints": `+endpoints+`}`), 0600)
+		_, err = loadConfig(file.Name())
+		assert.NotNil(err, endpoints)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "ec2metaproxy-config")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	flagDefaults, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/default")
+
+	cached, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	ioutil.WriteFile(file.Name(), []byte(`{"default_role": "arn:aws:iam::123456789012:role/reloaded"}`), 0600)
+	assert.Nil(reloadConfig(file.Name(), metaproxy.RoleDefaults{RoleArn: flagDefaults}, provider))
+
+	// cached credentials are kept, new containers get the reloaded default role
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(cached.AccessKey, creds.AccessKey)
+
+	containers.Set("172.17.0.3", metaproxy.ContainerInfo{ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"})
+	creds, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/reloaded", creds.RoleArn.String())
+
+	// an invalid file keeps the current configuration
+	ioutil.WriteFile(file.Name(), []byte(`{"default_role": "not-an-arn"}`), 0600)
+	assert.NotNil(reloadConfig(file.Name(), metaproxy.RoleDefaults{RoleArn: flagDefaults}, provider))
+
+	containers.Set("172.17.0.4", metaproxy.ContainerInfo{ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"})
+	creds, err = provider.CredentialsForIP(context.Background(), "172.17.0.4")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/reloaded", creds.RoleArn.String())
+}
@@ -1,13 +1,94 @@
 package main
 
-type containerInfo struct {
-	ID        string
-	Name      string
-	IamRole   roleArn
-	IamPolicy string
+import (
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// refreshTime is when cached container info is checked against the platform again.
+func refreshTime(now time.Time) time.Time {
+	return now.Add(1 * time.Second)
+}
+
+func containsIP(ips []string, containerIP string) bool {
+	for _, ip := range ips {
+		if ip == containerIP {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roleLabels are the keys of the container labels that configure the container role.
+type roleLabels struct {
+	Role            string
+	Policy          string
+	PolicyArns      string
+	ExternalID      string
+	SessionDuration string
+
+	// TagPrefix is the prefix of the labels that are passed as session tags. The
+	// rest of the label key is the tag key.
+	TagPrefix string
+
+	// TransitiveTags contains the comma separated keys of the transitive tags.
+	TransitiveTags string
 }
 
-type containerService interface {
-	ContainerForIP(containerIP string) (containerInfo, error)
-	TypeName() string
+// roleFromLabels reads the role and policy from the container labels. An invalid
+// role is logged and ignored so the container falls back to the default role.
+func (l roleLabels) roleFromLabels(containerID string, labels map[string]string) (metaproxy.RoleArn, string) {
+	var role metaproxy.RoleArn
+
+	if value := strings.TrimSpace(labels[l.Role]); len(value) > 0 {
+		var err error
+		role, err = metaproxy.NewRoleArn(value)
+
+		if err != nil {
+			log.Error("Invalid role in label ", l.Role, " of container ", containerID, ", using default role: ", err)
+		}
+	}
+
+	return role, strings.TrimSpace(labels[l.Policy])
+}
+
+// policyArnsFromLabels reads the comma separated session policy ARNs from the
+// container labels.
+func (l roleLabels) policyArnsFromLabels(containerID string, labels map[string]string) []string {
+	return metaproxy.ParsePolicyArns(containerID, labels[l.PolicyArns])
+}
+
+// sessionDurationFromLabels reads the session duration override from the container
+// labels. An invalid duration is logged and ignored.
+func (l roleLabels) sessionDurationFromLabels(containerID string, labels map[string]string) time.Duration {
+	return metaproxy.ParseSessionDuration(containerID, labels[l.SessionDuration])
+}
+
+// tagsFromLabels reads the session tags from the container labels.
+func (l roleLabels) tagsFromLabels(containerID string, labels map[string]string) metaproxy.SessionTags {
+	if len(l.TagPrefix) == 0 {
+		return metaproxy.SessionTags{}
+	}
+
+	tags := make(map[string]string)
+
+	for key, value := range labels {
+		if strings.HasPrefix(key, l.TagPrefix) {
+			tags[key[len(l.TagPrefix):]] = strings.TrimSpace(value)
+		}
+	}
+
+	var transitiveKeys []string
+
+	for _, key := range strings.Split(labels[l.TransitiveTags], ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			transitiveKeys = append(transitiveKeys, key)
+		}
+	}
+
+	return metaproxy.NewSessionTags(containerID, tags, transitiveKeys)
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagsFromLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	labels := roleLabels{TagPrefix: "com.ec2metaproxy.tag.", TransitiveTags: "com.ec2metaproxy.transitive-tags"}
+	tags := labels.tagsFromLabels("abc", map[string]string{
+		"com.ec2metaproxy.tag.team":        "payments",
+		"com.ec2metaproxy.tag.cost-center": "1234",
+		"com.ec2metaproxy.transitive-tags": "team, cost-center",
+		"other":                            "ignored",
+	})
+
+	assert.Equal(map[string]string{"team": "payments", "cost-center": "1234"}, tags.Tags)
+	assert.Equal([]string{"team", "cost-center"}, tags.TransitiveKeys)
+}
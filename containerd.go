@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+type containerdContainerInfo struct {
+	metaproxy.ContainerInfo
+	RefreshTime time.Time
+}
+
+// containerdConfig configures how the containerd backend reaches containerd.
+type containerdConfig struct {
+	// Address of the containerd socket.
+	Address string
+
+	// Namespace of the containers, k8s.io for containers created through CRI.
+	Namespace string
+
+	// Ctr is the path of the ctr binary used to inspect containers.
+	Ctr string
+
+	// CniResultsDir is the directory where CNI caches the results of the network
+	// setup. containerd does not record container IPs, so they are read from here.
+	CniResultsDir string
+
+	Labels roleLabels
+}
+
+// containerdContainerService resolves containers through the containerd metadata.
+// Container IPs come from the cached CNI results, which are keyed by the container
+// ID for nerdctl and by the pod sandbox ID for CRI.
+type containerdContainerService struct {
+	containerIPMap map[string]containerdContainerInfo
+	config         containerdConfig
+	lock           sync.Mutex
+}
+
+// ctrContainer is the subset of the ctr containers info output that is used.
+type ctrContainer struct {
+	ID     string            `json:"ID"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// cniResult is the subset of a CNI result cache file that is used.
+type cniResult struct {
+	ContainerID string `json:"containerId"`
+	Result      struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+	} `json:"result"`
+}
+
+func newContainerdContainerService(config containerdConfig) (*containerdContainerService, error) {
+	ctr, err := exec.LookPath(config.Ctr)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error finding ctr binary %s: %s", config.Ctr, err)
+	}
+
+	config.Ctr = ctr
+
+	return &containerdContainerService{
+		containerIPMap: make(map[string]containerdContainerInfo),
+		config:         config,
+	}, nil
+}
+
+func (c *containerdContainerService) TypeName() string {
+	return "containerd"
+}
+
+func (c *containerdContainerService) Ping() error {
+	return exec.Command(c.config.Ctr, "--address", c.config.Address, "version").Run()
+}
+
+func (c *containerdContainerService) ContainerForIP(containerIP string) (metaproxy.ContainerInfo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	info, found := c.containerIPMap[containerIP]
+	now := time.Now()
+
+	if !found {
+		c.syncContainers(now)
+		info, found = c.containerIPMap[containerIP]
+	} else if now.After(info.RefreshTime) {
+		info, found = c.syncContainer(containerIP, info, now)
+	}
+
+	if !found {
+		return metaproxy.ContainerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
+	}
+
+	return info.ContainerInfo, nil
+}
+
+// syncContainer confirms that the container still owns the IP. The CNI result is
+// removed when the container network is torn down.
+func (c *containerdContainerService) syncContainer(containerIP string, oldInfo containerdContainerInfo, now time.Time) (containerdContainerInfo, bool) {
+	containerIPs, err := readCniResults(c.config.CniResultsDir)
+
+	if err != nil || !containsIP(containerIPs[oldInfo.ID], containerIP) {
+		log.Debug("Container network changed, refreshing container info: ", oldInfo.ID)
+		c.syncContainers(now)
+		info, found := c.containerIPMap[containerIP]
+		return info, found
+	}
+
+	oldInfo.RefreshTime = refreshTime(now)
+	c.containerIPMap[containerIP] = oldInfo
+	return oldInfo, true
+}
+
+func (c *containerdContainerService) syncContainers(now time.Time) {
+	log.Info("Synchronizing state with containerd containers")
+	containerIPs, err := readCniResults(c.config.CniResultsDir)
+
+	if err != nil {
+		log.Error("Error reading CNI results: ", err)
+		return
+	}
+
+	refreshAt := refreshTime(now)
+	containerIPMap := make(map[string]containerdContainerInfo)
+
+	for containerID, ips := range containerIPs {
+		container, err := c.inspect(containerID)
+
+		if err != nil {
+			log.Debug("Error inspecting container: ", containerID, ": ", err)
+			continue
+		}
+
+		roleArn, iamPolicy := c.config.Labels.roleFromLabels(container.ID, container.Labels)
+
+		for _, ipAddress := range ips {
+			log.Infof("Container: id=%s ip=%s image=%s role=%s", shortContainerID(container.ID), ipAddress, container.Image, roleArn)
+
+			containerIPMap[ipAddress] = containerdContainerInfo{
+				ContainerInfo: metaproxy.ContainerInfo{
+					ID:              container.ID,
+					Name:            container.ID,
+					Image:           container.Image,
+					IamRole:         roleArn,
+					IamPolicy:       iamPolicy,
+					IamPolicyArns:   c.config.Labels.policyArnsFromLabels(container.ID, container.Labels),
+					IamExternalID:   strings.TrimSpace(container.Labels[c.config.Labels.ExternalID]),
+					SessionDuration: c.config.Labels.sessionDurationFromLabels(container.ID, container.Labels),
+					SessionTags:     c.config.Labels.tagsFromLabels(container.ID, container.Labels),
+					Labels:          container.Labels,
+				},
+				RefreshTime: refreshAt,
+			}
+		}
+	}
+
+	c.containerIPMap = containerIPMap
+}
+
+func (c *containerdContainerService) inspect(containerID string) (ctrContainer, error) {
+	output, err := exec.Command(c.config.Ctr,
+		"--address", c.config.Address,
+		"--namespace", c.config.Namespace,
+		"containers", "info", containerID).Output()
+
+	if err != nil {
+		return ctrContainer{}, err
+	}
+
+	var container ctrContainer
+
+	if err := json.Unmarshal(output, &container); err != nil {
+		return ctrContainer{}, fmt.Errorf("Error parsing ctr output: %s", err)
+	}
+
+	return container, nil
+}
+
+// readCniResults returns the normalized IPs of each container ID in the CNI
+// result cache directory.
+func readCniResults(dir string) (map[string][]string, error) {
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	containerIPs := make(map[string][]string)
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+
+		if err != nil {
+			log.Warn("Error reading CNI result ", file.Name(), ": ", err)
+			continue
+		}
+
+		var result cniResult
+
+		if err := json.Unmarshal(data, &result); err != nil || len(result.ContainerID) == 0 {
+			log.Debug("Ignoring invalid CNI result: ", file.Name())
+			continue
+		}
+
+		for _, address := range result.Result.IPs {
+			ip, _, err := net.ParseCIDR(address.Address)
+
+			if err != nil {
+				continue
+			}
+
+			containerIPs[result.ContainerID] = append(containerIPs[result.ContainerID], metaproxy.NormalizeIP(ip.String()))
+		}
+	}
+
+	return containerIPs, nil
+}
+
+func shortContainerID(containerID string) string {
+	if len(containerID) > 6 {
+		return containerID[:6]
+	}
+
+	return containerID
+}
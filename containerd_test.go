@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCniResults(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "cni-results")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "bridge-abc123-eth0"), []byte(`{
+		"kind": "cniCacheV1",
+		"containerId": "abc123",
+		"ifName": "eth0",
+		"result": {"cniVersion": "1.0.0", "ips": [
+			{"address": "10.4.0.5/24", "gateway": "10.4.0.1"},
+			{"address": "fd00::5/64"}
+		]}
+	}`), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "garbage"), []byte(`not json`), 0600)
+
+	containerIPs, err := readCniResults(dir)
+	assert.Nil(err)
+	assert.Equal(map[string][]string{"abc123": {"10.4.0.5", "fd00::5"}}, containerIPs)
+}
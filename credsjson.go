@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// The credentials responses have the exact field names of the AWS endpoints, which the
+// SDKs parse. Every field has a JSON name so renaming a Go field can not change them.
+
+// metadataTimeFormat is the RFC3339 format of the times in metadata responses, in UTC
+// with second precision.
+const metadataTimeFormat = "2006-01-02T15:04:05Z"
+
+// metadataTime formats a time of a metadata response.
+func metadataTime(t time.Time) string {
+	return t.UTC().Format(metadataTimeFormat)
+}
+
+// metadataCredentials is the credentials response of the EC2 metadata service.
+// AccountId is only set by the security-credentials-extended path.
+type metadataCredentials struct {
+	Code            string `json:"Code"`
+	LastUpdated     string `json:"LastUpdated"`
+	Type            string `json:"Type"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+	AccountID       string `json:"AccountId,omitempty"`
+}
+
+// newMetadataCredentials returns the credentials response of the EC2 metadata service.
+func newMetadataCredentials(credentials metaproxy.Credentials) metadataCredentials {
+	return metadataCredentials{
+		Code:            "Success",
+		LastUpdated:     metadataTime(credentials.GeneratedAt),
+		Type:            "AWS-HMAC",
+		AccessKeyID:     credentials.AccessKey,
+		SecretAccessKey: credentials.SecretKey,
+		Token:           credentials.Token,
+		Expiration:      metadataTime(credentials.Expiration),
+	}
+}
+
+// ecsCredentials is the response of the ECS container credentials endpoint, served to
+// the containers and read from the ECS agent for the ecs base credentials.
+type ecsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+	RoleArn         string `json:"RoleArn,omitempty"`
+}
+
+// newECSCredentials returns the response of the ECS container credentials endpoint.
+func newECSCredentials(credentials metaproxy.Credentials) ecsCredentials {
+	return ecsCredentials{
+		AccessKeyID:     credentials.AccessKey,
+		SecretAccessKey: credentials.SecretKey,
+		Token:           credentials.Token,
+		Expiration:      metadataTime(credentials.Expiration),
+		RoleArn:         credentials.RoleArn.String(),
+	}
+}
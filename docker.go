@@ -2,24 +2,43 @@ package main
 
 import (
 	"fmt"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
 	"github.com/fsouza/go-dockerclient"
 )
 
+// dockerEventsRetryDelay is the delay before subscribing to the events again.
+const dockerEventsRetryDelay = 5 * time.Second
+
+var dockerIndexSize = metaproxy.Metrics.Gauge(
+	"docker_container_index_size",
+	"Number of container IPs in the docker container index.")
+
 type dockerContainerInfo struct {
-	containerInfo
+	metaproxy.ContainerInfo
 	RefreshTime time.Time
 }
 
 type dockerContainerService struct {
 	containerIPMap map[string]dockerContainerInfo
 	docker         *docker.Client
+	labels         roleLabels
+	env            roleEnv
+	platform       string
+
+	// cacheTTL is how long container info is used before the container is
+	// inspected again. Not used while events are received.
+	cacheTTL time.Duration
+	watching bool
+	lock     sync.Mutex
 }
 
-func newDockerContainerService(endpoint string) (*dockerContainerService, error) {
+func newDockerContainerService(endpoint string, labels roleLabels, cacheTTL time.Duration) (*dockerContainerService, error) {
 	client, err := docker.NewClient(endpoint)
 
 	if err != nil {
@@ -29,37 +48,66 @@ func newDockerContainerService(endpoint string) (*dockerContainerService, error)
 	return &dockerContainerService{
 		containerIPMap: make(map[string]dockerContainerInfo),
 		docker:         client,
+		labels:         labels,
+		env:            defaultRoleEnv,
+		platform:       "docker",
+		cacheTTL:       cacheTTL,
 	}, nil
 }
 
+// detectPlatform names the platform windows if the daemon runs Windows containers, so
+// their session names tell them apart from Linux containers.
+func (d *dockerContainerService) detectPlatform() {
+	info, err := d.docker.Info()
+
+	if err != nil {
+		log.Warn("Error reading the ", d.platform, " daemon info, assuming Linux containers: ", err)
+		return
+	}
+
+	if strings.EqualFold(info.OSType, "windows") {
+		log.Info("The ", d.platform, " daemon runs Windows containers")
+		d.platform = "windows"
+	}
+}
+
 func (d *dockerContainerService) TypeName() string {
-	return "docker"
+	return d.platform
+}
+
+func (d *dockerContainerService) Ping() error {
+	return d.docker.Ping()
 }
 
-func (d *dockerContainerService) ContainerForIP(containerIP string) (containerInfo, error) {
+func (d *dockerContainerService) ContainerForIP(containerIP string) (metaproxy.ContainerInfo, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	info, found := d.containerIPMap[containerIP]
 	now := time.Now()
 
 	if !found {
 		d.syncContainers(now)
 		info, found = d.containerIPMap[containerIP]
-	} else if now.After(info.RefreshTime) {
+	} else if !d.watching && now.After(info.RefreshTime) {
 		info, found = d.syncContainer(containerIP, info, now)
 	}
 
 	if !found {
-		return containerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
+		return metaproxy.ContainerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
 	}
 
-	return info.containerInfo, nil
+	return info.ContainerInfo, nil
 }
 
 func (d *dockerContainerService) syncContainer(containerIP string, oldInfo dockerContainerInfo, now time.Time) (dockerContainerInfo, bool) {
 	log.Debug("Inspecting container: ", oldInfo.ID)
 	container, err := d.docker.InspectContainer(oldInfo.ID)
 
-	if err != nil || !container.State.Running {
-		if _, ok := err.(*docker.NoSuchContainer); ok {
+	if err != nil || !container.State.Running || !containsIP(getContainerIPs(container.NetworkSettings), containerIP) {
+		if err == nil {
+			log.Debug("Container stopped or changed IP, refreshing container info: ", oldInfo.ID)
+		} else if _, ok := err.(*docker.NoSuchContainer); ok {
 			log.Debug("Container not found, refreshing container info: ", oldInfo.ID)
 		} else {
 			log.Warn("Error inspecting container, refreshing container info: ", oldInfo.ID, ": ", err)
@@ -70,7 +118,7 @@ func (d *dockerContainerService) syncContainer(containerIP string, oldInfo docke
 		return info, found
 	}
 
-	oldInfo.RefreshTime = refreshTime(now)
+	oldInfo.RefreshTime = now.Add(d.cacheTTL)
 	d.containerIPMap[containerIP] = oldInfo
 	return oldInfo, true
 }
@@ -90,82 +138,329 @@ func (d *dockerContainerService) syncContainers(now time.Time) {
 		return
 	}
 
-	refreshAt := refreshTime(now)
+	refreshAt := now.Add(d.cacheTTL)
 	containerIPMap := make(map[string]dockerContainerInfo)
+	ambiguousIPs := make(map[string]bool)
 
 	for _, apiContainer := range apiContainers {
-		container, err := d.docker.InspectContainer(apiContainer.ID)
+		info, containerIPs, ok := d.inspectContainer(apiContainer.ID, refreshAt)
 
-		if err != nil {
-			if _, ok := err.(*docker.NoSuchContainer); ok {
-				log.Debug("Container not found: ", apiContainer.ID)
-			} else {
-				log.Warn("Error inspecting container: ", apiContainer.ID, ": ", err)
+		if !ok {
+			continue
+		}
+
+		for _, ipAddress := range containerIPs {
+			if other, found := containerIPMap[ipAddress]; found && other.ID != info.ID {
+				log.Error("IP address ", ipAddress, " is used by containers ", other.ID, " and ", info.ID, ", ignoring both")
+				ambiguousIPs[ipAddress] = true
 			}
 
-			continue
+			containerIPMap[ipAddress] = info
 		}
+	}
 
-		var containerIPs []string
-		if container.NetworkSettings.IPAddress != "" {
-			containerIPs = append(containerIPs, container.NetworkSettings.IPAddress)
+	for ipAddress := range ambiguousIPs {
+		delete(containerIPMap, ipAddress)
+	}
+
+	d.containerIPMap = containerIPMap
+	dockerIndexSize.Set(int64(len(containerIPMap)))
+}
+
+// inspectContainer returns the info and IPs of a running container. Returns false if
+// the container can not be served.
+func (d *dockerContainerService) inspectContainer(containerID string, refreshAt time.Time) (dockerContainerInfo, []string, bool) {
+	container, err := d.docker.InspectContainer(containerID)
+
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			log.Debug("Container not found: ", containerID)
+		} else {
+			log.Warn("Error inspecting container: ", containerID, ": ", err)
 		}
-		for _, network := range container.NetworkSettings.Networks {
-			containerIPs = append(containerIPs, network.IPAddress)
+
+		return dockerContainerInfo{}, nil, false
+	}
+
+	if !container.State.Running {
+		return dockerContainerInfo{}, nil, false
+	}
+
+	if isUserModeNetwork(container) {
+		log.Warn("Container uses user mode networking, its requests cannot be told apart from the host: ", containerID)
+		return dockerContainerInfo{}, nil, false
+	}
+
+	containerIPs := getContainerIPs(container.NetworkSettings)
+
+	if len(containerIPs) == 0 {
+		log.Error("No IP addresses discovered for container: ", containerID)
+		return dockerContainerInfo{}, nil, false
+	}
+
+	roleArn, iamPolicy, err := d.getContainerRole(container)
+
+	if err != nil {
+		log.Error("Error getting role from container: ", containerID, ": ", err)
+		return dockerContainerInfo{}, nil, false
+	}
+
+	log.Infof("Container: id=%s ips=%s image=%s role=%s", container.ID[:6], strings.Join(containerIPs, ","), container.Config.Image, roleArn)
+
+	return dockerContainerInfo{
+		ContainerInfo: d.containerInfo(container, roleArn, iamPolicy),
+		RefreshTime:   refreshAt,
+	}, containerIPs, true
+}
+
+// ContainerForID inspects the running container with the ID, whatever its network.
+func (d *dockerContainerService) ContainerForID(containerID string) (metaproxy.ContainerInfo, error) {
+	container, err := d.docker.InspectContainer(containerID)
+
+	if err != nil {
+		return metaproxy.ContainerInfo{}, err
+	}
+
+	if !container.State.Running {
+		return metaproxy.ContainerInfo{}, fmt.Errorf("Container %s is not running", containerID)
+	}
+
+	roleArn, iamPolicy, err := d.getContainerRole(container)
+
+	if err != nil {
+		return metaproxy.ContainerInfo{}, fmt.Errorf("Error getting role from container %s: %s", containerID, err)
+	}
+
+	return d.containerInfo(container, roleArn, iamPolicy), nil
+}
+
+func (d *dockerContainerService) containerInfo(container *docker.Container, roleArn metaproxy.RoleArn, iamPolicy string) metaproxy.ContainerInfo {
+	return metaproxy.ContainerInfo{
+		ID:                   container.ID,
+		Name:                 container.Name,
+		Image:                container.Config.Image,
+		IamRole:              roleArn,
+		IamPolicy:            iamPolicy,
+		IamPolicyArns:        d.labels.policyArnsFromLabels(container.ID, container.Config.Labels),
+		IamExternalID:        strings.TrimSpace(container.Config.Labels[d.labels.ExternalID]),
+		WebIdentityTokenFile: getWebIdentityTokenFile(container),
+		SessionDuration:      d.labels.sessionDurationFromLabels(container.ID, container.Config.Labels),
+		SessionTags:          d.labels.tagsFromLabels(container.ID, container.Config.Labels),
+		Labels:               container.Config.Labels,
+	}
+}
+
+// WatchEvents keeps the container index up to date from the docker events stream, so
+// stopped containers are removed immediately instead of after the cache TTL. The index
+// is rebuilt every time the stream is subscribed, since events may have been missed
+// while it was down.
+func (d *dockerContainerService) WatchEvents() {
+	go func() {
+		for {
+			events := make(chan *docker.APIEvents, 100)
+
+			if err := d.docker.AddEventListener(events); err != nil {
+				log.Error("Error subscribing to ", d.platform, " events: ", err)
+				time.Sleep(dockerEventsRetryDelay)
+				continue
+			}
+
+			d.lock.Lock()
+			d.syncContainers(time.Now())
+			d.watching = true
+			d.lock.Unlock()
+
+			for event := range events {
+				d.handleEvent(event)
+			}
+
+			d.lock.Lock()
+			d.watching = false
+			d.lock.Unlock()
+
+			log.Warn("The ", d.platform, " events stream closed, subscribing again")
+			time.Sleep(dockerEventsRetryDelay)
 		}
+	}()
+}
 
-		if len(containerIPs) == 0 {
-			log.Error("No IP addresses discovered for container: ", apiContainer.ID)
-			continue
+func (d *dockerContainerService) handleEvent(event *docker.APIEvents) {
+	containerID, action := eventContainer(event)
+
+	switch action {
+	case "start", "connect", "disconnect":
+		log.Debug("Container ", action, " event: ", containerID)
+		now := time.Now()
+		info, containerIPs, ok := d.inspectContainer(containerID, now.Add(d.cacheTTL))
+
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		d.removeContainer(containerID)
+
+		if ok {
+			for _, ipAddress := range containerIPs {
+				if other, found := d.containerIPMap[ipAddress]; found {
+					log.Error("IP address ", ipAddress, " is used by containers ", other.ID, " and ", info.ID, ", ignoring both")
+					delete(d.containerIPMap, ipAddress)
+					continue
+				}
+
+				d.containerIPMap[ipAddress] = info
+			}
 		}
+	case "die", "destroy":
+		log.Debug("Container ", action, " event: ", containerID)
 
-		roleArn, iamPolicy, err := getRoleArnFromEnv(container.Config.Env)
+		d.lock.Lock()
+		defer d.lock.Unlock()
 
-		if err != nil {
-			log.Error("Error getting role from container: ", apiContainer.ID, ": ", err)
-			continue
+		d.removeContainer(containerID)
+	default:
+		return
+	}
+
+	dockerIndexSize.Set(int64(len(d.containerIPMap)))
+}
+
+func (d *dockerContainerService) removeContainer(containerID string) {
+	for ipAddress, info := range d.containerIPMap {
+		if info.ID == containerID {
+			delete(d.containerIPMap, ipAddress)
 		}
+	}
+}
 
-		for _, ipAddress := range containerIPs {
-			log.Infof("Container: id=%s ip=%s image=%s role=%s", container.ID[:6], ipAddress, container.Config.Image, roleArn)
-
-			containerIPMap[ipAddress] = dockerContainerInfo{
-				containerInfo: containerInfo{
-					ID:        container.ID,
-					Name:      container.Name,
-					IamRole:   roleArn,
-					IamPolicy: iamPolicy,
-				},
-				RefreshTime: refreshAt,
-			}
+// eventContainer returns the container ID and action of container and network events.
+func eventContainer(event *docker.APIEvents) (string, string) {
+	switch event.Type {
+	case "container":
+		return event.Actor.ID, event.Action
+	case "network":
+		return event.Actor.Attributes["container"], event.Action
+	case "":
+		// API versions before 1.22 only have container events
+		return event.ID, event.Status
+	default:
+		return "", ""
+	}
+}
+
+// getContainerIPs returns the normalized IPv4 and IPv6 addresses of the container on
+// the default bridge and all other networks.
+// getContainerIPs returns the IPs of all networks of the container. Windows containers
+// only report their IPs in the networks, such as nat, not in the top level settings.
+func getContainerIPs(settings *docker.NetworkSettings) []string {
+	if settings == nil {
+		return nil
+	}
+
+	var containerIPs []string
+	seen := make(map[string]bool)
+
+	add := func(address string) {
+		if ip := metaproxy.NormalizeIP(address); len(ip) > 0 && !seen[ip] {
+			seen[ip] = true
+			containerIPs = append(containerIPs, ip)
 		}
 	}
 
-	d.containerIPMap = containerIPMap
+	add(settings.IPAddress)
+	add(settings.GlobalIPv6Address)
+
+	for _, address := range settings.SecondaryIPAddresses {
+		add(address)
+	}
+
+	for _, address := range settings.SecondaryIPv6Addresses {
+		add(address)
+	}
+
+	for _, network := range settings.Networks {
+		add(network.IPAddress)
+		add(network.GlobalIPv6Address)
+	}
+
+	return containerIPs
 }
 
-func refreshTime(now time.Time) time.Time {
-	return now.Add(1 * time.Second)
+// roleEnv configures the container environment variables that contain the role
+// and policy of the container.
+type roleEnv struct {
+	Role   string
+	Policy string
+
+	// Only ignores the labels, so the role is only read from the environment.
+	Only bool
+}
+
+var defaultRoleEnv = roleEnv{Role: "IAM_ROLE", Policy: "IAM_POLICY"}
+
+// getContainerRole reads the role and policy from the container labels. The
+// environment variables are only used if the container has none of the labels.
+func (d *dockerContainerService) getContainerRole(container *docker.Container) (metaproxy.RoleArn, string, error) {
+	_, hasRole := container.Config.Labels[d.labels.Role]
+	_, hasPolicy := container.Config.Labels[d.labels.Policy]
+
+	if d.env.Only || (!hasRole && !hasPolicy) {
+		return getRoleArnFromEnv(container.Config.Env, d.env)
+	}
+
+	role, policy := d.labels.roleFromLabels(container.ID, container.Config.Labels)
+	return role, policy, nil
 }
 
-func getRoleArnFromEnv(env []string) (role roleArn, policy string, err error) {
+// getRoleArnFromEnv reads the role and policy from the environment variables. The
+// role is empty if the variable is not set, so the default role is used.
+func getRoleArnFromEnv(env []string, names roleEnv) (role metaproxy.RoleArn, policy string, err error) {
 	for _, e := range env {
 		v := strings.SplitN(e, "=", 2)
 
-		if v[0] == "IAM_ROLE" && len(v) > 1 {
+		if v[0] == names.Role && len(v) > 1 {
 			roleArn := strings.TrimSpace(v[1])
 
 			if len(roleArn) > 0 {
-				role, err = newRoleArn(roleArn)
+				role, err = metaproxy.NewRoleArn(roleArn)
 
 				if err != nil {
 					return
 				}
 			}
-		} else if v[0] == "IAM_POLICY" && len(v) > 1 {
+		} else if v[0] == names.Policy && len(v) > 1 {
 			policy = strings.TrimSpace(v[1])
 		}
 	}
 
 	return
 }
+
+// getWebIdentityTokenFile resolves the AWS_WEB_IDENTITY_TOKEN_FILE path of the container
+// to the corresponding path on the host using the container mounts.
+func getWebIdentityTokenFile(container *docker.Container) string {
+	var tokenFile string
+
+	for _, e := range container.Config.Env {
+		v := strings.SplitN(e, "=", 2)
+
+		if v[0] == "AWS_WEB_IDENTITY_TOKEN_FILE" && len(v) > 1 {
+			tokenFile = path.Clean(strings.TrimSpace(v[1]))
+		}
+	}
+
+	if len(tokenFile) == 0 {
+		return ""
+	}
+
+	for _, mount := range container.Mounts {
+		if tokenFile == mount.Destination {
+			return mount.Source
+		}
+
+		if strings.HasPrefix(tokenFile, mount.Destination+"/") {
+			return path.Join(mount.Source, tokenFile[len(mount.Destination):])
+		}
+	}
+
+	log.Warn("Web identity token file is not mounted from the host: ", container.ID, ": ", tokenFile)
+	return ""
+}
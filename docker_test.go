@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetContainerIPsDualStack(t *testing.T) {
+	assert := assert.New(t)
+
+	ips := getContainerIPs(&docker.NetworkSettings{
+		IPAddress:         "172.17.0.2",
+		GlobalIPv6Address: "2001:DB8::0242:ac11:2",
+		Networks: map[string]docker.ContainerNetwork{
+			"bridge": {IPAddress: "172.17.0.2", GlobalIPv6Address: "2001:db8::242:ac11:2"},
+			"tenant": {IPAddress: "10.0.0.5"},
+		},
+	})
+
+	assert.Len(ips, 3)
+	assert.Contains(ips, "172.17.0.2")
+	assert.Contains(ips, "2001:db8::242:ac11:2")
+	assert.Contains(ips, "10.0.0.5")
+}
+
+func TestGetContainerIPsWindowsNat(t *testing.T) {
+	assert := assert.New(t)
+
+	// Windows containers only report the IP of the nat network
+	ips := getContainerIPs(&docker.NetworkSettings{
+		Networks: map[string]docker.ContainerNetwork{
+			"nat": {IPAddress: "172.25.160.5", MacAddress: "00:15:5d:7a:11:9c"},
+		},
+	})
+
+	assert.Equal([]string{"172.25.160.5"}, ips)
+}
+
+func TestDetectPlatformWindows(t *testing.T) {
+	assert := assert.New(t)
+
+	osType := "windows"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"OSType": %q}`, osType)
+	}))
+	defer server.Close()
+
+	service, err := newDockerContainerService(server.URL, roleLabels{}, 0)
+	assert.Nil(err)
+	service.detectPlatform()
+	assert.Equal("windows", service.TypeName())
+
+	osType = "linux"
+	service, err = newDockerContainerService(server.URL, roleLabels{}, 0)
+	assert.Nil(err)
+	service.detectPlatform()
+	assert.Equal("docker", service.TypeName())
+}
+
+func TestGetContainerIPsNone(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(getContainerIPs(&docker.NetworkSettings{}))
+	assert.Empty(getContainerIPs(nil))
+}
+
+func TestRemoteIP(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("172.17.0.2", remoteIP("172.17.0.2:41234"))
+	assert.Equal("172.17.0.2", remoteIP("[::ffff:172.17.0.2]:41234"))
+	assert.Equal("2001:db8::242:ac11:2", remoteIP("[2001:DB8:0::242:ac11:2]:41234"))
+	assert.Equal("172.17.0.2", remoteIP("172.17.0.2"))
+}
+
+func TestHandleEventRemovesStoppedContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &dockerContainerService{containerIPMap: map[string]dockerContainerInfo{
+		"172.17.0.2": {ContainerInfo: metaproxy.ContainerInfo{ID: "abc"}},
+		"fd00::2":    {ContainerInfo: metaproxy.ContainerInfo{ID: "abc"}},
+		"172.17.0.3": {ContainerInfo: metaproxy.ContainerInfo{ID: "def"}},
+	}}
+
+	service.handleEvent(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "abc"}})
+
+	assert.Len(service.containerIPMap, 1)
+	assert.Equal("def", service.containerIPMap["172.17.0.3"].ID)
+}
+
+func TestEventContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	id, action := eventContainer(&docker.APIEvents{Type: "network", Action: "disconnect", Actor: docker.APIActor{Attributes: map[string]string{"container": "abc"}}})
+	assert.Equal("abc", id)
+	assert.Equal("disconnect", action)
+
+	id, action = eventContainer(&docker.APIEvents{Status: "start", ID: "def"})
+	assert.Equal("def", id)
+	assert.Equal("start", action)
+}
+
+func TestGetContainerRoleFromLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &dockerContainerService{
+		labels: roleLabels{Role: "com.ec2metaproxy.role", Policy: "com.ec2metaproxy.policy"},
+		env:    defaultRoleEnv,
+	}
+	container := &docker.Container{ID: "abc", Config: &docker.Config{
+		Labels: map[string]string{"com.ec2metaproxy.role": "arn:aws:iam::123456789012:role/label", "com.ec2metaproxy.policy": ` {"Version":"2012-10-17"} `},
+		Env:    []string{"IAM_ROLE=arn:aws:iam::123456789012:role/env", "IAM_POLICY={}"},
+	}}
+
+	role, policy, err := service.getContainerRole(container)
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/label", role.String())
+	assert.Equal(`{"Version":"2012-10-17"}`, policy)
+
+	// the environment is only read without the labels
+	container.Config.Labels = map[string]string{"other": "label"}
+	role, policy, err = service.getContainerRole(container)
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/env", role.String())
+	assert.Equal("{}", policy)
+
+	// a malformed role label falls back to the default role instead of failing
+	container.Config.Labels = map[string]string{"com.ec2metaproxy.role": "not-an-arn"}
+	role, policy, err = service.getContainerRole(container)
+	assert.Nil(err)
+	assert.True(role.Empty())
+	assert.Equal("", policy)
+}
+
+func TestGetContainerRoleEnvOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &dockerContainerService{
+		labels: roleLabels{Role: "com.ec2metaproxy.role"},
+		env:    roleEnv{Role: "APP_ROLE", Policy: "APP_POLICY", Only: true},
+	}
+	container := &docker.Container{Config: &docker.Config{
+		Labels: map[string]string{"com.ec2metaproxy.role": "arn:aws:iam::123456789012:role/label"},
+		Env:    []string{"IAM_ROLE=arn:aws:iam::123456789012:role/other", "APP_ROLE=arn:aws:iam::123456789012:role/env"},
+	}}
+
+	role, policy, err := service.getContainerRole(container)
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/env", role.String())
+	assert.Equal("", policy)
+
+	// without the variable the default role is used
+	container.Config.Env = nil
+	role, _, err = service.getContainerRole(container)
+	assert.Nil(err)
+	assert.True(role.Empty())
+}
+
+// fakeDockerDaemon serves the running containers from the list and inspect APIs and
+// counts the calls.
+type fakeDockerDaemon struct {
+	containers map[string]string // container ID to IP
+	lists      int
+	inspects   int
+	lock       sync.Mutex
+}
+
+func (f *fakeDockerDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if strings.HasSuffix(r.URL.Path, "/containers/json") {
+		f.lists++
+		var ids []string
+
+		for id := range f.containers {
+			ids = append(ids, fmt.Sprintf(`{"Id": %q}`, id))
+		}
+
+		fmt.Fprintf(w, "[%s]", strings.Join(ids, ","))
+		return
+	}
+
+	f.inspects++
+	id := path.Base(path.Dir(r.URL.Path))
+	ip, found := f.containers[id]
+
+	if !found {
+		http.Error(w, `{"message": "No such container"}`, http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, `{"Id": %q, "State": {"Running": true}, "Config": {"Image": "app"}, "NetworkSettings": {"IPAddress": %q}}`, id, ip)
+}
+
+func (f *fakeDockerDaemon) set(id, ip string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.containers[id] = ip
+}
+
+func (f *fakeDockerDaemon) remove(id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.containers, id)
+}
+
+func (f *fakeDockerDaemon) calls() (lists, inspects int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.lists, f.inspects
+}
+
+func newFakeDockerService(t *testing.T, containers map[string]string, cacheTTL time.Duration) (*dockerContainerService, *fakeDockerDaemon, func()) {
+	daemon := &fakeDockerDaemon{containers: containers}
+	server := httptest.NewServer(daemon)
+	service, err := newDockerContainerService(server.URL, roleLabels{}, cacheTTL)
+
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return service, daemon, server.Close
+}
+
+// expire makes the cached container of the IP due for a refresh.
+func expire(service *dockerContainerService, containerIP string) {
+	info := service.containerIPMap[containerIP]
+	info.RefreshTime = time.Now().Add(-time.Second)
+	service.containerIPMap[containerIP] = info
+}
+
+func TestContainerForIPCached(t *testing.T) {
+	assert := assert.New(t)
+
+	service, daemon, closeServer := newFakeDockerService(t, map[string]string{"aaaaaaaa": "172.17.0.2"}, time.Hour)
+	defer closeServer()
+
+	info, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("aaaaaaaa", info.ID)
+	lists, inspects := daemon.calls()
+	assert.Equal(1, lists)
+	assert.Equal(1, inspects)
+
+	// the container is not inspected again before the TTL
+	info, err = service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("aaaaaaaa", info.ID)
+	lists, inspects = daemon.calls()
+	assert.Equal(1, lists)
+	assert.Equal(1, inspects)
+}
+
+func TestContainerForIPRefreshedAfterTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	service, daemon, closeServer := newFakeDockerService(t, map[string]string{"aaaaaaaa": "172.17.0.2"}, time.Hour)
+	defer closeServer()
+
+	_, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+
+	// an expired container that still runs is inspected without listing the containers
+	expire(service, "172.17.0.2")
+
+	info, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("aaaaaaaa", info.ID)
+	lists, inspects := daemon.calls()
+	assert.Equal(1, lists)
+	assert.Equal(2, inspects)
+	assert.True(service.containerIPMap["172.17.0.2"].RefreshTime.After(time.Now().Add(59 * time.Minute)))
+}
+
+func TestContainerForIPExpiredContainerReplaced(t *testing.T) {
+	assert := assert.New(t)
+
+	service, daemon, closeServer := newFakeDockerService(t, map[string]string{"aaaaaaaa": "172.17.0.2"}, time.Hour)
+	defer closeServer()
+
+	_, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+
+	// the container exited and its IP was given to another container
+	expire(service, "172.17.0.2")
+	daemon.remove("aaaaaaaa")
+	daemon.set("bbbbbbbb", "172.17.0.2")
+
+	info, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("bbbbbbbb", info.ID)
+	lists, _ := daemon.calls()
+	assert.Equal(2, lists)
+
+	// the IP is not served once no container has it
+	expire(service, "172.17.0.2")
+	daemon.remove("bbbbbbbb")
+	_, err = service.ContainerForIP("172.17.0.2")
+	assert.NotNil(err)
+}
+
+func TestContainerForIPNotRefreshedWhileWatching(t *testing.T) {
+	assert := assert.New(t)
+
+	service, daemon, closeServer := newFakeDockerService(t, map[string]string{"aaaaaaaa": "172.17.0.2"}, time.Hour)
+	defer closeServer()
+
+	_, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+
+	// the events stream removes stopped containers, so the TTL is not used
+	service.watching = true
+	expire(service, "172.17.0.2")
+	daemon.remove("aaaaaaaa")
+
+	info, err := service.ContainerForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("aaaaaaaa", info.ID)
+	lists, inspects := daemon.calls()
+	assert.Equal(1, lists)
+	assert.Equal(1, inspects)
+}
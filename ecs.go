@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// ecsTokenPath is where containers get the token of their ECS credentials path.
+const ecsTokenPath = "/creds"
+
+var ecsCredentialsRegex = regexp.MustCompile(`^/creds/([\w-]{8,128})$`)
+
+// ecsTokens issues and validates the tokens in the paths of the ECS credentials
+// endpoint. A token is an HMAC of the key of the container it was issued to, so it can
+// not be used from another container. Unlike IMDSv2 tokens they do not expire, since
+// SDKs read the path once from the environment.
+type ecsTokens struct {
+	secret []byte
+}
+
+// newECSTokens creates the tokens with the secret of the file, or with a random
+// secret if the file is not set. Tokens of a random secret are only valid until
+// the proxy restarts.
+func newECSTokens(secretFile string) (*ecsTokens, error) {
+	if len(secretFile) == 0 {
+		secret := make([]byte, 32)
+
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+
+		return &ecsTokens{secret}, nil
+	}
+
+	secret, err := ioutil.ReadFile(secretFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error reading ECS token secret file %s: %s", secretFile, err)
+	}
+
+	secret = bytes.TrimSpace(secret)
+
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("ECS token secret file %s must contain at least 16 bytes", secretFile)
+	}
+
+	return &ecsTokens{secret}, nil
+}
+
+func (t *ecsTokens) Generate(containerKey string) string {
+	return base64.RawURLEncoding.EncodeToString(t.sign(containerKey))
+}
+
+func (t *ecsTokens) Validate(containerKey, token string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && hmac.Equal(data, t.sign(containerKey))
+}
+
+func (t *ecsTokens) sign(containerKey string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(containerKey))
+	return mac.Sum(nil)
+}
+
+// handleECSTokenRequest issues the token of the ECS credentials path to the container.
+// Like IMDSv2 token requests, they must be PUT so they can not be forwarded by
+// applications that only make GET requests on behalf of users.
+func handleECSTokenRequest(tokens *ecsTokens, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := containerKey(c, r)
+
+	if err != nil {
+		log.Error(remoteIP(r.RemoteAddr), " Error identifying container: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(tokens.Generate(key)))
+}
+
+// handleECSCredentials serves the credentials of the container in the format of the ECS
+// container credentials endpoint, for SDKs configured with
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI.
+func handleECSCredentials(token string, tokens *ecsTokens, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	if chaos.Inject(w, r) {
+		return
+	}
+
+	clientIP := remoteIP(r.RemoteAddr)
+	key, err := containerKey(c, r)
+
+	if err != nil {
+		log.Error(clientIP, " Error identifying container: ", err)
+		writeCredentialsError(w, err)
+		return
+	}
+
+	// checked first so other containers can not make the proxy assume the role
+	if !tokens.Validate(key, token) {
+		log.Warn(clientIP, " Requested ECS credentials with the token of another container or proxy")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ctx, cacheStatus := metaproxy.WithCacheStatus(r.Context())
+	credentials, err := c.CredentialsForIP(ctx, key)
+
+	if _, ok := err.(metaproxy.NoRoleForContainerError); ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(clientIP, " ", err)
+		writeCredentialsError(w, err)
+		return
+	}
+
+	response := newECSCredentials(credentials)
+	body, err := json.Marshal(&response)
+
+	if err != nil {
+		log.Error("Error marshaling credentials: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeDebugHeaders(w, credentials, *cacheStatus)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
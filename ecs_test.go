@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleECSCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	tokens, err := newECSTokens("")
+	assert.Nil(err)
+
+	issue := func(clientIP string) string {
+		r := httptest.NewRequest("PUT", ecsTokenPath, nil)
+		r.RemoteAddr = clientIP + ":41234"
+		w := httptest.NewRecorder()
+		handleECSTokenRequest(tokens, provider, w, r)
+		assert.Equal(http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	request := func(clientIP, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/creds/"+token, nil)
+		r.RemoteAddr = clientIP + ":41234"
+		w := httptest.NewRecorder()
+		handleECSCredentials(token, tokens, provider, w, r)
+		return w
+	}
+
+	token := issue("172.17.0.2")
+	assert.Regexp(ecsCredentialsRegex, "/creds/"+token)
+
+	resp := request("172.17.0.2", token)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	var creds map[string]string
+	assert.Nil(json.Unmarshal(resp.Body.Bytes(), &creds))
+	assert.Contains(creds["AccessKeyId"], "ASIATEST")
+	assert.Equal("arn:aws:iam::123456789012:role/default", creds["RoleArn"])
+	assert.NotEmpty(creds["SecretAccessKey"])
+	assert.NotEmpty(creds["Token"])
+	assert.NotEmpty(creds["Expiration"])
+
+	assert.Equal(http.StatusOK, request("172.17.0.2", token).Code)
+
+	// rejected before the credentials of the other container are assumed
+	assert.Equal(http.StatusForbidden, request("172.17.0.3", token).Code)
+	assert.Equal(http.StatusForbidden, request("172.17.0.3", "chosen-by-client").Code)
+	assert.Equal(1, stsServer.Calls())
+
+	assert.Equal(http.StatusOK, request("172.17.0.3", issue("172.17.0.3")).Code)
+}
+
+func TestECSTokensSecretFile(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFile, err := ioutil.TempFile("", "secret")
+	assert.Nil(err)
+	defer os.Remove(secretFile.Name())
+
+	_, err = newECSTokens(secretFile.Name())
+	assert.NotNil(err, "the secret is too short")
+
+	secretFile.WriteString("0123456789abcdef0123456789abcdef\n")
+	secretFile.Close()
+
+	tokens, err := newECSTokens(secretFile.Name())
+	assert.Nil(err)
+	restarted, err := newECSTokens(secretFile.Name())
+	assert.Nil(err)
+	random, _ := newECSTokens("")
+
+	token := tokens.Generate("172.17.0.2")
+	assert.True(restarted.Validate("172.17.0.2", token))
+	assert.False(restarted.Validate("172.17.0.3", token))
+	assert.False(random.Validate("172.17.0.2", token))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// stsEndpointConfig returns the client config for the STS endpoint. Without a region
+// or endpoint the global STS endpoint is used. With only a region, the regional STS
+// endpoint of the region is used. A custom endpoint, such as a VPC interface endpoint,
+// requires the region to sign requests for.
+//
+// partition is the partition of the roles, if known. The GovCloud and China partitions
+// have no global STS endpoint, so they default to the endpoint of their first region.
+func stsEndpointConfig(region, endpoint, partition string) (*aws.Config, error) {
+	config := &aws.Config{}
+
+	if len(endpoint) > 0 && len(region) == 0 {
+		return nil, fmt.Errorf("STS region is required with STS endpoint %s", endpoint)
+	}
+
+	if len(region) == 0 {
+		region = partitionRegions[partition]
+	} else if len(partition) > 0 && regionPartition(region) != partition {
+		return nil, fmt.Errorf("STS region %s is not in the %s partition of the default role", region, partition)
+	}
+
+	if len(region) > 0 {
+		config.Region = aws.String(region)
+
+		if len(endpoint) == 0 {
+			endpoint = regionalStsEndpoint(region)
+		}
+	}
+
+	if len(endpoint) > 0 {
+		if err := validateEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+
+		config.Endpoint = aws.String(endpoint)
+	}
+
+	return config, nil
+}
+
+// partitionRegions are the default STS regions of the partitions without a global
+// STS endpoint.
+var partitionRegions = map[string]string{
+	"aws-us-gov": "us-gov-west-1",
+	"aws-cn":     "cn-north-1",
+}
+
+// regionPartition returns the partition of region: aws, aws-us-gov or aws-cn.
+func regionPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	default:
+		return "aws"
+	}
+}
+
+const globalStsEndpoint = "https://sts.amazonaws.com"
+
+var regionalStsHostRegexp = regexp.MustCompile(`^sts(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// stsFailoverConfigs returns the client configs of the STS endpoints to fail over to,
+// in order. "global" is the global endpoint. Requests to the global endpoint are
+// signed for us-east-1 and to regional endpoints for their region. Other endpoints
+// are signed for the STS region.
+func stsFailoverConfigs(endpoints []string, region string) ([]*aws.Config, error) {
+	var configs []*aws.Config
+
+	for _, endpoint := range endpoints {
+		if endpoint == "global" {
+			if partition := regionPartition(region); partition != "aws" {
+				return nil, fmt.Errorf("There is no global STS endpoint in the %s partition of region %s", partition, region)
+			}
+
+			endpoint = globalStsEndpoint
+		}
+
+		if err := validateEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+
+		signingRegion := endpointSigningRegion(endpoint, region)
+
+		if len(signingRegion) == 0 {
+			return nil, fmt.Errorf("STS region is required with STS failover endpoint %s", endpoint)
+		}
+
+		configs = append(configs, &aws.Config{
+			Endpoint: aws.String(endpoint),
+			Region:   aws.String(signingRegion),
+		})
+	}
+
+	return configs, nil
+}
+
+// endpointSigningRegion returns the region that requests to a valid endpoint are signed
+// for: us-east-1 for the global endpoint, the region of regional and FIPS endpoints, or
+// region for other endpoints.
+func endpointSigningRegion(endpoint, region string) string {
+	u, _ := url.Parse(endpoint)
+
+	if u.Host == "sts.amazonaws.com" {
+		return "us-east-1"
+	} else if match := regionalStsHostRegexp.FindStringSubmatch(u.Host); match != nil {
+		return match[1]
+	}
+
+	return region
+}
+
+func regionalStsEndpoint(region string) string {
+	if strings.HasPrefix(region, "cn-") {
+		return fmt.Sprintf("https://sts.%s.amazonaws.com.cn", region)
+	}
+
+	return fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+}
+
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+
+	if err != nil {
+		return fmt.Errorf("Invalid endpoint URL %s: %s", endpoint, err)
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+		return fmt.Errorf("Invalid endpoint URL %s: expected http(s)://host[:port]", endpoint)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStsEndpointConfigPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	// commercial roles keep using the global endpoint
+	config, err := stsEndpointConfig("", "", "aws")
+	assert.Nil(err)
+	assert.Nil(config.Endpoint)
+	assert.Nil(config.Region)
+
+	config, err = stsEndpointConfig("", "", "aws-us-gov")
+	assert.Nil(err)
+	assert.Equal("https://sts.us-gov-west-1.amazonaws.com", aws.StringValue(config.Endpoint))
+	assert.Equal("us-gov-west-1", aws.StringValue(config.Region))
+
+	config, err = stsEndpointConfig("cn-northwest-1", "", "aws-cn")
+	assert.Nil(err)
+	assert.Equal("https://sts.cn-northwest-1.amazonaws.com.cn", aws.StringValue(config.Endpoint))
+
+	_, err = stsEndpointConfig("us-west-2", "", "aws-us-gov")
+	assert.NotNil(err)
+}
+
+func TestStsEndpointConfigOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	// the regional endpoint of the region
+	config, err := stsEndpointConfig("us-west-2", "", "aws")
+	assert.Nil(err)
+	assert.Equal("https://sts.us-west-2.amazonaws.com", aws.StringValue(config.Endpoint))
+	assert.Equal("us-west-2", aws.StringValue(config.Region))
+
+	// a VPC interface endpoint is signed for the region
+	config, err = stsEndpointConfig("eu-west-1", "https://vpce-0123-abcd.sts.eu-west-1.vpce.amazonaws.com", "aws")
+	assert.Nil(err)
+	assert.Equal("https://vpce-0123-abcd.sts.eu-west-1.vpce.amazonaws.com", aws.StringValue(config.Endpoint))
+	assert.Equal("eu-west-1", aws.StringValue(config.Region))
+
+	_, err = stsEndpointConfig("", "https://vpce-0123-abcd.sts.eu-west-1.vpce.amazonaws.com", "aws")
+	assert.NotNil(err)
+
+	for _, endpoint := range []string{
+		"sts.us-west-2.amazonaws.com",
+		"ftp://sts.us-west-2.amazonaws.com",
+		"https://",
+		"https://sts.us-west-2.amazonaws.com:port",
+	} {
+		_, err = stsEndpointConfig("us-west-2", endpoint, "aws")
+		assert.NotNil(err, endpoint)
+	}
+}
+
+func TestEndpointSigningRegion(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("us-east-1", endpointSigningRegion("https://sts.amazonaws.com", "eu-west-1"))
+	assert.Equal("ap-southeast-2", endpointSigningRegion("https://sts.ap-southeast-2.amazonaws.com", "eu-west-1"))
+	assert.Equal("eu-west-1", endpointSigningRegion("https://vpce-0123-abcd.sts.eu-west-1.vpce.amazonaws.com", "eu-west-1"))
+}
+
+func TestStsEndpointConfigProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	// the base session points at an endpoint that is down
+	unreachable := ststest.NewServer()
+	unreachable.Close()
+
+	config, err := stsEndpointConfig("us-west-2", stsServer.URL, "aws")
+	assert.Nil(err)
+
+	defaultRole, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/default")
+	containers := metaproxy.NewMemoryContainerService("test", map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := metaproxy.NewCredentialsProvider(unreachable.Session(), containers, metaproxy.CredentialsProviderConfig{
+		Defaults:        metaproxy.RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Sts:             config,
+		Retry:           metaproxy.Backoff{MaxAttempts: 1},
+	})
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(1, stsServer.Calls())
+}
+
+func TestStsFailoverConfigsGlobalPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	configs, err := stsFailoverConfigs([]string{"global"}, "us-west-2")
+	assert.Nil(err)
+	assert.Equal("us-east-1", aws.StringValue(configs[0].Region))
+
+	_, err = stsFailoverConfigs([]string{"global"}, "us-gov-east-1")
+	assert.NotNil(err)
+
+	configs, err = stsFailoverConfigs([]string{"https://sts.us-gov-east-1.amazonaws.com"}, "us-gov-west-1")
+	assert.Nil(err)
+	assert.Equal("us-gov-east-1", aws.StringValue(configs[0].Region))
+}
@@ -2,23 +2,26 @@ package main
 
 import (
 	"fmt"
-
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 )
 
 type flynnContainerInfo struct {
-	containerInfo
+	metaproxy.ContainerInfo
 	RefreshTime time.Time
 }
 
 type flynnContainerService struct {
 	containerIPMap map[string]flynnContainerInfo
 	flynn          *cluster.Host
+	lock           sync.Mutex
 }
 
 func newFlynnContainerService(endpoint string) (*flynnContainerService, error) {
@@ -34,7 +37,15 @@ func (f *flynnContainerService) TypeName() string {
 	return "flynn"
 }
 
-func (f *flynnContainerService) ContainerForIP(containerIP string) (containerInfo, error) {
+func (f *flynnContainerService) Ping() error {
+	_, err := f.flynn.ListJobs()
+	return err
+}
+
+func (f *flynnContainerService) ContainerForIP(containerIP string) (metaproxy.ContainerInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	info, found := f.containerIPMap[containerIP]
 	now := time.Now()
 
@@ -46,10 +57,10 @@ func (f *flynnContainerService) ContainerForIP(containerIP string) (containerInf
 	}
 
 	if !found {
-		return containerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
+		return metaproxy.ContainerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
 	}
 
-	return info.containerInfo, nil
+	return info.ContainerInfo, nil
 }
 
 func (f *flynnContainerService) syncContainer(containerIP string, oldInfo flynnContainerInfo, now time.Time) (flynnContainerInfo, bool) {
@@ -86,35 +97,83 @@ func (f *flynnContainerService) syncContainers(now time.Time) {
 	containerIPMap := make(map[string]flynnContainerInfo)
 
 	for _, job := range jobs {
-		roleArn, err := getRoleArnFromJob(job.Job)
+		container, err := getContainerFromJob(job.Job)
 
 		if err != nil {
 			log.Error("Error getting role from container: ", job.ContainerID, ": ", err)
 			continue
 		}
 
-		log.Infof("Job: id=%s role=%s", job.Job.ID, roleArn)
-
-		containerIPMap[job.InternalIP] = flynnContainerInfo{
-			containerInfo: containerInfo{
-				ID:        job.Job.ID,
-				Name:      job.Job.ID,
-				IamRole:   roleArn,
-				IamPolicy: strings.TrimSpace(job.Job.Metadata["IAM_POLICY"]),
-			},
-			RefreshTime: refreshAt,
-		}
+		log.Infof("Job: id=%s role=%s", job.Job.ID, container.IamRole)
+		containerIPMap[metaproxy.NormalizeIP(job.InternalIP)] = flynnContainerInfo{container, refreshAt}
 	}
 
 	f.containerIPMap = containerIPMap
 }
 
-func getRoleArnFromJob(job *host.Job) (roleArn, error) {
+// getContainerFromJob reads the role of the container from the metadata of the job.
+func getContainerFromJob(job *host.Job) (metaproxy.ContainerInfo, error) {
+	roleArn, err := getRoleArnFromJob(job)
+
+	if err != nil {
+		return metaproxy.ContainerInfo{}, err
+	}
+
+	return metaproxy.ContainerInfo{
+		ID:                   job.ID,
+		Name:                 job.ID,
+		Image:                getImageFromJob(job),
+		IamRole:              roleArn,
+		IamPolicy:            strings.TrimSpace(job.Metadata["IAM_POLICY"]),
+		IamPolicyArns:        metaproxy.ParsePolicyArns(job.ID, job.Metadata["IAM_POLICY_ARNS"]),
+		IamExternalID:        strings.TrimSpace(job.Metadata["IAM_EXTERNAL_ID"]),
+		WebIdentityTokenFile: getWebIdentityTokenFileFromJob(job),
+		SessionDuration:      metaproxy.ParseSessionDuration(job.ID, job.Metadata["IAM_SESSION_DURATION"]),
+	}, nil
+}
+
+func getRoleArnFromJob(job *host.Job) (metaproxy.RoleArn, error) {
 	roleArnStr := job.Metadata["IAM_ROLE"]
 
 	if len(roleArnStr) > 0 {
-		return newRoleArn(roleArnStr)
+		return metaproxy.NewRoleArn(roleArnStr)
+	}
+
+	return metaproxy.RoleArn{}, nil
+}
+
+// getWebIdentityTokenFileFromJob resolves the IAM_WEB_IDENTITY_TOKEN_FILE path of the
+// job to the corresponding path on the host using the mounts of the job. Paths that are
+// not mounted from the host are ignored.
+func getWebIdentityTokenFileFromJob(job *host.Job) string {
+	tokenFile := strings.TrimSpace(job.Metadata["IAM_WEB_IDENTITY_TOKEN_FILE"])
+
+	if len(tokenFile) == 0 {
+		return ""
+	}
+
+	tokenFile = path.Clean(tokenFile)
+
+	for _, mount := range job.Config.Mounts {
+		target := path.Clean(mount.Target)
+
+		if tokenFile == target {
+			return mount.Location
+		}
+
+		if strings.HasPrefix(tokenFile, target+"/") {
+			return path.Join(mount.Location, tokenFile[len(target):])
+		}
+	}
+
+	log.Warn("Web identity token file is not mounted from the host: ", job.ID, ": ", tokenFile)
+	return ""
+}
+
+func getImageFromJob(job *host.Job) string {
+	if job.ImageArtifact == nil {
+		return ""
 	}
 
-	return roleArn{}, nil
+	return job.ImageArtifact.URI
 }
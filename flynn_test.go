@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetContainerFromJob(t *testing.T) {
+	assert := assert.New(t)
+
+	container, err := getContainerFromJob(&host.Job{
+		ID:            "job-1",
+		ImageArtifact: &host.Artifact{URI: "https://registry.example.com/app?id=1"},
+		Metadata: map[string]string{
+			"IAM_ROLE":                    "arn:aws:iam::123456789012:role/app",
+			"IAM_POLICY":                  ` {"Version":"2012-10-17"} `,
+			"IAM_POLICY_ARNS":             "arn:aws:iam::aws:policy/ReadOnlyAccess, not-an-arn",
+			"IAM_EXTERNAL_ID":             " external ",
+			"IAM_WEB_IDENTITY_TOKEN_FILE": "/var/run/secrets/token",
+			"IAM_SESSION_DURATION":        "2h",
+		},
+		Config: host.ContainerConfig{Mounts: []host.Mount{{Location: "/var/lib/tokens/job-1", Target: "/var/run/secrets"}}},
+	})
+	assert.Nil(err)
+	assert.Equal("job-1", container.ID)
+	assert.Equal("https://registry.example.com/app?id=1", container.Image)
+	assert.Equal("arn:aws:iam::123456789012:role/app", container.IamRole.String())
+	assert.Equal(`{"Version":"2012-10-17"}`, container.IamPolicy)
+	assert.Equal([]string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}, container.IamPolicyArns)
+	assert.Equal("external", container.IamExternalID)
+	assert.Equal("/var/lib/tokens/job-1/token", container.WebIdentityTokenFile)
+	assert.Equal(2*time.Hour, container.SessionDuration)
+
+	// jobs without a role get the default role
+	container, err = getContainerFromJob(&host.Job{ID: "job-2"})
+	assert.Nil(err)
+	assert.True(container.IamRole.Empty())
+	assert.Empty(container.Image)
+
+	_, err = getContainerFromJob(&host.Job{ID: "job-3", Metadata: map[string]string{"IAM_ROLE": "app"}})
+	assert.NotNil(err)
+}
+
+func TestGetWebIdentityTokenFileFromJob(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &host.Job{
+		ID:     "job-1",
+		Config: host.ContainerConfig{Mounts: []host.Mount{{Location: "/var/lib/tokens/job-1", Target: "/var/run/secrets/"}}},
+	}
+
+	for tokenFile, want := range map[string]string{
+		"/var/run/secrets":                     "/var/lib/tokens/job-1",
+		"/var/run/secrets/eks/token":           "/var/lib/tokens/job-1/eks/token",
+		"/var/run/secrets/../../../etc/shadow": "",
+		"/var/run/secretsfile":                 "",
+		"/etc/shadow":                          "",
+		"":                                     "",
+	} {
+		job.Metadata = map[string]string{"IAM_WEB_IDENTITY_TOKEN_FILE": tokenFile}
+		assert.Equal(want, getWebIdentityTokenFileFromJob(job), tokenFile)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// healthCheckTTL is how long a readiness result is reused, so frequent probes do not
+// turn into a call to the container platform and STS each.
+const healthCheckTTL = 10 * time.Second
+
+// healthChecker checks that the dependencies needed to serve credentials are reachable.
+type healthChecker struct {
+	container metaproxy.ContainerService
+	provider  *metaproxy.CredentialsProvider
+	checkSts  bool
+	lock      sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+func newHealthChecker(container metaproxy.ContainerService, c *metaproxy.CredentialsProvider, checkSts bool) *healthChecker {
+	return &healthChecker{
+		container: container,
+		provider:  c,
+		checkSts:  checkSts,
+	}
+}
+
+// Check returns nil if the container platform and, if enabled, STS are reachable.
+func (h *healthChecker) Check() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+
+	if !h.checkedAt.IsZero() && now.Sub(h.checkedAt) < healthCheckTTL {
+		return h.lastErr
+	}
+
+	h.lastErr = h.check()
+	h.checkedAt = now
+
+	if h.lastErr != nil {
+		log.Warn("Readiness check failed: ", h.lastErr)
+	}
+
+	return h.lastErr
+}
+
+func (h *healthChecker) check() error {
+	if err := h.container.Ping(); err != nil {
+		return fmt.Errorf("Error reaching %s: %s", h.container.TypeName(), err)
+	}
+
+	if h.checkSts {
+		if err := h.provider.PingSts(); err != nil {
+			return fmt.Errorf("Error reaching STS: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// newHealthHandler serves the readiness check on /healthz and the liveness check on
+// /livez, for a listener that is not reachable from containers.
+func newHealthHandler(h *healthChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadiness(h, w, r)
+	})
+	mux.HandleFunc("/livez", handleLiveness)
+	return mux
+}
+
+// handleReadiness responds 200 when the dependencies are reachable and 503 otherwise.
+func handleReadiness(h *healthChecker, w http.ResponseWriter, r *http.Request) {
+	if err := h.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+// handleLiveness only confirms that the server is up.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+type pingContainerService struct {
+	*metaproxy.MemoryContainerService
+	err   error
+	pings int
+}
+
+func (p *pingContainerService) Ping() error {
+	p.pings++
+	return p.err
+}
+
+func TestHealthCheckerCachesResult(t *testing.T) {
+	assert := assert.New(t)
+
+	container := &pingContainerService{MemoryContainerService: metaproxy.NewMemoryContainerService("test", nil), err: errors.New("connection refused")}
+	health := &healthChecker{container: container}
+
+	assert.NotNil(health.Check())
+	container.err = nil
+	assert.NotNil(health.Check())
+	assert.Equal(1, container.pings)
+
+	health.checkedAt = time.Now().Add(-healthCheckTTL)
+	assert.Nil(health.Check())
+	assert.Equal(2, container.pings)
+}
+
+func TestHealthHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	container := &pingContainerService{MemoryContainerService: metaproxy.NewMemoryContainerService("test", nil), err: errors.New("connection refused")}
+	handler := newHealthHandler(&healthChecker{container: container})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := serve("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Contains(w.Body.String(), "connection refused")
+
+	w = serve("/livez")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ok\n", w.Body.String())
+
+	// the health listener does not serve metadata
+	w = serve("/latest/meta-data/iam/security-credentials/")
+	assert.Equal(http.StatusNotFound, w.Code)
+}
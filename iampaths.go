@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// iamPathKind is how the proxy responds to an IAM path of the metadata service.
+type iamPathKind int
+
+const (
+	// iamCredentialsPath lists the role of the container and serves its credentials.
+	iamCredentialsPath iamPathKind = iota
+
+	// iamExtendedCredentialsPath is like iamCredentialsPath, with the account ID of the
+	// role in the credentials. Newer SDKs try it before the classic path.
+	iamExtendedCredentialsPath
+
+	// iamInfoPath serves the role of the container as the instance profile.
+	iamInfoPath
+
+	// iamHostPath is never served to containers.
+	iamHostPath
+)
+
+var (
+	credsRegex         = regexp.MustCompile("^/(.+?)/meta-data/iam/security-credentials(?:/(.*))?$")
+	extendedCredsRegex = regexp.MustCompile("^/(.+?)/meta-data/iam/security-credentials-extended(?:/(.*))?$")
+	iamInfoRegex       = regexp.MustCompile("^/(.+?)/meta-data/iam/info/?$")
+
+	// the identity credentials of the instance that EC2 services use, not an SDK
+	// credentials source
+	ec2IdentityCredsRegex = regexp.MustCompile("^/(.+?)/meta-data/identity-credentials/ec2/(?:info|security-credentials)(?:/(.*))?$")
+)
+
+// iamPaths are the IAM paths that the AWS SDKs request, matched in order. The first
+// group of a pattern is the API version and the second, if any, the subpath.
+var iamPaths = []struct {
+	pattern *regexp.Regexp
+	kind    iamPathKind
+}{
+	{credsRegex, iamCredentialsPath},
+	{extendedCredsRegex, iamExtendedCredentialsPath},
+	{iamInfoRegex, iamInfoPath},
+	{ec2IdentityCredsRegex, iamHostPath},
+}
+
+// handleIamPath serves the request if the path is one of the IAM paths. Returns false
+// for other paths.
+func handleIamPath(baseURL, urlPath, roleNameAlias string, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) bool {
+	for _, path := range iamPaths {
+		match := path.pattern.FindStringSubmatch(urlPath)
+
+		if match == nil {
+			continue
+		}
+
+		subpath := ""
+
+		if len(match) > 2 {
+			subpath = match[2]
+		}
+
+		switch path.kind {
+		case iamCredentialsPath:
+			handleCredentials(baseURL, match[1], subpath, roleNameAlias, false, c, w, r)
+		case iamExtendedCredentialsPath:
+			handleCredentials(baseURL, match[1], subpath, roleNameAlias, true, c, w, r)
+		case iamInfoPath:
+			handleIamInfo(baseURL, match[1], c, w, r)
+		default:
+			log.Debug("Not serving IAM path of the host to ", remoteIP(r.RemoteAddr), ": ", urlPath)
+			http.NotFound(w, r)
+		}
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleIamPathSdkSequences(t *testing.T) {
+	type step struct {
+		path     string
+		status   int
+		contains string
+		excludes string
+	}
+
+	// the requests of the instance profile credential providers after the IMDSv2 token
+	sequences := []struct {
+		sdk   string
+		steps []step
+	}{
+		{"aws-sdk-go", []step{
+			{"/latest/meta-data/iam/security-credentials/", http.StatusOK, "default", ""},
+			{"/latest/meta-data/iam/security-credentials/default", http.StatusOK, `"Code":"Success"`, "AccountId"},
+		}},
+		{"aws-sdk-java v1", []step{
+			{"/latest/meta-data/iam/security-credentials/", http.StatusOK, "default", ""},
+			{"/latest/meta-data/iam/security-credentials/default", http.StatusOK, `"AccessKeyId":"ASIATEST`, ""},
+		}},
+		{"aws-sdk-java v2", []step{
+			{"/latest/meta-data/iam/security-credentials-extended/", http.StatusOK, "default", ""},
+			{"/latest/meta-data/iam/security-credentials-extended/default", http.StatusOK, `"AccountId":"123456789012"`, "HOSTACCESSKEY"},
+		}},
+		{"instance identity credentials", []step{
+			{"/latest/meta-data/identity-credentials/ec2/info", http.StatusNotFound, "", ""},
+			{"/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance", http.StatusNotFound, "", "HOSTACCESSKEY"},
+		}},
+		{"host role", []step{
+			{"/latest/meta-data/iam/security-credentials/host-role", http.StatusNotFound, "", "HOSTACCESSKEY"},
+			{"/latest/meta-data/iam/security-credentials-extended/host-role", http.StatusNotFound, "", "HOSTACCESSKEY"},
+		}},
+	}
+
+	for _, sequence := range sequences {
+		f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+			"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		})
+		defer f.Close()
+
+		for _, step := range sequence.steps {
+			handled := false
+			w := f.request("172.17.0.2", step.path, func(w http.ResponseWriter, r *http.Request) {
+				handled = handleIamPath(f.metadata.URL, cleanMetadataPath(r.URL.Path), "", f.provider, w, r)
+			})
+
+			if !assert.True(t, handled, step.path) {
+				continue
+			}
+
+			assert.Equal(t, step.status, w.Code, "%s: %s", sequence.sdk, step.path)
+			assert.Contains(t, w.Body.String(), step.contains, "%s: %s", sequence.sdk, step.path)
+
+			if len(step.excludes) > 0 {
+				assert.NotContains(t, w.Body.String(), step.excludes, "%s: %s", sequence.sdk, step.path)
+			}
+		}
+	}
+
+	assert.False(t, handleIamPath("http://169.254.169.254", "/latest/meta-data/instance-id", "", nil, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)))
+	assert.True(t, hostCredentialsRegex.MatchString("/latest/meta-data/iam/security-credentials-extended/host-role"))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+var (
+	identityRegex = regexp.MustCompile("^/(.+?)/dynamic/instance-identity/(document|signature|pkcs7|rsa2048)/?$")
+)
+
+type instanceIdentityDocument struct {
+	AccountID        string    `json:"accountId"`
+	Architecture     string    `json:"architecture"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	InstanceID       string    `json:"instanceId"`
+	PendingTime      time.Time `json:"pendingTime"`
+	PrivateIP        string    `json:"privateIp"`
+	Region           string    `json:"region"`
+	Version          string    `json:"version"`
+}
+
+// containerInstanceID derives a stable, instance ID shaped placeholder from the container ID.
+func containerInstanceID(containerID string) string {
+	hash := sha256.Sum256([]byte(containerID))
+	return "i-" + hex.EncodeToString(hash[:])[:17]
+}
+
+// handleIdentityPath serves the instance identity paths if they are enabled. Returns
+// false if the path was not handled.
+func handleIdentityPath(urlPath, region string, enabled bool, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) bool {
+	if !enabled {
+		return false
+	}
+
+	match := identityRegex.FindStringSubmatch(urlPath)
+
+	if match == nil {
+		return false
+	}
+
+	handleInstanceIdentity(match[2], region, c, w, r)
+	return true
+}
+
+// handleInstanceIdentity serves an instance identity document describing the container:
+// the account of the container role, an instance ID derived from the container ID and
+// the time its credentials were generated.
+//
+// The signature endpoints can not return a valid AWS signature since only AWS holds the
+// signing key. They return a digest of the document that will fail verification with
+// the AWS certificates.
+func handleInstanceIdentity(document, region string, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	clientIP := remoteIP(r.RemoteAddr)
+	key, err := containerKey(c, r)
+
+	if err != nil {
+		log.Error(clientIP, " Error identifying container: ", err)
+		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+		return
+	}
+
+	credentials, err := c.CredentialsForIP(r.Context(), key)
+
+	if _, ok := err.(metaproxy.NoRoleForContainerError); ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(clientIP, " ", err)
+		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+		return
+	}
+
+	containerID, _ := c.ContainerIDForIP(key)
+
+	identity, err := json.MarshalIndent(&instanceIdentityDocument{
+		AccountID:        credentials.RoleArn.AccountID(),
+		Architecture:     "x86_64",
+		AvailabilityZone: region + "a",
+		InstanceID:       containerInstanceID(containerID),
+		PendingTime:      credentials.GeneratedAt.UTC().Truncate(time.Second),
+		PrivateIP:        clientIP,
+		Region:           region,
+		Version:          "2017-09-30",
+	}, "", "  ")
+
+	if err != nil {
+		log.Error("Error marshaling instance identity document: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if document == "document" {
+		w.Write(identity)
+		return
+	}
+
+	digest := sha256.Sum256(identity)
+	w.Write([]byte(base64.StdEncoding.EncodeToString(digest[:])))
+}
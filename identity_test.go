@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleInstanceIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	appRole, _ := metaproxy.NewRoleArn("arn:aws:iam::210987654321:role/app")
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamRole: appRole},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+	})
+	defer f.Close()
+
+	request := func(clientIP, path string) *httptest.ResponseRecorder {
+		return f.request(clientIP, path, func(w http.ResponseWriter, r *http.Request) {
+			assert.True(handleIdentityPath(path, "eu-west-1", true, f.provider, w, r), path)
+		})
+	}
+
+	resp := request("172.17.0.2", "/latest/dynamic/instance-identity/document")
+	assert.Equal(http.StatusOK, resp.Code)
+
+	var document instanceIdentityDocument
+	assert.Nil(json.Unmarshal(resp.Body.Bytes(), &document))
+	assert.Equal("210987654321", document.AccountID, "the account of the role")
+	assert.Equal(containerInstanceID("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), document.InstanceID)
+	assert.Equal("172.17.0.2", document.PrivateIP)
+	assert.Equal("eu-west-1", document.Region)
+	assert.Equal("eu-west-1a", document.AvailabilityZone)
+	assert.False(document.PendingTime.IsZero())
+
+	digest := sha256.Sum256(resp.Body.Bytes())
+	signature := request("172.17.0.2", "/latest/dynamic/instance-identity/signature")
+	assert.Equal(base64.StdEncoding.EncodeToString(digest[:]), signature.Body.String())
+
+	var other instanceIdentityDocument
+	assert.Nil(json.Unmarshal(request("172.17.0.3", "/latest/dynamic/instance-identity/document/").Body.Bytes(), &other))
+	assert.Equal("123456789012", other.AccountID)
+	assert.NotEqual(document.InstanceID, other.InstanceID)
+}
+
+func TestHandleIdentityPathOptIn(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{})
+	defer f.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/latest/dynamic/instance-identity/document", nil)
+	assert.False(handleIdentityPath(r.URL.Path, "eu-west-1", false, f.provider, w, r))
+	assert.Empty(w.Body.String())
+	assert.Equal(0, f.sts.Calls())
+
+	assert.False(handleIdentityPath("/latest/dynamic/instance-identity/other", "eu-west-1", true, f.provider, w, r))
+}
+
+func TestHandleInstanceIdentityNoRole(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	defer f.Close()
+	f.provider.Reconfigure(metaproxy.RoleDefaults{}, nil, nil, nil)
+
+	w := f.request("172.17.0.2", "/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		handleInstanceIdentity("document", "eu-west-1", f.provider, w, r)
+	})
+
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Empty(w.Body.String())
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+type kubernetesPodInfo struct {
+	metaproxy.ContainerInfo
+	RefreshTime time.Time
+}
+
+// kubernetesConfig configures how the kubernetes backend reaches the kubelet.
+type kubernetesConfig struct {
+	// KubeletURL is the base URL of the kubelet API of the node.
+	KubeletURL string
+
+	// TokenFile contains the bearer token used to authenticate with the kubelet.
+	// No authentication is used if empty.
+	TokenFile string
+
+	// CAFile verifies the kubelet certificate. Uses the system roots if empty.
+	CAFile string
+
+	// Insecure disables verification of the kubelet certificate.
+	Insecure bool
+
+	// Annotations are the keys of the pod annotations that configure the pod role.
+	Annotations roleLabels
+}
+
+// kubernetesContainerService resolves pods through the pod list of the local kubelet.
+// All containers of a pod share its IP, so the pod is the unit that gets a role.
+type kubernetesContainerService struct {
+	podIPMap    map[string]kubernetesPodInfo
+	hostIPs     map[string]bool
+	client      *http.Client
+	config      kubernetesConfig
+	lastRefresh time.Time
+	lock        sync.Mutex
+}
+
+// kubeletPodList is the subset of the kubelet /pods response that is used.
+type kubeletPodList struct {
+	Items []kubeletPod `json:"items"`
+}
+
+type kubeletPod struct {
+	Metadata struct {
+		UID         string            `json:"uid"`
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		HostNetwork bool `json:"hostNetwork"`
+		Containers  []struct {
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+func newKubernetesContainerService(config kubernetesConfig) (*kubernetesContainerService, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+
+	if len(config.CAFile) > 0 {
+		ca, err := ioutil.ReadFile(config.CAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Error reading kubelet CA file %s: %s", config.CAFile, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in kubelet CA file %s", config.CAFile)
+		}
+	}
+
+	return &kubernetesContainerService{
+		podIPMap: make(map[string]kubernetesPodInfo),
+		hostIPs:  make(map[string]bool),
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		config: config,
+	}, nil
+}
+
+func (k *kubernetesContainerService) TypeName() string {
+	return "k8s"
+}
+
+func (k *kubernetesContainerService) Ping() error {
+	_, err := k.listPods()
+	return err
+}
+
+func (k *kubernetesContainerService) ContainerForIP(containerIP string) (metaproxy.ContainerInfo, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	info, found := k.podIPMap[containerIP]
+	now := time.Now()
+
+	if !found || now.After(info.RefreshTime) {
+		k.syncPods(now)
+		info, found = k.podIPMap[containerIP]
+	}
+
+	if !found {
+		if k.hostIPs[containerIP] {
+			return metaproxy.ContainerInfo{}, fmt.Errorf("IP %s belongs to pods on the host network, which cannot be told apart", containerIP)
+		}
+
+		return metaproxy.ContainerInfo{}, fmt.Errorf("No pod found for IP %s", containerIP)
+	}
+
+	return info.ContainerInfo, nil
+}
+
+func (k *kubernetesContainerService) syncPods(now time.Time) {
+	// the kubelet returns all pods at once, so a burst of unknown IPs only lists them once
+	if now.Before(refreshTime(k.lastRefresh)) {
+		return
+	}
+
+	log.Info("Synchronizing state with kubelet pods")
+	pods, err := k.listPods()
+
+	if err != nil {
+		log.Error("Error listing pods: ", err)
+		return
+	}
+
+	k.lastRefresh = now
+	refreshAt := refreshTime(now)
+	podIPMap := make(map[string]kubernetesPodInfo)
+	hostIPs := make(map[string]bool)
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" {
+			continue
+		}
+
+		ips := getPodIPs(pod)
+
+		if pod.Spec.HostNetwork {
+			// host network pods share the node IP. Handing out the role of one of
+			// them would give it to every process on the node.
+			for _, ip := range ips {
+				hostIPs[ip] = true
+			}
+
+			continue
+		}
+
+		roleArn, iamPolicy := k.config.Annotations.roleFromLabels(pod.Metadata.UID, pod.Metadata.Annotations)
+		image := ""
+
+		if len(pod.Spec.Containers) > 0 {
+			image = pod.Spec.Containers[0].Image
+		}
+
+		for _, ipAddress := range ips {
+			log.Infof("Pod: uid=%s name=%s/%s ip=%s role=%s", pod.Metadata.UID, pod.Metadata.Namespace, pod.Metadata.Name, ipAddress, roleArn)
+
+			podIPMap[ipAddress] = kubernetesPodInfo{
+				ContainerInfo: metaproxy.ContainerInfo{
+					ID:              pod.Metadata.UID,
+					Name:            pod.Metadata.Namespace + "/" + pod.Metadata.Name,
+					Image:           image,
+					IamRole:         roleArn,
+					IamPolicy:       iamPolicy,
+					IamPolicyArns:   k.config.Annotations.policyArnsFromLabels(pod.Metadata.UID, pod.Metadata.Annotations),
+					IamExternalID:   strings.TrimSpace(pod.Metadata.Annotations[k.config.Annotations.ExternalID]),
+					SessionDuration: k.config.Annotations.sessionDurationFromLabels(pod.Metadata.UID, pod.Metadata.Annotations),
+					SessionTags:     k.config.Annotations.tagsFromLabels(pod.Metadata.UID, pod.Metadata.Annotations),
+					Labels:          pod.Metadata.Annotations,
+				},
+				RefreshTime: refreshAt,
+			}
+		}
+	}
+
+	k.podIPMap = podIPMap
+	k.hostIPs = hostIPs
+}
+
+func (k *kubernetesContainerService) listPods() (*kubeletPodList, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(k.config.KubeletURL, "/")+"/pods", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(k.config.TokenFile) > 0 {
+		// service account tokens are rotated, so the file is read for every request
+		token, err := ioutil.ReadFile(k.config.TokenFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Error reading kubelet token file %s: %s", k.config.TokenFile, err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Kubelet returned status %d", resp.StatusCode)
+	}
+
+	var pods kubeletPodList
+
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("Error parsing kubelet pods: %s", err)
+	}
+
+	return &pods, nil
+}
+
+// getPodIPs returns the normalized IPs of the pod.
+func getPodIPs(pod kubeletPod) []string {
+	var ips []string
+
+	add := func(address string) {
+		if ip := metaproxy.NormalizeIP(address); len(ip) > 0 && !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+
+	add(pod.Status.PodIP)
+
+	for _, podIP := range pod.Status.PodIPs {
+		add(podIP.IP)
+	}
+
+	return ips
+}
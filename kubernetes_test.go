@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKubeletPods = `{"items": [
+	{
+		"metadata": {"uid": "pod-uid-1", "name": "app", "namespace": "default",
+			"annotations": {"ec2metaproxy.io/role": "arn:aws:iam::123456789012:role/app"}},
+		"spec": {"containers": [{"image": "example/app:1.0"}]},
+		"status": {"phase": "Running", "podIP": "10.1.0.5", "podIPs": [{"ip": "10.1.0.5"}, {"ip": "fd00::5"}]}
+	},
+	{
+		"metadata": {"uid": "pod-uid-2", "name": "agent", "namespace": "kube-system"},
+		"spec": {"hostNetwork": true, "containers": [{"image": "example/agent"}]},
+		"status": {"phase": "Running", "podIP": "192.168.1.10"}
+	}
+]}`
+
+func newTestKubelet() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testKubeletPods))
+	}))
+}
+
+func TestKubernetesContainerForIP(t *testing.T) {
+	assert := assert.New(t)
+
+	kubelet := newTestKubelet()
+	defer kubelet.Close()
+
+	service, err := newKubernetesContainerService(kubernetesConfig{
+		KubeletURL:  kubelet.URL,
+		Annotations: roleLabels{Role: "ec2metaproxy.io/role"},
+	})
+	assert.Nil(err)
+
+	for _, ip := range []string{"10.1.0.5", "fd00::5"} {
+		info, err := service.ContainerForIP(ip)
+		assert.Nil(err)
+		assert.Equal("pod-uid-1", info.ID)
+		assert.Equal("default/app", info.Name)
+		assert.Equal("example/app:1.0", info.Image)
+		assert.Equal("arn:aws:iam::123456789012:role/app", info.IamRole.String())
+	}
+}
+
+func TestKubernetesContainerForIPHostNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	kubelet := newTestKubelet()
+	defer kubelet.Close()
+
+	service, err := newKubernetesContainerService(kubernetesConfig{KubeletURL: kubelet.URL})
+	assert.Nil(err)
+
+	_, err = service.ContainerForIP("192.168.1.10")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "host network")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listen validates the host:port address and binds it, explaining the common causes
+// of bind failures.
+func listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid listen address %s: %s", addr, err)
+	}
+
+	if len(host) > 0 && net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("Invalid listen address %s: host must be an IP address", addr)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("Invalid listen address %s: invalid port %s", addr, port)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		if len(host) > 0 {
+			return nil, fmt.Errorf("Error listening on %s, make sure %s is assigned to an interface, for example as a loopback alias: %s", addr, host, err)
+		}
+
+		return nil, fmt.Errorf("Error listening on %s: %s", addr, err)
+	}
+
+	return listener, nil
+}
+
+// listenUnix binds the Unix socket, replacing the socket file of a previous run. The
+// socket file is removed when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Error listening on %s: the file exists and is not a socket", path)
+		}
+
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error listening on %s: %s", path, err)
+	}
+
+	// containers are told apart by their peer credentials, not file permissions
+	if err := os.Chmod(path, 0666); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Error setting the permissions of %s: %s", path, err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenValidatesAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := listen("18000")
+	assert.NotNil(err)
+
+	_, err = listen("localhost:18000")
+	assert.NotNil(err)
+
+	_, err = listen("127.0.0.1:99999")
+	assert.NotNil(err)
+
+	listener, err := listen("127.0.0.1:0")
+	assert.Nil(err)
+	listener.Close()
+}
+
+func TestListenUnixReplacesSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metadata.sock")
+
+	// a socket file left by a previous run
+	stale, err := net.Listen("unix", path)
+	assert.Nil(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path)
+	assert.Nil(err)
+	listener.Close()
+
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	ioutil.WriteFile(path, []byte("data"), 0600)
+	_, err = listenUnix(path)
+	assert.NotNil(err)
+}
@@ -1,24 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
-	"regexp"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
 )
 
-var (
-	credsRegex = regexp.MustCompile("^/(.+?)/meta-data/iam/security-credentials/(.*)$")
-
-	instanceServiceClient = &http.Transport{}
-)
+var instanceServiceClient = &http.Transport{}
 
 var (
 	defaultIamRole = roleArnOpt(kingpin.
@@ -30,21 +35,333 @@ var (
 				Default("").
 				String()
 
+	guardrailPolicyDoc = kingpin.
+				Flag("guardrail-policy", "IAM policy of Deny statements added to the session policy of every assumed role, including container roles.").
+				Default("").
+				String()
+
+	defaultIamExternalID = kingpin.
+				Flag("default-iam-external-id", "External ID to use when assuming the default IAM role.").
+				Default("").
+				String()
+
+	sessionDuration = kingpin.
+			Flag("session-duration", "Duration of the assumed role sessions (between 15m and 12h).").
+			Default("1h").
+			Duration()
+
+	sessionNameFormat = kingpin.
+				Flag("session-name-template", "Template of the role session names. Tokens: {platform}, {containerId}, {shortId}, {image}.").
+				Default(metaproxy.DefaultSessionNameTemplate).
+				String()
+
+	debugHeaders = kingpin.
+			Flag("debug-headers", "Add the X-EC2MetaProxy-Role and X-EC2MetaProxy-Cache headers, with the assumed role ARN and whether the credentials were cached, to the credentials responses.").
+			Bool()
+
+	roleNameAlias = kingpin.
+			Flag("role-name-alias", "Name under which the role of every container is listed in the security-credentials path, instead of the name of the assumed role, for applications that expect a fixed role name.").
+			Default("").
+			String()
+
+	sessionNamePrefix = kingpin.
+				Flag("session-name-prefix", "Prefix of the role session names, like the name of the environment, to filter the sessions of the proxy in CloudTrail.").
+				String()
+
+	refreshThreshold = kingpin.
+				Flag("refresh-threshold", "Remaining lifetime at which a request refreshes the cached credentials. The background refresh renews them at twice this, but at least 10m. Defaults to 1/12 of the session duration.").
+				Default("0s").
+				Duration()
+
+	minCredentialLifetime = kingpin.
+				Flag("min-credential-lifetime", "Minimum remaining lifetime of the credentials served to containers. Raises --refresh-threshold if it is lower.").
+				Default("0s").
+				Duration()
+
+	disableCredentialCache = kingpin.
+				Flag("disable-credential-cache", "Assume the role of the container for every credentials request instead of caching the credentials in memory. Calls STS for every request.").
+				Bool()
+
+	dryRun = kingpin.
+		Flag("dry-run", "Resolve and log the role of each container without assuming it. Credential requests respond with 501.").
+		Bool()
+
+	refreshInterval = kingpin.
+			Flag("refresh-interval", "Interval at which all cached credentials are checked, to retry failed refreshes. Credentials are otherwise refreshed when they reach the background refresh threshold.").
+			Default("1m").
+			Duration()
+
+	purgeInterval = kingpin.
+			Flag("purge-interval", "Interval at which the cached credentials of containers that no longer exist are removed. Disabled if 0.").
+			Default("5m").
+			Duration()
+
+	shutdownTimeout = kingpin.
+			Flag("shutdown-timeout", "Time to wait for in-flight requests to finish on SIGTERM.").
+			Default("30s").
+			Duration()
+
+	stsMaxAttempts = kingpin.
+			Flag("sts-max-attempts", "Maximum number of attempts for STS calls that are throttled.").
+			Default("5").
+			Int()
+
+	stsBackoffBase = kingpin.
+			Flag("sts-backoff-base", "Initial delay between attempts of throttled STS calls.").
+			Default("100ms").
+			Duration()
+
+	stsBackoffMax = kingpin.
+			Flag("sts-backoff-max", "Maximum delay between attempts of throttled STS calls.").
+			Default("5s").
+			Duration()
+
+	negativeCacheTTL = kingpin.
+				Flag("negative-cache-ttl", "How long to remember that no container was found for an IP.").
+				Default("5s").
+				Duration()
+
+	exitGracePeriod = kingpin.
+			Flag("exit-grace-period", "How long the cached credentials of a container are still served after its lookup starts to fail, for example while it restarts. Disabled if 0.").
+			Default("0s").
+			Duration()
+
+	maxCacheEntryAge = kingpin.
+				Flag("max-cache-entry-age", "Age at which the cache entry of a container is dropped and its labels and role are resolved again, so changes to long-running containers take effect. Unbounded if 0.").
+				Default("24h").
+				Duration()
+
+	maxCachedContainers = kingpin.
+				Flag("max-cached-containers", "Maximum number of container IPs whose credentials are cached. The least recently used are evicted beyond it. Unbounded if 0.").
+				Default("10000").
+				Int()
+
+	configFile = kingpin.
+			Flag("config", "Configuration file with the default role and image to role mappings. Reloaded on SIGHUP.").
+			Default("").
+			String()
+
+	auditLog = kingpin.
+			Flag("audit-log", "Where to write the audit log of credential grants: stdout, syslog or a file path. Disabled if not set.").
+			Default("").
+			String()
+
+	otlpEndpoint = kingpin.
+			Flag("otlp-endpoint", "OTLP HTTP endpoint of the OpenTelemetry collector that receives the traces of credential requests, like http://localhost:4318. Tracing is disabled if not set.").
+			Default("").
+			String()
+
+	auditCacheHits = kingpin.
+			Flag("audit-cache-hits", "Also write an audit log entry when cached credentials are served.").
+			Bool()
+
+	clockSkewMargin = kingpin.
+			Flag("clock-skew-margin", "Safety margin added to credential expiration checks for clock drift between the host and AWS.").
+			Default("30s").
+			Duration()
+
+	baseCredentialsSource = kingpin.
+				Flag("base-credentials", "Source of the credentials that the container roles are assumed with: default for the default chain of the AWS SDK, env, profile, instance-profile or ecs for the task role of the ECS task the proxy runs in.").
+				Default("default").
+				Enum("default", "env", "profile", "instance-profile", "ecs")
+
+	baseProfile = kingpin.
+			Flag("base-profile", "Profile of the shared credentials file with --base-credentials=profile. Defaults to $AWS_PROFILE or default.").
+			Default("").
+			String()
+
+	baseCredentialsFile = kingpin.
+				Flag("base-credentials-file", "Shared credentials file with --base-credentials=profile. Defaults to ~/.aws/credentials.").
+				Default("").
+				String()
+
+	chainIamRole = roleArnOpt(kingpin.
+			Flag("chain-iam-role", "ARN of an intermediate role to assume before assuming the container roles."))
+
+	chainIamExternalID = kingpin.
+				Flag("chain-iam-external-id", "External ID to use when assuming the intermediate role.").
+				Default("").
+				String()
+
+	stsRegion = kingpin.
+			Flag("sts-region", "Region of the regional STS endpoint to use instead of the global endpoint.").
+			Default("").
+			String()
+
+	stsEndpoint = kingpin.
+			Flag("sts-endpoint", "URL of a custom STS endpoint, such as a VPC interface endpoint. Requires --sts-region.").
+			Default("").
+			String()
+
+	stsFailoverEndpoints = kingpin.
+				Flag("sts-failover-endpoint", "URL of an STS endpoint, or global for the global endpoint, to use when the STS endpoint can not be reached. Can be repeated, endpoints are tried in order.").
+				Strings()
+
+	stsTimeout = kingpin.
+			Flag("sts-timeout", "Maximum time to wait for a response to an STS call, including its retries. Unbounded if 0.").
+			Default("5s").
+			Duration()
+
+	stsMaxConcurrency = kingpin.
+				Flag("sts-max-concurrency", "Maximum number of concurrent STS calls that assume roles. Further calls wait for one to finish. Not limited if 0.").
+				Default("0").
+				Int()
+
+	stsQueueTimeout = kingpin.
+			Flag("sts-queue-timeout", "Maximum time a credentials request waits for one of the concurrent STS calls to finish before it fails with 503.").
+			Default("10s").
+			Duration()
+
+	stsProbeInterval = kingpin.
+				Flag("sts-probe-interval", "Interval at which to measure the latency of the STS endpoints and prefer the fastest over the order of --sts-failover-endpoint. Not measured if 0.").
+				Default("0").
+				Duration()
+
+	healthCheckSts = kingpin.
+			Flag("health-check-sts", "Call sts:GetCallerIdentity in the /healthz readiness check.").
+			Default("true").
+			Bool()
+
+	allowedPaths = kingpin.
+			Flag("allow-path", "Metadata path, relative to the API version, that is forwarded to the metadata service. A trailing /* allows everything below the path. Repeatable.").
+			Default(defaultAllowedPaths...).
+			Strings()
+
+	deniedPaths = kingpin.
+			Flag("deny-path", "Metadata path, relative to the API version, that is never forwarded to the metadata service, even with --passthrough. A trailing /* denies everything below the path. Matched ignoring case. Repeatable.").
+			Default(defaultDeniedPaths...).
+			Strings()
+
+	passthrough = kingpin.
+			Flag("passthrough", "Forward all metadata paths that are not overridden to the metadata service, ignoring --allow-path.").
+			Bool()
+
+	chaosDelay = kingpin.
+			Flag("chaos-delay", "Testing only: delay every credentials response by this duration.").
+			Default("0s").
+			Duration()
+
+	chaosJitter = kingpin.
+			Flag("chaos-delay-jitter", "Testing only: delay every credentials response by a random duration up to this, on top of --chaos-delay.").
+			Default("0s").
+			Duration()
+
+	chaosErrorRate = kingpin.
+			Flag("chaos-error-rate", "Testing only: share of the credentials requests, between 0 and 1, that fail with throttling, unavailable or internal errors.").
+			Default("0").
+			Float64()
+
+	rateLimit = kingpin.
+			Flag("rate-limit", "Metadata requests per second allowed from each container. Disabled if 0.").
+			Default("20").
+			Float64()
+
+	rateLimitBurst = kingpin.
+			Flag("rate-limit-burst", "Number of metadata requests a container can make at once before the rate limit applies.").
+			Default("100").
+			Int()
+
 	metadataURL = kingpin.
 			Flag("metadata-url", "URL of the real EC2 metadata service.").
 			Default("http://169.254.169.254").
 			String()
 
 	serverAddr = kingpin.
-			Flag("server", "Interface and port to bind the server to.").
+			Flag("server", "Interface and port to bind the server to. The firewall redirects metadata requests of containers to this address.").
 			Default(":18000").
+			Envar("EC2METAPROXY_SERVER").
 			Short('s').
 			String()
 
+	unixSocket = kingpin.
+			Flag("unix-socket", "Path of a Unix socket to serve the metadata on, in addition to --server, or instead of it if --server is empty. Requires --identify-by=cgroup.").
+			Default("").
+			String()
+
+	proxyProtocolTrusted = kingpin.
+				Flag("proxy-protocol-trusted", "Source range, in CIDR notation, trusted to send the PROXY protocol header with the address of the container, such as a NAT gateway. Repeatable. The header is ignored from all other sources.").
+				Strings()
+
+	metricsAddr = kingpin.
+			Flag("metrics-server", "Interface and port to serve prometheus metrics on. Disabled if not set.").
+			Default("").
+			String()
+
+	healthAddr = kingpin.
+			Flag("health-server", "Interface and port to serve the /healthz readiness and /livez liveness checks on. Must not be reachable from containers. Disabled if not set.").
+			Default("").
+			String()
+
+	adminAddr = kingpin.
+			Flag("admin-server", "Interface and port to serve the admin API on. Must not be reachable from containers. Disabled if not set.").
+			Default("").
+			String()
+
+	adminTLSCert = kingpin.
+			Flag("admin-tls-cert", "Certificate file of the admin API. Requires --admin-client-ca.").
+			Default("").
+			String()
+
+	adminTLSKey = kingpin.
+			Flag("admin-tls-key", "Private key file of the admin API certificate.").
+			Default("").
+			String()
+
+	adminClientCA = kingpin.
+			Flag("admin-client-ca", "CA file to verify the client certificates of admin API requests with. The admin API serves TLS and rejects requests without a client certificate if set.").
+			Default("").
+			String()
+
+	serveECSCredentials = kingpin.
+				Flag("serve-ecs-credentials", "Serve the credentials of the containers at /creds/<token> in the format of the ECS container credentials endpoint. Containers get their token from PUT /creds.").
+				Bool()
+
+	ecsTokenSecretFile = kingpin.
+				Flag("ecs-token-secret-file", "File with the secret that signs the tokens of the ECS credentials endpoint, so the tokens stay valid when the proxy restarts. A random secret is used if not set.").
+				Default("").
+				String()
+
+	servePlacement = kingpin.
+			Flag("serve-placement", "Serve the placement region and availability zone from --sts-region, so SDKs in the containers detect the region. Requires --sts-region.").
+			Bool()
+
+	serveInstanceIdentity = kingpin.
+				Flag("serve-instance-identity", "Serve instance identity documents describing the containers. The signatures are not valid AWS signatures. Requires --sts-region.").
+				Bool()
+
+	requireIMDSv2 = kingpin.
+			Flag("require-imdsv2", "Reject metadata requests that do not provide an IMDSv2 session token.").
+			Bool()
+
+	networkCheck = kingpin.
+			Flag("network-check", "Check at startup that the proxy does not run in a container without host networking: warn, strict to refuse to start, or off.").
+			Default("warn").
+			Enum("warn", "strict", "off")
+
+	checkDefaultRole = kingpin.
+				Flag("check-default-role", "Assume the default role at startup to check that the base credentials are allowed to: warn, strict to refuse to start, or off. Skipped if there is no default role.").
+				Default("off").
+				Enum("warn", "strict", "off")
+
+	procDir = kingpin.
+		Flag("proc-dir", "Directory of the procfs of the host, used to find the processes of connections with --identify-by=cgroup.").
+		Default("/proc").
+		String()
+
 	verbose = kingpin.
 		Flag("verbose", "Enable verbose output.").
 		Bool()
 
+	logLevel = kingpin.
+			Flag("log-level", "Minimum level of the log messages.").
+			Default("info").
+			Enum("debug", "info", "warn", "error")
+
+	logFormat = kingpin.
+			Flag("log-format", "Format of the log messages.").
+			Default("text").
+			Enum("text", "json")
+
 	dockerCommand = kingpin.Command("docker", "Run proxy for docker container manager.")
 
 	dockerEndpoint = dockerCommand.
@@ -52,6 +369,246 @@ var (
 			Default("unix:///var/run/docker.sock").
 			String()
 
+	dockerCacheTTL = dockerCommand.
+			Flag("container-cache-ttl", "How long container info is cached before the container is inspected again.").
+			Default("3s").
+			Duration()
+
+	dockerRoleLabel = dockerCommand.
+			Flag("role-label", "Container label that contains the ARN of the container role.").
+			Default("com.ec2metaproxy.role").
+			String()
+
+	dockerPolicyLabel = dockerCommand.
+				Flag("policy-label", "Container label that contains the IAM policy of the container.").
+				Default("com.ec2metaproxy.policy").
+				String()
+
+	dockerPolicyArnsLabel = dockerCommand.
+				Flag("policy-arns-label", "Container label that contains the comma separated ARNs of managed session policies of the container.").
+				Default("com.ec2metaproxy.policy-arns").
+				String()
+
+	dockerExternalIDLabel = dockerCommand.
+				Flag("external-id-label", "Container label that contains the external ID used to assume the container role.").
+				Default("com.ec2metaproxy.external-id").
+				String()
+
+	dockerSessionDurationLabel = dockerCommand.
+					Flag("session-duration-label", "Container label that overrides the duration of the container role sessions.").
+					Default("com.ec2metaproxy.session-duration").
+					String()
+
+	dockerTagLabelPrefix = dockerCommand.
+				Flag("tag-label-prefix", "Prefix of the container labels that are passed as session tags.").
+				Default("com.ec2metaproxy.tag.").
+				String()
+
+	dockerTransitiveTagsLabel = dockerCommand.
+					Flag("transitive-tags-label", "Container label that contains the comma separated keys of the transitive session tags.").
+					Default("com.ec2metaproxy.transitive-tags").
+					String()
+
+	dockerRoleSource = dockerCommand.
+				Flag("role-source", "Source of the container role: labels, falling back to the environment variables, or env for the environment variables only.").
+				Default("labels").
+				Enum("labels", "env")
+
+	dockerRoleEnv = dockerCommand.
+			Flag("role-env", "Container environment variable that contains the IAM role of the container.").
+			Default(defaultRoleEnv.Role).
+			String()
+
+	dockerPolicyEnv = dockerCommand.
+			Flag("policy-env", "Container environment variable that contains the IAM policy of the container.").
+			Default(defaultRoleEnv.Policy).
+			String()
+
+	dockerIdentifyBy = dockerCommand.
+				Flag("identify-by", "How the container of a request is found: ip, by the source IP, or cgroup, by the cgroup of the process that opened the connection, falling back to the source IP. cgroup requires the host PID namespace.").
+				Default("ip").
+				Enum("ip", "cgroup")
+
+	podmanCommand = kingpin.Command("podman", "Run proxy for podman containers.")
+
+	podmanEndpoint = podmanCommand.
+			Flag("podman-endpoint", "Endpoint of the docker compatible podman API.").
+			Default("unix:///run/podman/podman.sock").
+			String()
+
+	podmanCacheTTL = podmanCommand.
+			Flag("container-cache-ttl", "How long container info is cached before the container is inspected again.").
+			Default("3s").
+			Duration()
+
+	podmanRoleLabel = podmanCommand.
+			Flag("role-label", "Container label that contains the ARN of the container role.").
+			Default("com.ec2metaproxy.role").
+			String()
+
+	podmanPolicyLabel = podmanCommand.
+				Flag("policy-label", "Container label that contains the IAM policy of the container.").
+				Default("com.ec2metaproxy.policy").
+				String()
+
+	podmanPolicyArnsLabel = podmanCommand.
+				Flag("policy-arns-label", "Container label that contains the comma separated ARNs of managed session policies of the container.").
+				Default("com.ec2metaproxy.policy-arns").
+				String()
+
+	podmanExternalIDLabel = podmanCommand.
+				Flag("external-id-label", "Container label that contains the external ID used to assume the container role.").
+				Default("com.ec2metaproxy.external-id").
+				String()
+
+	podmanSessionDurationLabel = podmanCommand.
+					Flag("session-duration-label", "Container label that overrides the duration of the container role sessions.").
+					Default("com.ec2metaproxy.session-duration").
+					String()
+
+	podmanTagLabelPrefix = podmanCommand.
+				Flag("tag-label-prefix", "Prefix of the container labels that are passed as session tags.").
+				Default("com.ec2metaproxy.tag.").
+				String()
+
+	podmanTransitiveTagsLabel = podmanCommand.
+					Flag("transitive-tags-label", "Container label that contains the comma separated keys of the transitive session tags.").
+					Default("com.ec2metaproxy.transitive-tags").
+					String()
+
+	podmanRoleSource = podmanCommand.
+				Flag("role-source", "Source of the container role: labels, falling back to the environment variables, or env for the environment variables only.").
+				Default("labels").
+				Enum("labels", "env")
+
+	podmanRoleEnv = podmanCommand.
+			Flag("role-env", "Container environment variable that contains the IAM role of the container.").
+			Default(defaultRoleEnv.Role).
+			String()
+
+	podmanPolicyEnv = podmanCommand.
+			Flag("policy-env", "Container environment variable that contains the IAM policy of the container.").
+			Default(defaultRoleEnv.Policy).
+			String()
+
+	podmanIdentifyBy = podmanCommand.
+				Flag("identify-by", "How the container of a request is found: ip, by the source IP, or cgroup, by the cgroup of the process that opened the connection, falling back to the source IP. cgroup requires the host PID namespace.").
+				Default("ip").
+				Enum("ip", "cgroup")
+
+	containerdCommand = kingpin.Command("containerd", "Run proxy for containerd container manager.")
+
+	containerdAddress = containerdCommand.
+				Flag("containerd-address", "Address of the containerd socket.").
+				Default("/run/containerd/containerd.sock").
+				String()
+
+	containerdNamespace = containerdCommand.
+				Flag("containerd-namespace", "containerd namespace of the containers (k8s.io for CRI).").
+				Default("default").
+				String()
+
+	containerdCtr = containerdCommand.
+			Flag("ctr", "Path of the ctr binary used to inspect containers.").
+			Default("ctr").
+			String()
+
+	containerdCniResults = containerdCommand.
+				Flag("cni-results-dir", "Directory where CNI caches the network setup results, used to map IPs to containers.").
+				Default("/var/lib/cni/results").
+				String()
+
+	containerdRoleLabel = containerdCommand.
+				Flag("role-label", "Container label that contains the ARN of the container role.").
+				Default("com.ec2metaproxy.role").
+				String()
+
+	containerdPolicyLabel = containerdCommand.
+				Flag("policy-label", "Container label that contains the IAM policy of the container.").
+				Default("com.ec2metaproxy.policy").
+				String()
+
+	containerdPolicyArnsLabel = containerdCommand.
+					Flag("policy-arns-label", "Container label that contains the comma separated ARNs of managed session policies of the container.").
+					Default("com.ec2metaproxy.policy-arns").
+					String()
+
+	containerdExternalIDLabel = containerdCommand.
+					Flag("external-id-label", "Container label that contains the external ID used to assume the container role.").
+					Default("com.ec2metaproxy.external-id").
+					String()
+
+	containerdSessionDurationLabel = containerdCommand.
+					Flag("session-duration-label", "Container label that overrides the duration of the container role sessions.").
+					Default("com.ec2metaproxy.session-duration").
+					String()
+
+	containerdTagLabelPrefix = containerdCommand.
+					Flag("tag-label-prefix", "Prefix of the container labels that are passed as session tags.").
+					Default("com.ec2metaproxy.tag.").
+					String()
+
+	containerdTransitiveTagsLabel = containerdCommand.
+					Flag("transitive-tags-label", "Container label that contains the comma separated keys of the transitive session tags.").
+					Default("com.ec2metaproxy.transitive-tags").
+					String()
+
+	kubernetesCommand = kingpin.Command("k8s", "Run proxy for the pods of a kubernetes node.")
+
+	kubeletURL = kubernetesCommand.
+			Flag("kubelet-url", "Base URL of the kubelet API.").
+			Default("https://127.0.0.1:10250").
+			String()
+
+	kubeletTokenFile = kubernetesCommand.
+				Flag("kubelet-token-file", "File with the bearer token to authenticate with the kubelet.").
+				Default("/var/run/secrets/kubernetes.io/serviceaccount/token").
+				String()
+
+	kubeletCAFile = kubernetesCommand.
+			Flag("kubelet-ca-file", "CA certificates to verify the kubelet certificate.").
+			Default("").
+			String()
+
+	kubeletInsecure = kubernetesCommand.
+			Flag("kubelet-insecure", "Do not verify the kubelet certificate, which is often self-signed.").
+			Bool()
+
+	kubernetesRoleAnnotation = kubernetesCommand.
+					Flag("role-annotation", "Pod annotation that contains the ARN of the pod role.").
+					Default("ec2metaproxy.io/role").
+					String()
+
+	kubernetesPolicyAnnotation = kubernetesCommand.
+					Flag("policy-annotation", "Pod annotation that contains the IAM policy of the pod.").
+					Default("ec2metaproxy.io/policy").
+					String()
+
+	kubernetesPolicyArnsAnnotation = kubernetesCommand.
+					Flag("policy-arns-annotation", "Pod annotation that contains the comma separated ARNs of managed session policies of the pod.").
+					Default("ec2metaproxy.io/policy-arns").
+					String()
+
+	kubernetesExternalIDAnnotation = kubernetesCommand.
+					Flag("external-id-annotation", "Pod annotation that contains the external ID used to assume the pod role.").
+					Default("ec2metaproxy.io/external-id").
+					String()
+
+	kubernetesSessionDurationAnnotation = kubernetesCommand.
+						Flag("session-duration-annotation", "Pod annotation that overrides the duration of the pod role sessions.").
+						Default("ec2metaproxy.io/session-duration").
+						String()
+
+	kubernetesTagAnnotationPrefix = kubernetesCommand.
+					Flag("tag-annotation-prefix", "Prefix of the pod annotations that are passed as session tags.").
+					Default("ec2metaproxy.io/tag.").
+					String()
+
+	kubernetesTransitiveTagsAnnotation = kubernetesCommand.
+						Flag("transitive-tags-annotation", "Pod annotation that contains the comma separated keys of the transitive session tags.").
+						Default("ec2metaproxy.io/transitive-tags").
+						String()
+
 	flynnCommand = kingpin.Command("flynn", "Run proxy for flynn container manager.")
 
 	flynnEndpoint = flynnCommand.
@@ -60,14 +617,19 @@ var (
 			String()
 )
 
-type metadataCredentials struct {
-	Code            string
-	LastUpdated     time.Time
-	Type            string
-	AccessKeyID     string `json:"AccessKeyId"`
-	SecretAccessKey string
-	Token           string
-	Expiration      time.Time
+// metadataError is the body of the credentials errors of the EC2 metadata service,
+// which the SDKs parse.
+type metadataError struct {
+	Code        string
+	Message     string
+	LastUpdated string
+}
+
+type metadataIamInfo struct {
+	Code               string
+	LastUpdated        string
+	InstanceProfileArn string
+	InstanceProfileID  string `json:"InstanceProfileId"`
 }
 
 func copyHeaders(dst, src http.Header) {
@@ -82,39 +644,37 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
-func configureLogging(verbose bool) {
-	minLevel := "info"
+// remoteIP returns the normalized IP of a host:port address.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 
-	if verbose {
-		minLevel = "trace"
+	if err != nil {
+		host = addr
 	}
 
-	logger, err := log.LoggerFromConfigAsString(fmt.Sprintf(`
-<seelog minlevel="%s">
-    <outputs formatid="out">
-        <console />
-    </outputs>
-    <formats>
-        <format id="out" format="%%Date %%Time [%%LEVEL] %%Msg%%n" />
-    </formats>
-</seelog>
-`, minLevel))
-
-	if err != nil {
-		panic(err)
+	if ip := metaproxy.NormalizeIP(host); len(ip) > 0 {
+		return ip
 	}
 
-	log.ReplaceLogger(logger)
+	return host
 }
 
-func remoteIP(addr string) string {
-	index := strings.Index(addr, ":")
+// connContextKey is the request context key of the connection of the request.
+type connContextKey struct{}
+
+// withConn adds the connection to the context of its requests.
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
 
-	if index < 0 {
-		return addr
+// containerKey identifies the container that sent the request. It is the client IP,
+// unless the container service identifies containers from the connection.
+func containerKey(c *metaproxy.CredentialsProvider, r *http.Request) (string, error) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		return c.ContainerKeyForConn(conn)
 	}
 
-	return addr[:index]
+	return remoteIP(r.RemoteAddr), nil
 }
 
 type logResponseWriter struct {
@@ -164,7 +724,14 @@ func newGET(path string) *http.Request {
 	return r
 }
 
-func handleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvider, w http.ResponseWriter, r *http.Request) {
+// handleCredentials serves the listing and the credentials of the security-credentials
+// path. The role is listed by its name, or by the alias if one is set. Extended
+// credentials include the account ID of the role.
+func handleCredentials(baseURL, apiVersion, subpath, roleNameAlias string, extended bool, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	if chaos.Inject(w, r) {
+		return
+	}
+
 	resp, err := instanceServiceClient.RoundTrip(newGET(baseURL + "/" + apiVersion + "/meta-data/iam/security-credentials/"))
 
 	if err != nil {
@@ -173,6 +740,8 @@ func handleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvid
 		return
 	}
 
+	// the listing contains the name of the host instance profile role
+	hostRoleName, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
 	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
@@ -181,47 +750,313 @@ func handleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvid
 	}
 
 	clientIP := remoteIP(r.RemoteAddr)
-	credentials, err := c.CredentialsForIP(clientIP)
+	key, err := containerKey(c, r)
 
 	if err != nil {
+		log.Error(clientIP, " Error identifying container: ", err)
+		writeCredentialsError(w, err)
+		return
+	}
+
+	ctx, cacheStatus := metaproxy.WithCacheStatus(r.Context())
+	credentials, err := c.CredentialsForIP(ctx, key)
+
+	if _, ok := err.(metaproxy.NoRoleForContainerError); ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
 		log.Error(clientIP, " ", err)
-		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+		writeCredentialsError(w, err)
 		return
 	}
 
 	roleName := credentials.RoleArn.RoleName()
 
+	if len(roleNameAlias) > 0 {
+		roleName = roleNameAlias
+	}
+
 	if len(subpath) == 0 {
 		w.Write([]byte(roleName))
-	} else if !strings.HasPrefix(subpath, roleName) || (len(subpath) > len(roleName) && subpath[len(roleName)-1] != '/') {
+	} else if !strings.HasPrefix(subpath, roleName) || (len(subpath) > len(roleName) && subpath[len(roleName)] != '/') {
 		// An idiosyncrasy of the standard EC2 metadata service:
 		// Subpaths of the role name are ignored. So long as the correct role name is provided,
 		// it can be followed by a slash and anything after the slash is ignored.
+		if hostRole := strings.TrimSpace(string(hostRoleName)); len(hostRole) > 0 && strings.HasPrefix(subpath, hostRole) {
+			log.Warn("Container ", clientIP, " requested the credentials of the host role ", hostRole)
+		}
+
 		w.WriteHeader(http.StatusNotFound)
 	} else {
-		creds, err := json.Marshal(&metadataCredentials{
-			Code:            "Success",
-			LastUpdated:     credentials.GeneratedAt,
-			Type:            "AWS-HMAC",
-			AccessKeyID:     credentials.AccessKey,
-			SecretAccessKey: credentials.SecretKey,
-			Token:           credentials.Token,
-			Expiration:      credentials.Expiration,
-		})
+		response := newMetadataCredentials(credentials)
+
+		if extended {
+			response.AccountID = credentials.RoleArn.AccountID()
+		}
+
+		creds, err := json.Marshal(&response)
 
 		if err != nil {
 			log.Error("Error marshaling credentials: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		} else {
+			writeDebugHeaders(w, credentials, *cacheStatus)
 			w.Write(creds)
 		}
 	}
 }
 
-func newContainerService(platform string) (containerService, error) {
+// writeDebugHeaders adds the role and the cache status of the credentials to the
+// response if --debug-headers is set. The headers never contain secrets.
+func writeDebugHeaders(w http.ResponseWriter, credentials metaproxy.Credentials, cacheStatus string) {
+	if !*debugHeaders {
+		return
+	}
+
+	w.Header().Set("X-EC2MetaProxy-Role", credentials.RoleArn.String())
+
+	if len(cacheStatus) > 0 {
+		w.Header().Set("X-EC2MetaProxy-Cache", strings.ToUpper(cacheStatus))
+	}
+}
+
+// stsRetryAfter is the Retry-After of the responses to credentials requests that fail
+// because STS is unavailable or throttling.
+const stsRetryAfter = 5 * time.Second
+
+// writeCredentialsError responds with the error format of the EC2 metadata service.
+// Errors that are likely temporary respond with 503 and Retry-After so the SDKs back
+// off and retry. Errors of the permissions of the role respond with 403.
+func writeCredentialsError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	code := "InternalError"
+	message := "An unexpected error occurred getting the container credentials"
+
+	if dryRun, ok := err.(metaproxy.DryRunError); ok {
+		status = http.StatusNotImplemented
+		code = "DryRun"
+		message = dryRun.Error()
+	} else if notAllowed, ok := err.(metaproxy.RoleNotAllowedError); ok {
+		status = http.StatusForbidden
+		code = "RoleNotAllowed"
+		message = notAllowed.Error()
+	} else if tooLarge, ok := err.(metaproxy.PolicyTooLargeError); ok {
+		code = "PolicyTooLarge"
+		message = tooLarge.Error()
+	} else if invalid, ok := err.(metaproxy.InvalidPolicyError); ok {
+		code = "MalformedPolicyDocument"
+		message = invalid.Error()
+	} else if _, ok := err.(metaproxy.StsQueueTimeoutError); ok {
+		status = http.StatusServiceUnavailable
+		code = "ServiceUnavailable"
+		message = "Too many concurrent credential requests, try again later"
+	} else if awsErr, ok := err.(awserr.Error); ok {
+		switch {
+		case awsErr.Code() == "AccessDenied":
+			status = http.StatusForbidden
+			code = "AssumeRoleUnauthorizedAccess"
+			message = awsErr.Message()
+		case awsErr.Code() == "InvalidIdentityToken" || awsErr.Code() == "ExpiredTokenException":
+			status = http.StatusForbidden
+			code = "InvalidIdentityToken"
+			message = awsErr.Message()
+		case awsErr.Code() == "PackedPolicyTooLarge" || awsErr.Code() == "MalformedPolicyDocument":
+			code = awsErr.Code()
+			message = awsErr.Message()
+		case awsErr.Code() == "RegionDisabledException":
+			status = http.StatusForbidden
+			code = "RegionDisabled"
+			message = awsErr.Message()
+		case metaproxy.IsRetryableStsError(err):
+			status = http.StatusServiceUnavailable
+			code = "Throttling"
+			message = "STS is throttling requests, try again later"
+		case metaproxy.IsTimeoutError(err):
+			status = http.StatusServiceUnavailable
+			code = "RequestTimeout"
+			message = "STS did not respond in time, try again later"
+		case metaproxy.IsConnectionError(err):
+			status = http.StatusServiceUnavailable
+			code = "ServiceUnavailable"
+			message = "STS could not be reached, try again later"
+		case metaproxy.IsServerError(err):
+			status = http.StatusServiceUnavailable
+			code = "ServiceUnavailable"
+			message = "STS is unavailable, try again later"
+		}
+	}
+
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(stsRetryAfter/time.Second)))
+	}
+
+	body, _ := json.Marshal(&metadataError{
+		Code:        code,
+		Message:     message,
+		LastUpdated: metadataTime(time.Now()),
+	})
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func handleIamInfo(baseURL, apiVersion string, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	resp, err := instanceServiceClient.RoundTrip(newGET(baseURL + "/" + apiVersion + "/meta-data/iam/info"))
+
+	if err != nil {
+		log.Error("Error requesting iam info path for API version ", apiVersion, ": ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	clientIP := remoteIP(r.RemoteAddr)
+	key, err := containerKey(c, r)
+
+	if err != nil {
+		log.Error(clientIP, " Error identifying container: ", err)
+		writeCredentialsError(w, err)
+		return
+	}
+
+	credentials, err := c.CredentialsForIP(r.Context(), key)
+
+	if _, ok := err.(metaproxy.NoRoleForContainerError); ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(clientIP, " ", err)
+		writeCredentialsError(w, err)
+		return
+	}
+
+	info, err := json.Marshal(&metadataIamInfo{
+		Code:               "Success",
+		LastUpdated:        metadataTime(credentials.GeneratedAt),
+		InstanceProfileArn: credentials.RoleArn.String(),
+		InstanceProfileID:  credentials.RoleID,
+	})
+
+	if err != nil {
+		log.Error("Error marshaling iam info: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Write(info)
+	}
+}
+
+func reloadOnSignal(filename string, flagDefaults metaproxy.RoleDefaults, c *metaproxy.CredentialsProvider) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := reloadConfig(filename, flagDefaults, c); err != nil {
+			log.Error("Error reloading configuration, keeping current configuration: ", err)
+		}
+	}
+}
+
+// reloadConfig reconfigures the provider from the config file. The provider is not
+// changed if the file is invalid.
+func reloadConfig(filename string, flagDefaults metaproxy.RoleDefaults, c *metaproxy.CredentialsProvider) error {
+	log.Info("Reloading configuration: ", filename)
+	config, err := loadConfig(filename)
+
+	if err != nil {
+		return err
+	}
+
+	c.Reconfigure(config.Defaults(flagDefaults), config.Images, config.Networks, config.StaticCredentials)
+	return nil
+}
+
+func newContainerService(platform string) (metaproxy.ContainerService, error) {
 	switch platform {
 	case "docker":
-		return newDockerContainerService(*dockerEndpoint)
+		service, err := newDockerContainerService(*dockerEndpoint, roleLabels{
+			Role:            *dockerRoleLabel,
+			Policy:          *dockerPolicyLabel,
+			PolicyArns:      *dockerPolicyArnsLabel,
+			ExternalID:      *dockerExternalIDLabel,
+			SessionDuration: *dockerSessionDurationLabel,
+			TagPrefix:       *dockerTagLabelPrefix,
+			TransitiveTags:  *dockerTransitiveTagsLabel,
+		}, *dockerCacheTTL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		service.env = roleEnv{Role: *dockerRoleEnv, Policy: *dockerPolicyEnv, Only: *dockerRoleSource == "env"}
+		service.detectPlatform()
+		service.WatchEvents()
+
+		if *dockerIdentifyBy == "cgroup" {
+			return newCgroupContainerService(service, *procDir, *dockerCacheTTL), nil
+		}
+
+		return service, nil
+	case "podman":
+		service, err := newPodmanContainerService(*podmanEndpoint, roleLabels{
+			Role:            *podmanRoleLabel,
+			Policy:          *podmanPolicyLabel,
+			PolicyArns:      *podmanPolicyArnsLabel,
+			ExternalID:      *podmanExternalIDLabel,
+			SessionDuration: *podmanSessionDurationLabel,
+			TagPrefix:       *podmanTagLabelPrefix,
+			TransitiveTags:  *podmanTransitiveTagsLabel,
+		}, *podmanCacheTTL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		service.env = roleEnv{Role: *podmanRoleEnv, Policy: *podmanPolicyEnv, Only: *podmanRoleSource == "env"}
+		service.WatchEvents()
+
+		if *podmanIdentifyBy == "cgroup" {
+			return newCgroupContainerService(service, *procDir, *podmanCacheTTL), nil
+		}
+
+		return service, nil
+	case "containerd":
+		return newContainerdContainerService(containerdConfig{
+			Address:       *containerdAddress,
+			Namespace:     *containerdNamespace,
+			Ctr:           *containerdCtr,
+			CniResultsDir: *containerdCniResults,
+			Labels: roleLabels{
+				Role:            *containerdRoleLabel,
+				Policy:          *containerdPolicyLabel,
+				PolicyArns:      *containerdPolicyArnsLabel,
+				ExternalID:      *containerdExternalIDLabel,
+				SessionDuration: *containerdSessionDurationLabel,
+				TagPrefix:       *containerdTagLabelPrefix,
+				TransitiveTags:  *containerdTransitiveTagsLabel,
+			},
+		})
+	case "k8s":
+		return newKubernetesContainerService(kubernetesConfig{
+			KubeletURL: *kubeletURL,
+			TokenFile:  *kubeletTokenFile,
+			CAFile:     *kubeletCAFile,
+			Insecure:   *kubeletInsecure,
+			Annotations: roleLabels{
+				Role:            *kubernetesRoleAnnotation,
+				Policy:          *kubernetesPolicyAnnotation,
+				PolicyArns:      *kubernetesPolicyArnsAnnotation,
+				ExternalID:      *kubernetesExternalIDAnnotation,
+				SessionDuration: *kubernetesSessionDurationAnnotation,
+				TagPrefix:       *kubernetesTagAnnotationPrefix,
+				TransitiveTags:  *kubernetesTransitiveTagsAnnotation,
+			},
+		})
 	case "flynn":
 		return newFlynnContainerService(*flynnEndpoint)
 	default:
@@ -234,7 +1069,17 @@ func main() {
 	command := kingpin.Parse()
 
 	defer log.Flush()
-	configureLogging(*verbose)
+	level := *logLevel
+
+	if *verbose {
+		level = "trace"
+	}
+
+	metaproxy.ConfigureLogging(level, *logFormat)
+
+	if err := checkHostNetwork(*networkCheck, *procDir); err != nil {
+		panic(err)
+	}
 
 	platform, err := newContainerService(command)
 
@@ -242,18 +1087,266 @@ func main() {
 		panic(err)
 	}
 
-	awsSession := session.New()
-	credentials := newCredentialsProvider(awsSession, platform, *defaultIamRole, *defaultIamPolicy)
+	if _, ok := platform.(metaproxy.ConnContainerService); len(*unixSocket) > 0 && !ok {
+		panic("--unix-socket requires --identify-by=cgroup to identify the containers of Unix socket connections")
+	}
+
+	if len(*serverAddr) == 0 && len(*unixSocket) == 0 {
+		panic("--server or --unix-socket is required")
+	}
+
+	flagDefaults := metaproxy.RoleDefaults{RoleArn: *defaultIamRole, Policy: *defaultIamPolicy, ExternalID: *defaultIamExternalID}
+	defaults := flagDefaults
+
+	var imageRoles metaproxy.ImageRoleTable
+	var networkRoles metaproxy.NetworkRoleTable
+	var staticCreds metaproxy.StaticCredentialsTable
+	var accounts []accountCredentials
+	var stsEndpoints metaproxy.StsEndpointTable
+
+	if len(*configFile) > 0 {
+		config, err := loadConfig(*configFile)
+
+		if err != nil {
+			panic(err)
+		}
+
+		defaults = config.Defaults(flagDefaults)
+		imageRoles = config.Images
+		networkRoles = config.Networks
+		staticCreds = config.StaticCredentials
+		accounts = config.Accounts
+		stsEndpoints = config.StsEndpoints
+	}
+
+	if !defaults.RoleArn.Empty() {
+		log.Infof("Default IAM role: %s (account %s)", defaults.RoleArn, defaults.RoleArn.AccountID())
+	}
+
+	if *serveInstanceIdentity && len(*stsRegion) == 0 {
+		panic("--sts-region is required with --serve-instance-identity")
+	}
+
+	if *servePlacement && len(*stsRegion) == 0 {
+		panic("--sts-region is required with --serve-placement")
+	}
+
+	stsConfig, err := stsEndpointConfig(*stsRegion, *stsEndpoint, defaults.RoleArn.Partition())
+
+	if err != nil {
+		panic(err)
+	}
+
+	stsFailover, err := stsFailoverConfigs(*stsFailoverEndpoints, aws.StringValue(stsConfig.Region))
+
+	if err != nil {
+		panic(err)
+	}
+
+	sessionName, err := metaproxy.NewSessionNameTemplate(*sessionNameFormat)
+
+	if err != nil {
+		panic(err)
+	}
+
+	namePrefix, err := metaproxy.NewSessionNamePrefix(*sessionNamePrefix)
+
+	if err != nil {
+		panic(err)
+	}
+
+	chaos, err = newChaosInjector(*chaosDelay, *chaosJitter, *chaosErrorRate)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if strings.Contains(*roleNameAlias, "/") {
+		panic(fmt.Sprintf("--role-name-alias %q must not contain a slash", *roleNameAlias))
+	}
+
+	guardrail, err := metaproxy.NewGuardrailPolicy(*guardrailPolicyDoc)
+
+	if err != nil {
+		panic(err)
+	}
+
+	audit, err := metaproxy.NewAuditLogger(*auditLog, *auditCacheHits)
+
+	if err != nil {
+		panic(err)
+	}
+
+	traces := metaproxy.NewTracer(*otlpEndpoint)
+	defer traces.Stop()
+
+	creds, err := baseCredentials(*baseCredentialsSource, *baseProfile, *baseCredentialsFile, *metadataURL)
+
+	if err != nil {
+		panic(err)
+	}
+
+	awsSession := session.New(&aws.Config{Credentials: creds})
+	accountSessions := newAccountSessions(accounts, awsSession, *baseCredentialsFile, stsConfig, *stsTimeout)
+	maxSessionDuration := time.Duration(0)
+
+	if !chainIamRole.Empty() {
+		log.Info("Assuming container roles through intermediate role ", chainIamRole)
+		awsSession = metaproxy.NewChainedSession(awsSession, stsConfig, *stsTimeout, *chainIamRole, *chainIamExternalID)
+
+		if *sessionDuration > metaproxy.MaxChainedSessionDuration {
+			log.Warn("Session duration is limited to ", metaproxy.MaxChainedSessionDuration, " when chaining roles")
+			*sessionDuration = metaproxy.MaxChainedSessionDuration
+		}
+
+		maxSessionDuration = metaproxy.MaxChainedSessionDuration
+	}
+
+	for _, account := range accounts {
+		if !account.Role.Empty() && *sessionDuration > metaproxy.MaxChainedSessionDuration {
+			log.Warn("Session duration is limited to ", metaproxy.MaxChainedSessionDuration, " when chaining roles for account ", account.AccountID)
+			*sessionDuration = metaproxy.MaxChainedSessionDuration
+			maxSessionDuration = metaproxy.MaxChainedSessionDuration
+		}
+	}
+
+	if *refreshThreshold*2 >= *sessionDuration {
+		panic(fmt.Sprintf("--refresh-threshold must be less than half of the session duration %s", *sessionDuration))
+	}
+
+	if *minCredentialLifetime*2 >= *sessionDuration {
+		panic(fmt.Sprintf("--min-credential-lifetime must be less than half of the session duration %s", *sessionDuration))
+	}
+
+	credentials := metaproxy.NewCredentialsProvider(awsSession, platform, metaproxy.CredentialsProviderConfig{
+		Defaults:        defaults,
+		SessionDuration: *sessionDuration,
+		Retry: metaproxy.Backoff{
+			MaxAttempts: *stsMaxAttempts,
+			BaseDelay:   *stsBackoffBase,
+			MaxDelay:    *stsBackoffMax,
+		},
+		NegativeCacheTTL:    *negativeCacheTTL,
+		ExitGracePeriod:     *exitGracePeriod,
+		MaxCachedContainers: *maxCachedContainers,
+		MaxEntryAge:         *maxCacheEntryAge,
+		ImageRoles:          imageRoles,
+		NetworkRoles:        networkRoles,
+		StaticCredentials:   staticCreds,
+		Audit:               audit,
+		ClockSkewMargin:     *clockSkewMargin,
+		Sts:                 stsConfig,
+		StsFailover:         stsFailover,
+		AccountSessions:     accountSessions,
+		StsEndpoints:        stsEndpoints,
+		StsTimeout:          *stsTimeout,
+		StsProbeInterval:    *stsProbeInterval,
+		MaxConcurrentSts:    *stsMaxConcurrency,
+		StsQueueTimeout:     *stsQueueTimeout,
+		SessionName:         sessionName,
+		SessionNamePrefix:   namePrefix,
+		MaxSessionDuration:  maxSessionDuration,
+		RefreshThreshold:    *refreshThreshold,
+		DryRun:              *dryRun,
+		DisableCache:        *disableCredentialCache,
+		MinLifetime:         *minCredentialLifetime,
+		Guardrail:           guardrail,
+		Tracer:              traces,
+	})
+	if *checkDefaultRole != "off" {
+		if err := credentials.CheckDefaultRole(context.Background()); err != nil {
+			if *checkDefaultRole == "strict" {
+				panic(err)
+			}
+
+			log.Warn("Containers without a role will not get credentials: ", err)
+		}
+	}
+
+	credentials.StartRefresh(*refreshInterval, *purgeInterval)
+	defer credentials.Stop()
+
+	if len(*configFile) > 0 {
+		go reloadOnSignal(*configFile, flagDefaults, credentials)
+	}
+
+	tokens, err := newMetadataTokens()
+
+	if err != nil {
+		panic(err)
+	}
+
+	ecsTokens, err := newECSTokens(*ecsTokenSecretFile)
+
+	if err != nil {
+		panic(err)
+	}
+
+	allowed := pathAllowlist(*allowedPaths)
+	denied := pathDenylist(*deniedPaths)
 
 	// Proxy non-credentials requests to primary metadata service
-	http.HandleFunc("/", logHandler(func(w http.ResponseWriter, r *http.Request) {
-		match := credsRegex.FindStringSubmatch(r.URL.Path)
-		if match != nil {
-			handleCredentials(*metadataURL, match[1], match[2], credentials, w, r)
+	metadataHandler := logHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metadataTokenPath {
+			handleTokenRequest(tokens, credentials, w, r)
+			return
+		}
+
+		// ECS credential requests do not use IMDSv2 tokens
+		if *serveECSCredentials {
+			if cleanMetadataPath(r.URL.Path) == ecsTokenPath {
+				handleECSTokenRequest(ecsTokens, credentials, w, r)
+				return
+			}
+
+			if match := ecsCredentialsRegex.FindStringSubmatch(cleanMetadataPath(r.URL.Path)); match != nil {
+				handleECSCredentials(match[1], ecsTokens, credentials, w, r)
+				return
+			}
+		}
+
+		if !checkMetadataToken(tokens, credentials, *requireIMDSv2, w, r) {
+			return
+		}
+
+		urlPath := cleanMetadataPath(r.URL.Path)
+
+		if handleIamPath(*metadataURL, urlPath, *roleNameAlias, credentials, w, r) {
+			return
+		}
+
+		if handleIdentityPath(urlPath, *stsRegion, *serveInstanceIdentity, credentials, w, r) {
+			return
+		}
+
+		if *servePlacement {
+			match := placementRegex.FindStringSubmatch(urlPath)
+			if match != nil {
+				handlePlacement(match[2], *stsRegion, w, r)
+				return
+			}
+		}
+
+		if hostCredentialsRegex.MatchString(urlPath) {
+			// never forward the credentials of the host, even in passthrough mode
+			log.Warn("Blocked request for host credentials from ", remoteIP(r.RemoteAddr), ": ", urlPath)
+			http.NotFound(w, r)
 			return
 		}
 
-		proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", *metadataURL, r.URL.Path), r.Body)
+		if denied.Denied(urlPath) {
+			log.Debug("Metadata path denied: ", urlPath)
+			http.NotFound(w, r)
+			return
+		}
+
+		if !*passthrough && !allowed.Allowed(urlPath) {
+			log.Debug("Metadata path not allowed: ", urlPath)
+			http.NotFound(w, r)
+			return
+		}
+
+		proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", *metadataURL, urlPath), r.Body)
 
 		if err != nil {
 			log.Error("Error creating proxy http request: ", err)
@@ -262,6 +1355,7 @@ func main() {
 		}
 
 		copyHeaders(proxyReq.Header, r.Header)
+		proxyReq.Header.Del(metadataTokenHeader) // only valid for this proxy
 		resp, err := instanceServiceClient.RoundTrip(proxyReq)
 
 		if err != nil {
@@ -277,8 +1371,101 @@ func main() {
 		if _, err := io.Copy(w, resp.Body); err != nil {
 			log.Warn("Error copying response content from EC2 metadata service: ", err)
 		}
-	}))
+	})
+
+	if *rateLimit > 0 {
+		metadataHandler = newRateLimiter(*rateLimit, *rateLimitBurst).Wrap(credentials, metadataHandler)
+	}
+
+	http.HandleFunc("/", metadataHandler)
+
+	if len(*metricsAddr) > 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metaproxy.Metrics)
+
+		go func() {
+			log.Info("Serving metrics on ", *metricsAddr)
+			log.Critical(http.ListenAndServe(*metricsAddr, metricsMux))
+		}()
+	}
+
+	if len(*healthAddr) > 0 {
+		health := newHealthChecker(platform, credentials, *healthCheckSts)
+
+		go func() {
+			log.Info("Serving health checks on ", *healthAddr)
+			log.Critical(http.ListenAndServe(*healthAddr, newHealthHandler(health)))
+		}()
+	}
+
+	if len(*adminAddr) > 0 {
+		adminServer := &http.Server{Addr: *adminAddr, Handler: newAdminHandler(credentials)}
+
+		if len(*adminClientCA) > 0 {
+			tlsConfig, err := adminTLSConfig(*adminTLSCert, *adminTLSKey, *adminClientCA)
+
+			if err != nil {
+				panic(err)
+			}
 
-	log.Info("Listening on ", *serverAddr)
-	log.Critical(http.ListenAndServe(*serverAddr, nil))
+			adminServer.TLSConfig = tlsConfig
+			adminServer.Handler = requireClientCert(adminServer.Handler)
+		} else if len(*adminTLSCert) > 0 {
+			panic("--admin-tls-cert requires --admin-client-ca")
+		}
+
+		go func() {
+			if adminServer.TLSConfig != nil {
+				log.Info("Serving admin API with client certificates on ", *adminAddr)
+				log.Critical(adminServer.ListenAndServeTLS("", ""))
+			} else {
+				log.Info("Serving admin API on ", *adminAddr)
+				log.Critical(adminServer.ListenAndServe())
+			}
+		}()
+	}
+
+	// the credentials cache is not persisted, so it is dropped once the requests
+	// are drained and the background refresh is stopped
+	inFlight := &inFlightCounter{}
+	server := &http.Server{Addr: *serverAddr, Handler: inFlight.Wrap(http.DefaultServeMux), ConnContext: withConn}
+	var listeners []net.Listener
+
+	if len(*serverAddr) > 0 {
+		listener, err := listen(*serverAddr)
+
+		if err != nil {
+			panic(err)
+		}
+
+		if len(*proxyProtocolTrusted) > 0 {
+			trusted, err := parseTrustedProxies(*proxyProtocolTrusted)
+
+			if err != nil {
+				panic(err)
+			}
+
+			listener = &proxyProtocolListener{Listener: listener, trusted: trusted}
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	if len(*unixSocket) > 0 {
+		listener, err := listenUnix(*unixSocket)
+
+		if err != nil {
+			panic(err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		log.Info("Listening on ", listener.Addr())
+	}
+
+	if err := serveUntilSignal(server, listeners, inFlight, *shutdownTimeout); err != nil {
+		log.Critical(err)
+	}
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProvider(stsServer *ststest.Server, containers metaproxy.ContainerService) *metaproxy.CredentialsProvider {
+	defaultRole, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/default")
+
+	return metaproxy.NewCredentialsProvider(stsServer.Session(), containers, metaproxy.CredentialsProviderConfig{
+		Defaults:        metaproxy.RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           metaproxy.Backoff{MaxAttempts: 1},
+	})
+}
+
+// newTestMetadataService serves the credentials of the host instance profile role.
+func newTestMetadataService() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimSuffix(r.URL.Path, "/") {
+		case "/latest/meta-data/iam/security-credentials":
+			w.Write([]byte("host-role"))
+		case "/latest/meta-data/iam/security-credentials/host-role":
+			w.Write([]byte(`{"Code":"Success","AccessKeyId":"HOSTACCESSKEY","SecretAccessKey":"HOSTSECRET"}`))
+		case "/latest/meta-data/iam/info":
+			w.Write([]byte(`{"Code":"Success","InstanceProfileArn":"arn:aws:iam::123456789012:instance-profile/host-role"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// handlerFixture serves the credentials of the containers from a fake STS, on a host
+// whose metadata service has the instance profile role host-role.
+type handlerFixture struct {
+	metadata   *httptest.Server
+	sts        *ststest.Server
+	containers *metaproxy.MemoryContainerService
+	provider   *metaproxy.CredentialsProvider
+}
+
+func newHandlerFixture(containers map[string]metaproxy.ContainerInfo) *handlerFixture {
+	f := &handlerFixture{
+		metadata:   newTestMetadataService(),
+		sts:        ststest.NewServer(),
+		containers: metaproxy.NewMemoryContainerService("test", containers),
+	}
+
+	f.provider = newTestProvider(f.sts, f.containers)
+	return f
+}
+
+func (f *handlerFixture) Close() {
+	f.metadata.Close()
+	f.sts.Close()
+}
+
+// request sends a GET request for the path from the container IP to the handler.
+func (f *handlerFixture) request(containerIP, path string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = containerIP + ":41234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// credentials requests the security-credentials subpath from 172.17.0.2. The role is
+// served under the alias, unless it is empty.
+func (f *handlerFixture) credentials(subpath, alias string) *httptest.ResponseRecorder {
+	return f.request("172.17.0.2", "/latest/meta-data/iam/security-credentials/"+subpath, func(w http.ResponseWriter, r *http.Request) {
+		handleCredentials(f.metadata.URL, "latest", subpath, alias, false, f.provider, w, r)
+	})
+}
+
+func TestHandleCredentialsHidesHostRole(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	defer f.Close()
+
+	listing := f.credentials("", "")
+	assert.Equal(http.StatusOK, listing.Code)
+	assert.Equal("default", listing.Body.String())
+
+	for _, subpath := range []string{"host-role", "host-role/", "host-role/x"} {
+		resp := f.credentials(subpath, "")
+		assert.Equal(http.StatusNotFound, resp.Code, subpath)
+		assert.NotContains(resp.Body.String(), "HOST", subpath)
+	}
+
+	creds := f.credentials("default", "")
+	assert.Equal(http.StatusOK, creds.Code)
+	assert.NotContains(creds.Body.String(), "HOST")
+	assert.Contains(creds.Body.String(), "ASIATEST")
+}
+
+func TestHandleCredentialsNoRole(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	defer f.Close()
+	f.provider.Reconfigure(metaproxy.RoleDefaults{}, nil, nil, nil)
+
+	// like an instance without an instance profile
+	for _, subpath := range []string{"", "default"} {
+		resp := f.credentials(subpath, "")
+		assert.Equal(http.StatusNotFound, resp.Code, subpath)
+		assert.Equal("", resp.Body.String(), subpath)
+	}
+
+	assert.Equal(0, f.sts.Calls())
+}
+
+func TestHandleIamInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	appRole, _ := metaproxy.NewRoleArn("arn:aws:iam::210987654321:role/app")
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamRole: appRole},
+	})
+	defer f.Close()
+
+	request := func(clientIP string) metadataIamInfo {
+		w := f.request(clientIP, "/latest/meta-data/iam/info", func(w http.ResponseWriter, r *http.Request) {
+			handleIamInfo(f.metadata.URL, "latest", f.provider, w, r)
+		})
+		assert.Equal(http.StatusOK, w.Code, clientIP)
+		assert.NotContains(w.Body.String(), "host-role", clientIP)
+
+		var info metadataIamInfo
+		assert.Nil(json.Unmarshal(w.Body.Bytes(), &info))
+		return info
+	}
+
+	// the role resolved for each container, not the instance profile of the host
+	info := request("172.17.0.2")
+	assert.Equal("Success", info.Code)
+	assert.Equal("arn:aws:iam::123456789012:role/default", info.InstanceProfileArn)
+	assert.Equal("AROATEST", info.InstanceProfileID)
+
+	creds, _ := f.provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Equal(creds.GeneratedAt.UTC().Format(time.RFC3339), info.LastUpdated)
+
+	assert.Equal("arn:aws:iam::210987654321:role/app", request("172.17.0.3").InstanceProfileArn)
+}
+
+func TestHandleCredentialsRoleNameMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	defer f.Close()
+
+	for _, subpath := range []string{"other", "defaultx", "defaul", "other/default"} {
+		resp := f.credentials(subpath, "")
+		assert.Equal(http.StatusNotFound, resp.Code, subpath)
+		assert.NotContains(resp.Body.String(), "ASIATEST", subpath)
+	}
+
+	// like EC2, anything after the role name and a slash is ignored
+	for _, subpath := range []string{"default", "default/", "default/anything"} {
+		resp := f.credentials(subpath, "")
+		assert.Equal(http.StatusOK, resp.Code, subpath)
+		assert.Contains(resp.Body.String(), "ASIATEST", subpath)
+	}
+}
+
+func TestHandleCredentialsRoleNameAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	defer f.Close()
+
+	assert.Equal("app-role", f.credentials("", "app-role").Body.String())
+
+	creds := f.credentials("app-role", "app-role")
+	assert.Equal(http.StatusOK, creds.Code)
+	assert.Contains(creds.Body.String(), "ASIATEST")
+
+	// the role is only served under the alias
+	assert.Equal(http.StatusNotFound, f.credentials("default", "app-role").Code)
+}
+
+func TestHandleCredentialsDebugHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newHandlerFixture(map[string]metaproxy.ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	defer f.Close()
+
+	// off by default
+	resp := f.credentials("default", "")
+	assert.Empty(resp.Header().Get("X-EC2MetaProxy-Role"))
+	assert.Empty(resp.Header().Get("X-EC2MetaProxy-Cache"))
+
+	*debugHeaders = true
+	defer func() { *debugHeaders = false }()
+
+	resp = f.credentials("default", "")
+	assert.Equal("arn:aws:iam::123456789012:role/default", resp.Header().Get("X-EC2MetaProxy-Role"))
+	assert.Equal("HIT", resp.Header().Get("X-EC2MetaProxy-Cache"))
+
+	f.provider.Invalidate(func(string, metaproxy.ContainerCredentials) bool { return true })
+	resp = f.credentials("default", "")
+	assert.Equal("MISS", resp.Header().Get("X-EC2MetaProxy-Cache"))
+}
+
+func TestCredsRegexWithoutTrailingSlash(t *testing.T) {
+	match := credsRegex.FindStringSubmatch("/latest/meta-data/iam/security-credentials")
+	if assert.NotNil(t, match) {
+		assert.Equal(t, "", match[2])
+	}
+}
+
+func TestWriteCredentialsError(t *testing.T) {
+	assert := assert.New(t)
+
+	write := func(err error) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		writeCredentialsError(w, err)
+		return w
+	}
+
+	denied := write(awserr.New("AccessDenied", "Not authorized to perform sts:AssumeRole", nil))
+	assert.Equal(http.StatusForbidden, denied.Code)
+	assert.Contains(denied.Body.String(), `"Code":"AssumeRoleUnauthorizedAccess"`)
+	assert.Contains(denied.Body.String(), `"Message":"Not authorized to perform sts:AssumeRole"`)
+	assert.Equal("", denied.Header().Get("Retry-After"))
+
+	unavailable := []struct {
+		err  error
+		code string
+	}{
+		{awserr.New("Throttling", "Rate exceeded", nil), "Throttling"},
+		{awserr.New("RequestError", "send request failed", nil), "ServiceUnavailable"},
+		{awserr.New("RequestTimeout", "STS did not respond within 5s", nil), "RequestTimeout"},
+		{awserr.NewRequestFailure(awserr.New("InternalFailure", "Internal error", nil), http.StatusInternalServerError, "request-1"), "ServiceUnavailable"},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Service unavailable", nil), http.StatusServiceUnavailable, "request-2"), "ServiceUnavailable"},
+		{metaproxy.StsQueueTimeoutError{Limit: 10, Waited: 10 * time.Second}, "ServiceUnavailable"},
+	}
+
+	for _, tc := range unavailable {
+		w := write(tc.err)
+		assert.Equal(http.StatusServiceUnavailable, w.Code, "%v", tc.err)
+		assert.Contains(w.Body.String(), `"Code":"`+tc.code+`"`)
+		assert.Equal("5", w.Header().Get("Retry-After"))
+	}
+
+	role, _ := metaproxy.NewRoleArn("arn:aws:iam::123456789012:role/admin")
+	notAllowed := write(metaproxy.RoleNotAllowedError{ContainerID: "aaaaaaaaaaaa", RoleArn: role})
+	assert.Equal(http.StatusForbidden, notAllowed.Code)
+	assert.Contains(notAllowed.Body.String(), `"Code":"RoleNotAllowed"`)
+
+	other := write(fmt.Errorf("No container found for IP 172.17.0.2"))
+	assert.Equal(http.StatusInternalServerError, other.Code)
+	assert.Contains(other.Body.String(), `"Code":"InternalError"`)
+}
+
+func TestHandlePlacement(t *testing.T) {
+	assert := assert.New(t)
+
+	request := func(path string) *httptest.ResponseRecorder {
+		match := placementRegex.FindStringSubmatch(path)
+		assert.NotNil(match, path)
+
+		w := httptest.NewRecorder()
+		handlePlacement(match[2], "eu-west-1", w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	assert.Equal("eu-west-1a", request("/latest/meta-data/placement/availability-zone").Body.String())
+	assert.Equal("eu-west-1", request("/latest/meta-data/placement/region/").Body.String())
+	assert.Nil(placementRegex.FindStringSubmatch("/latest/meta-data/placement/availability-zone-id"))
+}
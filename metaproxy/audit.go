@@ -0,0 +1,119 @@
+package metaproxy
+
+import (
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	ContainerID string    `json:"container_id"`
+	Image       string    `json:"image"`
+	SourceIP    string    `json:"source_ip"`
+	RoleArn     string    `json:"role_arn"`
+	SessionName string    `json:"session_name"`
+	Expiration  time.Time `json:"expiration"`
+}
+
+// AuditLogger writes one JSON line for each credential grant. A nil auditLogger
+// discards all records.
+type AuditLogger struct {
+	out          io.Writer
+	logCacheHits bool
+	lock         sync.Mutex
+}
+
+// NewAuditLogger creates an audit logger for the target: "stdout", "syslog" or a
+// file path. Returns nil if the target is empty.
+func NewAuditLogger(target string, logCacheHits bool) (*AuditLogger, error) {
+	var out io.Writer
+
+	switch target {
+	case "":
+		return nil, nil
+	case "stdout":
+		out = os.Stdout
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "ec2metaproxy")
+
+		if err != nil {
+			return nil, err
+		}
+
+		out = writer
+	default:
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+		if err != nil {
+			return nil, err
+		}
+
+		out = file
+	}
+
+	return &AuditLogger{out: out, logCacheHits: logCacheHits}, nil
+}
+
+// Grant records credentials obtained from STS for a container.
+func (a *AuditLogger) Grant(sourceIP string, container ContainerInfo, creds Credentials) {
+	a.write("grant", sourceIP, container, creds)
+}
+
+// CacheHit records cached credentials served to a container, if enabled.
+func (a *AuditLogger) CacheHit(sourceIP string, container ContainerInfo, creds Credentials) {
+	if a != nil && a.logCacheHits {
+		a.write("cache_hit", sourceIP, container, creds)
+	}
+}
+
+// Static records static credentials served to a container.
+func (a *AuditLogger) Static(sourceIP string, container ContainerInfo, creds Credentials) {
+	a.write("static", sourceIP, container, creds)
+}
+
+// Grace records cached credentials served to a container whose lookup failed, during
+// the exit grace period.
+func (a *AuditLogger) Grace(sourceIP string, container ContainerInfo, creds Credentials) {
+	a.write("grace", sourceIP, container, creds)
+}
+
+// Denied records a container that requested a role it is not allowed to assume.
+func (a *AuditLogger) Denied(sourceIP string, container ContainerInfo) {
+	a.write("denied", sourceIP, container, Credentials{RoleArn: container.IamRole})
+}
+
+func (a *AuditLogger) write(event, sourceIP string, container ContainerInfo, creds Credentials) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(&auditRecord{
+		Time:        time.Now(),
+		Event:       event,
+		ContainerID: container.ID,
+		Image:       container.Image,
+		SourceIP:    sourceIP,
+		RoleArn:     creds.RoleArn.String(),
+		SessionName: creds.SessionName,
+		Expiration:  creds.Expiration,
+	})
+
+	if err != nil {
+		log.Error("Error marshaling audit record: ", err)
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		log.Error("Error writing audit record: ", err)
+	}
+}
@@ -0,0 +1,129 @@
+package metaproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLoggerGrants(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy-audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// the file is appended to
+	auditFile := filepath.Join(dir, "audit.log")
+	assert.Nil(ioutil.WriteFile(auditFile, []byte("previous\n"), 0600))
+
+	audit, err := NewAuditLogger(auditFile, false)
+	assert.Nil(err)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Image: "example/app:1"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.audit = audit
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	// cache hits are not recorded by default
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	lines := readAuditLines(t, auditFile)
+	assert.Equal(2, len(lines))
+	assert.Equal("previous", lines[0])
+
+	var record map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(lines[1]), &record), lines[1])
+	assert.Equal("grant", record["event"])
+	assert.Equal("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", record["container_id"])
+	assert.Equal("example/app:1", record["image"])
+	assert.Equal("172.17.0.2", record["source_ip"])
+	assert.Equal("arn:aws:iam::123456789012:role/default", record["role_arn"])
+	assert.Equal(creds.SessionName, record["session_name"])
+	assert.Equal(creds.Expiration.Format(time.RFC3339), parseAuditTime(t, record["expiration"]).Format(time.RFC3339))
+	assert.WithinDuration(time.Now(), parseAuditTime(t, record["time"]), time.Minute)
+
+	assert.NotContains(lines[1], creds.SecretKey)
+	assert.NotContains(lines[1], creds.Token)
+	assert.NotContains(lines[1], creds.AccessKey)
+
+	info, err := os.Stat(auditFile)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestAuditLoggerCacheHits(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy-audit")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// new files are only readable by the proxy
+	auditFile := filepath.Join(dir, "audit.log")
+	audit, err := NewAuditLogger(auditFile, true)
+	assert.Nil(err)
+
+	info, err := os.Stat(auditFile)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.audit = audit
+
+	for i := 0; i < 2; i++ {
+		_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+		assert.Nil(err)
+	}
+
+	lines := readAuditLines(t, auditFile)
+	assert.Equal(2, len(lines))
+	assert.Contains(lines[0], `"event":"grant"`)
+	assert.Contains(lines[1], `"event":"cache_hit"`)
+
+	// no target, no audit log
+	audit, err = NewAuditLogger("", true)
+	assert.Nil(err)
+	assert.Nil(audit)
+	audit.Grant("172.17.0.2", ContainerInfo{}, Credentials{})
+}
+
+func readAuditLines(t *testing.T, auditFile string) []string {
+	data, err := ioutil.ReadFile(auditFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func parseAuditTime(t *testing.T, value interface{}) time.Time {
+	parsed, err := time.Parse(time.RFC3339Nano, value.(string))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
@@ -0,0 +1,111 @@
+package metaproxy
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/cihub/seelog"
+)
+
+var (
+	// STS error codes that indicate the call can be retried
+	retryableStsCodes = map[string]bool{
+		"Throttling":            true,
+		"ThrottlingException":   true,
+		"RequestLimitExceeded":  true,
+		"IDPCommunicationError": true,
+	}
+)
+
+// Backoff are the retries of throttled STS calls. Calls are attempted MaxAttempts
+// times, waiting a random delay of up to BaseDelay doubled for each attempt, at most
+// MaxDelay.
+type Backoff struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Do calls fn until it succeeds, returns an error that can not be retried or the
+// maximum number of attempts is reached. The delay between attempts grows
+// exponentially with full jitter. The last error is returned on failure, or the error
+// of ctx if it is done while waiting.
+func (b Backoff) Do(ctx context.Context, fn func() error) error {
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		err = fn()
+
+		if err == nil || !IsRetryableStsError(err) || attempt >= b.MaxAttempts {
+			return err
+		}
+
+		delay := b.Delay(attempt)
+		log.Debug("Retrying throttled STS call in ", delay, ": ", err)
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Delay returns a random delay to wait after the given (1-based) attempt.
+func (b Backoff) Delay(attempt int) time.Duration {
+	limit := b.MaxDelay
+
+	if shift := uint(attempt - 1); shift < 32 {
+		if d := b.BaseDelay << shift; d > 0 && d < limit {
+			limit = d
+		}
+	}
+
+	if limit <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// IsConnectionError checks if the STS endpoint could not be reached or did not respond
+// in time, as opposed to STS responding with an error.
+func IsConnectionError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "RequestError" || awsErr.Code() == "RequestTimeout"
+	}
+
+	return false
+}
+
+// IsTimeoutError checks if STS did not respond within the STS timeout.
+func IsTimeoutError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "RequestTimeout"
+	}
+
+	return false
+}
+
+// IsServerError checks if STS responded with a 5xx status, like during an outage.
+func IsServerError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+
+	return false
+}
+
+// IsRetryableStsError checks if STS throttled the call or could not reach the
+// identity provider, so the call can be retried.
+func IsRetryableStsError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return retryableStsCodes[awsErr.Code()]
+	}
+
+	return false
+}
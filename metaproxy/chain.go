@@ -0,0 +1,78 @@
+package metaproxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	chainSessionName = "ec2metaproxy-chain"
+
+	// MaxChainedSessionDuration is the limit AWS puts on sessions obtained through
+	// role chaining.
+	MaxChainedSessionDuration = 1 * time.Hour
+)
+
+// chainedRoleProvider provides the credentials of an intermediate role assumed with
+// the base credentials. They are renewed shortly before they expire.
+type chainedRoleProvider struct {
+	awscredentials.Expiry
+	sts        stsAPI
+	roleArn    RoleArn
+	externalID string
+}
+
+func (p *chainedRoleProvider) Retrieve() (awscredentials.Value, error) {
+	var externalID *string
+
+	if len(p.externalID) > 0 {
+		externalID = aws.String(p.externalID)
+	}
+
+	log.Debug("Assuming intermediate role: ", p.roleArn)
+	resp, err := p.sts.AssumeRole(context.Background(), &sts.AssumeRoleInput{
+		DurationSeconds: aws.Int64(int64(MaxChainedSessionDuration / time.Second)),
+		ExternalId:      externalID,
+		RoleArn:         aws.String(p.roleArn.String()),
+		RoleSessionName: aws.String(chainSessionName),
+	}, nil)
+
+	if err != nil {
+		log.Error("Error assuming intermediate role ", p.roleArn, ": ", err)
+		return awscredentials.Value{}, err
+	}
+
+	p.SetExpiration(*resp.Credentials.Expiration, time.Minute)
+
+	return awscredentials.Value{
+		AccessKeyID:     *resp.Credentials.AccessKeyId,
+		SecretAccessKey: *resp.Credentials.SecretAccessKey,
+		SessionToken:    *resp.Credentials.SessionToken,
+		ProviderName:    chainSessionName,
+	}, nil
+}
+
+// NewChainedSession returns a copy of the base session that signs requests with the
+// credentials of the intermediate role. The intermediate role is assumed through the
+// STS endpoint of the config, like the container roles, within the STS timeout.
+func NewChainedSession(base *session.Session, stsConfig *aws.Config, stsTimeout time.Duration, intermediateRole RoleArn, externalID string) *session.Session {
+	var stsConfigs []*aws.Config
+
+	if stsConfig != nil {
+		stsConfigs = append(stsConfigs, stsConfig)
+	}
+
+	provider := &chainedRoleProvider{
+		sts:        &stsClient{sts.New(base, stsConfigs...), stsTimeout},
+		roleArn:    intermediateRole,
+		externalID: externalID,
+	}
+
+	return base.Copy(&aws.Config{Credentials: awscredentials.NewCredentials(provider)})
+}
@@ -0,0 +1,134 @@
+package metaproxy
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// ContainerInfo is the identity and IAM settings of a container.
+type ContainerInfo struct {
+	ID        string
+	Name      string
+	Image     string
+	IamRole   RoleArn
+	IamPolicy string
+
+	// IamPolicyArns are managed policies passed to sts:AssumeRole as session policies,
+	// in addition to IamPolicy.
+	IamPolicyArns []string
+
+	// IamExternalID is passed to sts:AssumeRole for roles with an ExternalId condition.
+	IamExternalID string
+
+	// WebIdentityTokenFile is the path on the proxy host to an OIDC token. When set,
+	// credentials are obtained with sts:AssumeRoleWithWebIdentity instead of sts:AssumeRole.
+	WebIdentityTokenFile string
+
+	// SessionDuration overrides the duration of the role sessions. Uses the proxy
+	// default if zero.
+	SessionDuration time.Duration
+
+	// SessionTags are passed to sts:AssumeRole.
+	SessionTags SessionTags
+
+	// Labels are the labels of the container, or the annotations of the pod, that the
+	// static credentials mappings match.
+	Labels map[string]string
+}
+
+// maxPolicyArns is the STS limit on the managed session policies of a role session.
+const maxPolicyArns = 10
+
+var policyArnRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(\d{12}|aws):policy/[\x21-\x7e]+$`)
+
+// ContainerService looks up containers on a container platform. Implementations must
+// be safe for concurrent use.
+type ContainerService interface {
+	// ContainerForIP returns the container that has the IP. An error is returned if no
+	// such container exists. It is called concurrently for different IPs.
+	ContainerForIP(containerIP string) (ContainerInfo, error)
+
+	// TypeName is the name of the platform, used in logs and metrics.
+	TypeName() string
+
+	// Ping checks that the container platform can be reached.
+	Ping() error
+}
+
+// ConnContainerService is a ContainerService that identifies containers from the
+// connection of the request instead of its remote IP, for containers whose requests
+// can not be told apart by IP. The returned key is passed to ContainerForIP in place of
+// the IP and the credentials are cached by it.
+type ConnContainerService interface {
+	ContainerService
+
+	// ContainerKeyForConn returns the key of the container that opened the connection.
+	ContainerKeyForConn(conn net.Conn) (string, error)
+}
+
+// ParsePolicyArns parses comma separated policy ARNs. Malformed ARNs are logged and
+// ignored rather than failing the credentials request.
+func ParsePolicyArns(containerID, value string) []string {
+	var arns []string
+
+	for _, arn := range strings.Split(value, ",") {
+		arn = strings.TrimSpace(arn)
+
+		if len(arn) == 0 {
+			continue
+		}
+
+		if !policyArnRegexp.MatchString(arn) {
+			log.Warn("Ignoring malformed policy ARN ", arn, " of container ", containerID)
+			continue
+		}
+
+		arns = append(arns, arn)
+	}
+
+	if len(arns) > maxPolicyArns {
+		log.Warn("Container ", containerID, " has more than ", maxPolicyArns, " policy ARNs, ignoring the rest")
+		arns = arns[:maxPolicyArns]
+	}
+
+	return arns
+}
+
+// ParseSessionDuration parses the session duration label or metadata of the container,
+// like "2h". Returns zero, the default session duration, if empty or invalid.
+func ParseSessionDuration(containerID, value string) time.Duration {
+	value = strings.TrimSpace(value)
+
+	if len(value) == 0 {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil || duration <= 0 {
+		log.Warn("Invalid session duration ", value, " of container ", containerID, ", using default session duration")
+		return 0
+	}
+
+	return duration
+}
+
+// NormalizeIP formats the IP so that equivalent forms, such as IPv4-mapped IPv6
+// addresses, are the same string. Returns an empty string if the IP is not valid.
+func NormalizeIP(address string) string {
+	ip := net.ParseIP(strings.TrimSpace(address))
+
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	return ip.String()
+}
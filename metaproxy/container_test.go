@@ -0,0 +1,15 @@
+package metaproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicyArns(t *testing.T) {
+	assert := assert.New(t)
+
+	arns := ParsePolicyArns("a", " arn:aws:iam::aws:policy/ReadOnlyAccess, arn:aws:iam::123456789012:role/app,,arn:aws-cn:iam::123456789012:policy/path/app ")
+	assert.Equal([]string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws-cn:iam::123456789012:policy/path/app"}, arns)
+	assert.Nil(ParsePolicyArns("a", ""))
+}
@@ -0,0 +1,1845 @@
+package metaproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	maxSessionNameLen int = 32
+
+	// STS limits on the DurationSeconds parameter of AssumeRole
+	minSessionDuration = 15 * time.Minute
+	maxSessionDuration = 12 * time.Hour
+
+	// startupCheckSessionName is the session name of CheckDefaultRole.
+	startupCheckSessionName = "ec2metaproxy-startup-check"
+
+	// minimum remaining lifetime at which the background refresh renews credentials
+	backgroundRefreshThreshold = 10 * time.Minute
+)
+
+var (
+	// matches char that is not valid in a STS role session name
+	invalidSessionNameRegexp = regexp.MustCompile(`[^\w+=,.@-]`)
+)
+
+// Credentials are temporary AWS credentials of a role session.
+type Credentials struct {
+	AccessKey   string
+	Expiration  time.Time
+	GeneratedAt time.Time
+	RoleArn     RoleArn
+	RoleID      string
+	SecretKey   string
+	SessionName string
+	Token       string
+}
+
+// ExpiredNow checks if the credentials have expired.
+func (c Credentials) ExpiredNow() bool {
+	return c.ExpiredAt(time.Now())
+}
+
+// ExpiredAt checks if the credentials have expired at the time.
+func (c Credentials) ExpiredAt(at time.Time) bool {
+	return at.After(c.Expiration)
+}
+
+// ExpiresIn checks if the credentials expire within the duration.
+func (c Credentials) ExpiresIn(d time.Duration) bool {
+	return c.ExpiredAt(time.Now().Add(d))
+}
+
+// ExpiresInWithSkew is ExpiresIn for an AWS clock that is skew ahead of the local clock.
+func (c Credentials) ExpiresInWithSkew(d time.Duration, skew time.Duration) bool {
+	return c.ExpiresIn(d + skew)
+}
+
+// ContainerCredentials are the credentials cached for a container.
+type ContainerCredentials struct {
+	ContainerInfo
+	Credentials
+
+	// key of the credentials shared by all containers with the same role and policy
+	sharedKey string
+
+	// sessionName is kept across refreshes so the CloudTrail events of the container
+	// share one role session name
+	sessionName string
+
+	// createdAt is when the container of the entry was resolved
+	createdAt time.Time
+}
+
+// IsValid checks that the entry still describes the container and is younger than
+// maxAge, unless maxAge is zero. The expiration of the credentials is checked separately
+// since they are shared with other containers.
+func (c ContainerCredentials) IsValid(container ContainerInfo, maxAge time.Duration) bool {
+	return c.ContainerInfo.IamRole.Equals(container.IamRole) &&
+		c.ContainerInfo.ID == container.ID &&
+		(maxAge <= 0 || time.Since(c.createdAt) < maxAge)
+}
+
+// CredentialsProviderConfig contains the settings of a CredentialsProvider.
+type CredentialsProviderConfig struct {
+	Defaults        RoleDefaults
+	SessionDuration time.Duration
+	Retry           Backoff
+
+	// NegativeCacheTTL is how long a failed container lookup is remembered
+	// before the container service is asked again.
+	NegativeCacheTTL time.Duration
+
+	// Sts configures the STS endpoint. Uses the global endpoint if nil.
+	Sts *aws.Config
+
+	// StsFailover are the STS endpoints to try in order when the STS endpoint can
+	// not be reached.
+	StsFailover []*aws.Config
+
+	// AccountSessions sign the STS calls that assume the roles of their account, by
+	// account ID, for accounts that require other base credentials than the session of
+	// the provider.
+	AccountSessions map[string]*session.Session
+
+	// StsEndpoints are the STS endpoints of the roles that must not be assumed through
+	// the STS endpoint and its failover endpoints.
+	StsEndpoints StsEndpointTable
+
+	// StsTimeout bounds every STS call, including the retries of the SDK. Calls are
+	// not bounded if zero.
+	StsTimeout time.Duration
+
+	// MaxConcurrentSts limits the number of concurrent STS calls that assume roles.
+	// Not limited if zero.
+	MaxConcurrentSts int
+
+	// StsQueueTimeout is the maximum time a call waits for one of the concurrent
+	// calls to finish. Waits until the request is canceled if zero.
+	StsQueueTimeout time.Duration
+
+	// StsProbeInterval is the interval at which the latency of the STS endpoints is
+	// measured, to prefer the fastest endpoint over the order of the failover endpoints.
+	// Endpoints are not probed if zero.
+	StsProbeInterval time.Duration
+
+	// ClockSkewMargin is added to the refresh thresholds to absorb clock drift that
+	// the measured skew does not account for.
+	ClockSkewMargin time.Duration
+
+	// Audit records the credentials granted to containers. May be nil.
+	Audit *AuditLogger
+
+	// ImageRoles maps container images to roles for containers without a role.
+	ImageRoles ImageRoleTable
+
+	// NetworkRoles maps container subnets to default roles for containers without
+	// a role or image mapping.
+	NetworkRoles NetworkRoleTable
+
+	// StaticCredentials are served to the containers they match instead of assuming
+	// a role.
+	StaticCredentials StaticCredentialsTable
+
+	// SessionName is the template of the role session names. Uses the
+	// default template if empty.
+	SessionName SessionNameTemplate
+
+	// SessionNamePrefix is prepended to the role session names. May be empty.
+	SessionNamePrefix string
+
+	// Guardrail is added to the session policy of every assumed role. May be nil.
+	Guardrail *GuardrailPolicy
+
+	// Tracer traces the credentials requests. May be nil.
+	Tracer *Tracer
+
+	// RefreshThreshold is the remaining lifetime at which a request refreshes the
+	// cached credentials. Scales with the session duration if zero.
+	RefreshThreshold time.Duration
+
+	// MinLifetime is the minimum remaining lifetime of the credentials returned by
+	// CredentialsForIP. Cached credentials that expire sooner are refreshed first.
+	MinLifetime time.Duration
+
+	// DryRun resolves the container roles without assuming them, to validate the
+	// role mappings.
+	DryRun bool
+
+	// DisableCache assumes the role for every credentials request instead of caching the
+	// credentials, so they are not kept in memory. The refresh threshold and minimum
+	// lifetime have no effect, since the credentials are always new.
+	DisableCache bool
+
+	// MaxCachedContainers is the number of container IPs whose credentials are
+	// cached. The least recently used are evicted beyond it. Unbounded if zero.
+	MaxCachedContainers int
+
+	// MaxEntryAge is the age at which a cache entry is dropped and the container and its
+	// role are resolved again, so label and role changes of long-running containers take
+	// effect. Unbounded if zero.
+	MaxEntryAge time.Duration
+
+	// ExitGracePeriod is how long the cached credentials of a container are still served
+	// after its lookup starts to fail, for example while it restarts. Credentials are
+	// never served past their expiration. Disabled if zero.
+	ExitGracePeriod time.Duration
+
+	// MaxSessionDuration caps the session duration overrides of the containers,
+	// for example to the 1 hour limit of role chaining. Uses the STS limit if zero.
+	MaxSessionDuration time.Duration
+}
+
+// NoRoleForContainerError is returned when neither the container nor the configuration
+// provide a role, like an instance without an instance profile.
+type NoRoleForContainerError struct {
+	ContainerID string
+}
+
+func (e NoRoleForContainerError) Error() string {
+	return fmt.Sprintf("No role for container %s", e.ContainerID)
+}
+
+// RoleNotAllowedError is returned when a container requests a role that is not in
+// the allowlist of its image or network.
+type RoleNotAllowedError struct {
+	ContainerID string
+	RoleArn     RoleArn
+}
+
+func (e RoleNotAllowedError) Error() string {
+	return fmt.Sprintf("Role %s is not allowed for container %s", e.RoleArn, e.ContainerID)
+}
+
+// PolicyTooLargeError is returned when the session policy of a container, including
+// the guardrail, exceeds the size STS accepts.
+type PolicyTooLargeError struct {
+	ContainerID string
+	Size        int
+}
+
+func (e PolicyTooLargeError) Error() string {
+	return fmt.Sprintf("Session policy of container %s has %d characters, STS accepts at most %d", e.ContainerID, e.Size, maxPolicySize)
+}
+
+// InvalidPolicyError is returned when the session policy of a container is not a
+// JSON object.
+type InvalidPolicyError struct {
+	ContainerID string
+	Err         error
+}
+
+func (e InvalidPolicyError) Error() string {
+	return fmt.Sprintf("Invalid session policy for container %s: %s", e.ContainerID, e.Err)
+}
+
+// DryRunError is returned instead of credentials in dry run mode. It describes the
+// role that would have been assumed.
+type DryRunError struct {
+	ContainerID string
+	Role        ContainerRole
+}
+
+func (e DryRunError) Error() string {
+	return fmt.Sprintf("Dry run: container %s would assume role %s (policy: %t, policy ARNs: %d, external ID: %t)",
+		e.ContainerID, e.Role.RoleArn, len(e.Role.Policy) > 0, len(e.Role.PolicyArns), len(e.Role.ExternalID) > 0)
+}
+
+// StsQueueTimeoutError is returned when the limit of concurrent STS calls is reached
+// and no call finished within the queue timeout.
+type StsQueueTimeoutError struct {
+	Limit  int
+	Waited time.Duration
+}
+
+func (e StsQueueTimeoutError) Error() string {
+	return fmt.Sprintf("Waited %s for one of %d concurrent STS calls to finish", e.Waited, e.Limit)
+}
+
+type failedLookup struct {
+	err     error
+	expires time.Time
+}
+
+// CredentialsProvider resolves the roles of containers and caches their credentials.
+type CredentialsProvider struct {
+	clockSkew            int64 // time.Duration, accessed atomically; first for 64-bit alignment
+	container            ContainerService
+	stsClients           []stsAPI            // the STS endpoint followed by the failover endpoints
+	accountSts           map[string][]stsAPI // like stsClients, by account ID of the role
+	stsEndpoints         StsEndpointTable
+	endpointSts          map[string][]stsAPI // clients of stsEndpoints, created on first use
+	endpointStsLock      sync.Mutex
+	newEndpointSts       func(override StsEndpointOverride, accountID string) stsAPI
+	stsLimit             *stsLimiter
+	stsProbeInterval     time.Duration
+	preferredSts         int32 // index of stsClients, accessed atomically
+	defaultIamRoleArn    RoleArn
+	defaultIamPolicy     string
+	defaultIamExternalID string
+	sessionDuration      time.Duration
+	maxSessionDuration   time.Duration
+	refreshThreshold     time.Duration
+	minLifetime          time.Duration
+	dryRun               bool
+	disableCache         bool
+	retry                Backoff
+	negativeCacheTTL     time.Duration
+	imageRoles           ImageRoleTable
+	staticCreds          StaticCredentialsTable
+	networkRoles         NetworkRoleTable
+	audit                *AuditLogger
+	clockSkewMargin      time.Duration
+	sessionName          SessionNameTemplate
+	sessionNamePrefix    string
+	guardrail            *GuardrailPolicy
+	tracer               *Tracer
+	cache                *credentialsCache
+	schedule             *refreshSchedule
+	roleSessions         *roleSessionDurations
+	sharedCredentials    map[string]Credentials
+	failedLookups        map[string]failedLookup
+	exitGracePeriod      time.Duration
+	maxEntryAge          time.Duration
+	lookupFailedSince    map[string]time.Time // by container IP, for the exit grace period
+	assuming             flightGroup
+	lock                 sync.Mutex
+	stop                 chan struct{}
+	stopped              chan struct{}
+}
+
+// NewCredentialsProvider creates a provider that assumes roles with the credentials of
+// the AWS session.
+func NewCredentialsProvider(awsSession *session.Session, container ContainerService, config CredentialsProviderConfig) *CredentialsProvider {
+	var stsConfigs []*aws.Config
+
+	if config.Sts != nil {
+		stsConfigs = append(stsConfigs, config.Sts)
+	}
+
+	newClients := func(awsSession *session.Session) []stsAPI {
+		clients := []stsAPI{&stsClient{sts.New(awsSession, stsConfigs...), config.StsTimeout}}
+
+		for _, failover := range config.StsFailover {
+			clients = append(clients, &stsClient{sts.New(awsSession, failover), config.StsTimeout})
+		}
+
+		return clients
+	}
+
+	c := newCredentialsProvider(newClients(awsSession), container, config)
+
+	for accountID, accountSession := range config.AccountSessions {
+		c.accountSts[accountID] = newClients(accountSession)
+	}
+
+	c.newEndpointSts = func(override StsEndpointOverride, accountID string) stsAPI {
+		endpointSession := awsSession
+
+		if accountSession, found := config.AccountSessions[accountID]; found {
+			endpointSession = accountSession
+		}
+
+		return &stsClient{sts.New(endpointSession, &aws.Config{
+			Endpoint: aws.String(override.Endpoint),
+			Region:   aws.String(override.Region),
+		}), config.StsTimeout}
+	}
+
+	return c
+}
+
+// newCredentialsProvider creates a provider that calls the STS clients in order, the
+// STS endpoint followed by the failover endpoints.
+func newCredentialsProvider(stsClients []stsAPI, container ContainerService, config CredentialsProviderConfig) *CredentialsProvider {
+	sessionName := config.SessionName
+	maxDuration := config.MaxSessionDuration
+
+	if maxDuration <= 0 || maxDuration > maxSessionDuration {
+		maxDuration = maxSessionDuration
+	}
+
+	if len(sessionName) == 0 {
+		sessionName = DefaultSessionNameTemplate
+	}
+
+	c := &CredentialsProvider{
+		container:            container,
+		stsClients:           stsClients,
+		accountSts:           make(map[string][]stsAPI),
+		stsEndpoints:         config.StsEndpoints,
+		endpointSts:          make(map[string][]stsAPI),
+		stsLimit:             newStsLimiter(config.MaxConcurrentSts, config.StsQueueTimeout),
+		stsProbeInterval:     config.StsProbeInterval,
+		defaultIamRoleArn:    config.Defaults.RoleArn,
+		defaultIamPolicy:     config.Defaults.Policy,
+		defaultIamExternalID: config.Defaults.ExternalID,
+		sessionDuration:      clampSessionDuration(config.SessionDuration),
+		maxSessionDuration:   maxDuration,
+		refreshThreshold:     config.RefreshThreshold,
+		minLifetime:          config.MinLifetime,
+		dryRun:               config.DryRun,
+		disableCache:         config.DisableCache,
+		retry:                config.Retry,
+		negativeCacheTTL:     config.NegativeCacheTTL,
+		imageRoles:           config.ImageRoles,
+		staticCreds:          config.StaticCredentials,
+		networkRoles:         config.NetworkRoles,
+		audit:                config.Audit,
+		clockSkewMargin:      config.ClockSkewMargin,
+		sessionName:          sessionName,
+		sessionNamePrefix:    config.SessionNamePrefix,
+		guardrail:            config.Guardrail,
+		tracer:               config.Tracer,
+		cache:                newCredentialsCache(config.MaxCachedContainers),
+		schedule:             newRefreshSchedule(),
+		roleSessions:         newRoleSessionDurations(),
+		sharedCredentials:    make(map[string]Credentials),
+		failedLookups:        make(map[string]failedLookup),
+		exitGracePeriod:      config.ExitGracePeriod,
+		maxEntryAge:          config.MaxEntryAge,
+		lookupFailedSince:    make(map[string]time.Time),
+	}
+
+	credentialAge.SetSource(func() []float64 { return c.cacheAges(false) })
+	credentialRemainingLifetime.SetSource(func() []float64 { return c.cacheAges(true) })
+
+	return c
+}
+
+// cacheAges returns the age, or the remaining lifetime, of the cached credentials in
+// seconds. Only the timestamps are copied under the lock, so large caches do not block
+// requests while the metrics are written.
+func (c *CredentialsProvider) cacheAges(remaining bool) []float64 {
+	c.lock.Lock()
+	times := make([]time.Time, 0, c.cache.Len())
+
+	c.cache.Each(func(containerIP string, entry ContainerCredentials) {
+		if remaining {
+			times = append(times, entry.Expiration)
+		} else {
+			times = append(times, entry.GeneratedAt)
+		}
+	})
+
+	c.lock.Unlock()
+
+	now := time.Now()
+	ages := make([]float64, len(times))
+
+	for i, t := range times {
+		if remaining {
+			ages[i] = math.Max(t.Sub(now).Seconds(), 0)
+		} else {
+			ages[i] = now.Sub(t).Seconds()
+		}
+	}
+
+	return ages
+}
+
+// PingSts checks that STS can be reached with the base credentials.
+func (c *CredentialsProvider) PingSts() error {
+	return c.stsClients[0].GetCallerIdentity(context.Background())
+}
+
+// CheckDefaultRole assumes the default role and discards the credentials, to find out
+// at startup, instead of on the first request, if the base credentials are not
+// allowed to assume it. Does nothing if there is no default role.
+func (c *CredentialsProvider) CheckDefaultRole(ctx context.Context) error {
+	c.lock.Lock()
+	roleArn, externalID := c.defaultIamRoleArn, c.defaultIamExternalID
+	c.lock.Unlock()
+
+	if roleArn.Empty() {
+		return nil
+	}
+
+	_, err := c.AssumeRole(ctx, AssumeRoleInput{
+		RoleArn:     roleArn,
+		ExternalID:  externalID,
+		SessionName: sanitizeSessionName(c.sessionNamePrefix + startupCheckSessionName),
+		Duration:    minSessionDuration,
+	})
+
+	if err != nil {
+		return fmt.Errorf("Error assuming the default role %s: %s", roleArn, err)
+	}
+
+	return nil
+}
+
+// RefreshThreshold is the remaining lifetime at which a request refreshes the cached
+// credentials. Unless configured, it scales with the session duration: 5 minutes of a
+// 1 hour session. It is at least the minimum lifetime, so requests never get
+// credentials that expire sooner.
+func (c *CredentialsProvider) RefreshThreshold() time.Duration {
+	threshold := c.sessionDuration / 12
+
+	if c.refreshThreshold > 0 {
+		threshold = c.refreshThreshold
+	}
+
+	if threshold < c.minLifetime {
+		threshold = c.minLifetime
+	}
+
+	return threshold
+}
+
+// BackgroundRefreshThreshold is the remaining lifetime at which the background refresh
+// renews cached credentials. It is kept at twice the request threshold so the
+// credentials are renewed in the background before requests have to wait on STS.
+func (c *CredentialsProvider) BackgroundRefreshThreshold() time.Duration {
+	if threshold := 2 * c.RefreshThreshold(); threshold > backgroundRefreshThreshold {
+		return threshold
+	}
+
+	return backgroundRefreshThreshold
+}
+
+// ContainerKeyForConn returns the key that identifies the container that opened the
+// connection. It is the remote IP of the connection, unless the container service is a
+// ConnContainerService.
+func (c *CredentialsProvider) ContainerKeyForConn(conn net.Conn) (string, error) {
+	if service, ok := c.container.(ConnContainerService); ok {
+		return service.ContainerKeyForConn(conn)
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		return "", err
+	}
+
+	return host, nil
+}
+
+// CredentialsForConn returns the credentials of the container that opened the connection.
+func (c *CredentialsProvider) CredentialsForConn(ctx context.Context, conn net.Conn) (Credentials, error) {
+	key, err := c.ContainerKeyForConn(conn)
+
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return c.CredentialsForIP(ctx, key)
+}
+
+// cacheStatusKey is the context key of the cache status of a credentials request.
+type cacheStatusKey struct{}
+
+// WithCacheStatus returns a context in which CredentialsForIP records how it served the
+// credentials: hit, miss, stale, static or disabled. The status is empty if the request
+// failed before the cache was checked.
+func WithCacheStatus(ctx context.Context) (context.Context, *string) {
+	status := new(string)
+	return context.WithValue(ctx, cacheStatusKey{}, status), status
+}
+
+// CredentialsForIP returns the credentials of the container with the IP. When ctx is
+// done, it returns the error of ctx without waiting for STS. The credentials are still
+// assumed and cached for the other requests of the container.
+func (c *CredentialsProvider) CredentialsForIP(ctx context.Context, containerIP string) (creds Credentials, err error) {
+	if ip := NormalizeIP(containerIP); len(ip) > 0 {
+		containerIP = ip
+	}
+
+	fields := logFields{"container_ip": containerIP}
+	trace := c.tracer.Start("CredentialsForIP")
+
+	defer func() {
+		if status, ok := ctx.Value(cacheStatusKey{}).(*string); ok && fields["cache"] != nil {
+			*status = fmt.Sprint(fields["cache"])
+		}
+
+		for key, value := range fields {
+			trace.SetAttribute(key, fmt.Sprint(value))
+		}
+
+		trace.SetError(err)
+		trace.End()
+
+		if dryRun, ok := err.(DryRunError); ok {
+			fields["dry_run"] = dryRun.Error()
+			logStructured(log.InfoLvl, "Credentials request", fields)
+		} else if err != nil {
+			fields["error"] = err.Error()
+			logStructured(log.WarnLvl, "Credentials request failed", fields)
+		} else {
+			fields["role_arn"] = creds.RoleArn.String()
+			logStructured(log.InfoLvl, "Credentials request", fields)
+			c.checkNearExpiry(containerIP, creds)
+		}
+	}()
+
+	// static credentials bypass STS and the cache
+	if creds, found, err := c.staticCredentials(containerIP, fields); err != nil || found {
+		return creds, err
+	}
+
+	if c.disableCache {
+		return c.uncachedCredentials(ctx, containerIP, fields, trace)
+	}
+
+	entry, role, found, err := c.cachedCredentials(ctx, containerIP, fields, trace)
+
+	if err != nil || found {
+		return entry.Credentials, err
+	}
+
+	if c.dryRun {
+		fields["role_arn"] = role.RoleArn.String()
+		return Credentials{}, DryRunError{entry.ContainerInfo.ID, role}
+	}
+
+	// STS is called without the lock so requests for other containers are not held up
+	credentialCacheMisses.Inc()
+	fields["cache"] = "miss"
+
+	call := trace.Child("AssumeRole")
+	call.SetAttribute("role_arn", role.RoleArn.String())
+
+	start := time.Now()
+	shared, err := c.assumeShared(ctx, entry.sharedKey, containerIP, entry.ContainerInfo, role, entry.sessionName, c.RefreshThreshold())
+	fields["sts_latency_ms"] = time.Since(start).Seconds() * 1000
+
+	call.SetError(err)
+	call.End()
+
+	if err != nil {
+		if c.usableStale(entry.Credentials, role) && ctx.Err() == nil {
+			// keep serving the credentials a failed refresh would have replaced
+			log.Warnf("Serving cached credentials of container %s that expire in %s, refreshing them failed: %s",
+				entry.ContainerInfo.ID, entry.Expiration.Sub(time.Now()).Truncate(time.Second), err)
+			credentialsServedStale.Inc()
+			fields["cache"] = "stale"
+			return entry.Credentials, nil
+		}
+
+		return Credentials{}, err
+	}
+
+	entry.Credentials = shared
+
+	c.lock.Lock()
+	c.storeEntry(containerIP, entry)
+	c.lock.Unlock()
+
+	return entry.Credentials, nil
+}
+
+// uncachedCredentials assumes the role of the container without reading or storing
+// the cached credentials.
+func (c *CredentialsProvider) uncachedCredentials(ctx context.Context, containerIP string, fields logFields, trace *span) (Credentials, error) {
+	if err := ctx.Err(); err != nil {
+		return Credentials{}, err
+	}
+
+	lookup := trace.Child("ContainerForIP")
+	lookup.SetAttribute("platform", c.container.TypeName())
+	container, err := c.containerForIP(containerIP)
+	lookup.SetError(err)
+	lookup.End()
+
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	fields["container_id"] = container.ID
+	fields["cache"] = "disabled"
+
+	c.lock.Lock()
+	allowed := c.roleAllowed(containerIP, container)
+	role := c.resolveRole(containerIP, container)
+	c.lock.Unlock()
+
+	if !allowed {
+		c.audit.Denied(containerIP, container)
+		return Credentials{}, RoleNotAllowedError{container.ID, container.IamRole}
+	} else if role.RoleArn.Empty() {
+		return Credentials{}, NoRoleForContainerError{container.ID}
+	}
+
+	if c.dryRun {
+		fields["role_arn"] = role.RoleArn.String()
+		return Credentials{}, DryRunError{container.ID, role}
+	}
+
+	call := trace.Child("AssumeRole")
+	call.SetAttribute("role_arn", role.RoleArn.String())
+
+	start := time.Now()
+	sessionName := generateSessionName(c.sessionNamePrefix, c.sessionName, c.container.TypeName(), containerIP, container)
+	creds, err := c.assumeContainerRole(ctx, container, role, sessionName)
+	fields["sts_latency_ms"] = time.Since(start).Seconds() * 1000
+
+	call.SetError(err)
+	call.End()
+
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	c.audit.Grant(containerIP, container, creds)
+	return creds, nil
+}
+
+// usableStale checks if the cached credentials can be served when they can not be
+// refreshed: they were obtained for the role and have not expired yet.
+func (c *CredentialsProvider) usableStale(creds Credentials, role ContainerRole) bool {
+	return len(creds.AccessKey) > 0 && creds.RoleArn.Equals(role.RoleArn) && !c.expiresIn(creds, 0)
+}
+
+// graceCredentials returns the cached credentials of a container whose lookup failed,
+// if the lookup started to fail less than the exit grace period ago and the credentials
+// have not expired.
+func (c *CredentialsProvider) graceCredentials(containerIP string, lookupErr error, fields logFields) (ContainerCredentials, bool) {
+	if c.exitGracePeriod <= 0 {
+		return ContainerCredentials{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.cache.Peek(containerIP)
+
+	if !found || !c.inGracePeriod(containerIP, time.Now()) || len(entry.AccessKey) == 0 || c.expiresIn(entry.Credentials, 0) {
+		return ContainerCredentials{}, false
+	}
+
+	log.Warnf("Serving cached credentials of container %s during the exit grace period, the container lookup failed: %s", entry.ContainerInfo.ID, lookupErr)
+	credentialsServedGrace.Inc()
+	c.audit.Grace(containerIP, entry.ContainerInfo, entry.Credentials)
+	fields["container_id"] = entry.ContainerInfo.ID
+	fields["cache"] = "grace"
+	return entry, true
+}
+
+// inGracePeriod records when the lookup of the container IP first failed and checks if
+// that was less than the exit grace period ago. Must be called with the lock.
+func (c *CredentialsProvider) inGracePeriod(containerIP string, now time.Time) bool {
+	since, found := c.lookupFailedSince[containerIP]
+
+	if !found {
+		since = now
+		c.lookupFailedSince[containerIP] = since
+	}
+
+	return now.Sub(since) < c.exitGracePeriod
+}
+
+// cachedCredentials looks up the container and its cached credentials. If the
+// credentials have to be assumed, found is false and the entry and role are resolved.
+func (c *CredentialsProvider) cachedCredentials(ctx context.Context, containerIP string, fields logFields, trace *span) (entry ContainerCredentials, role ContainerRole, found bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return ContainerCredentials{}, ContainerRole{}, false, err
+	}
+
+	lookup := trace.Child("ContainerForIP")
+	lookup.SetAttribute("platform", c.container.TypeName())
+	container, err := c.containerForIP(containerIP)
+	lookup.SetError(err)
+	lookup.End()
+
+	if err != nil {
+		if entry, found := c.graceCredentials(containerIP, err, fields); found {
+			return entry, ContainerRole{}, true, nil
+		}
+
+		return ContainerCredentials{}, ContainerRole{}, false, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.lookupFailedSince, containerIP)
+	fields["container_id"] = container.ID
+
+	if !c.roleAllowed(containerIP, container) {
+		c.audit.Denied(containerIP, container)
+		return ContainerCredentials{}, ContainerRole{}, false, RoleNotAllowedError{container.ID, container.IamRole}
+	}
+
+	entry, found = c.cache.Get(containerIP)
+	sessionName := entry.sessionName
+
+	if found && !entry.IsValid(container, c.maxEntryAge) {
+		if entry.ContainerInfo.ID != container.ID {
+			// The IP was reused by another container. Never serve it the credentials
+			// obtained for the previous container.
+			log.Info("Container IP ", containerIP, " reassigned from ", entry.ContainerInfo.ID, " to ", container.ID)
+			sessionName = ""
+		} else if entry.IsValid(container, 0) {
+			log.Debug("Resolving container ", container.ID, " again, its cache entry is older than ", c.maxEntryAge)
+		}
+
+		c.deleteEntry(containerIP, entry)
+		found = false
+	}
+
+	if !found {
+		entry = ContainerCredentials{ContainerInfo: container, sessionName: sessionName, createdAt: time.Now()}
+	}
+
+	if len(entry.sessionName) == 0 {
+		entry.sessionName = generateSessionName(c.sessionNamePrefix, c.sessionName, c.container.TypeName(), containerIP, container)
+	}
+
+	fields["cache"] = "hit"
+
+	if c.expiresIn(entry.Credentials, c.RefreshThreshold()) {
+		role = c.resolveRole(containerIP, container)
+
+		if role.RoleArn.Empty() {
+			return ContainerCredentials{}, ContainerRole{}, false, NoRoleForContainerError{container.ID}
+		}
+
+		entry.sharedKey = sharedKey(container, role, entry.sessionName)
+		shared, found := c.lookupShared(entry.sharedKey, c.RefreshThreshold())
+
+		if !found {
+			return entry, role, false, nil
+		}
+
+		credentialCacheHits.Inc()
+		c.audit.CacheHit(containerIP, container, shared)
+		entry.Credentials = shared
+	} else {
+		credentialCacheHits.Inc()
+		c.audit.CacheHit(containerIP, container, entry.Credentials)
+	}
+
+	c.storeEntry(containerIP, entry)
+	return entry, role, true, nil
+}
+
+// deleteEntry removes the cached entry of the IP, and the shared credentials of the
+// entry unless other containers still use them. Must be called with the lock.
+func (c *CredentialsProvider) deleteEntry(containerIP string, entry ContainerCredentials) {
+	c.cache.Delete(containerIP)
+	referenced := false
+
+	c.cache.Each(func(otherIP string, other ContainerCredentials) {
+		referenced = referenced || other.sharedKey == entry.sharedKey
+	})
+
+	if !referenced {
+		delete(c.sharedCredentials, entry.sharedKey)
+	}
+}
+
+// storeEntry caches the entry of the IP and schedules the refresh of its credentials.
+// Must be called with the lock.
+func (c *CredentialsProvider) storeEntry(containerIP string, entry ContainerCredentials) {
+	c.cache.Set(containerIP, entry)
+	c.schedule.Schedule(containerIP, c.scheduledExpiration(entry.Credentials))
+}
+
+// assumeShared assumes the role of the shared credentials key. Concurrent calls for
+// the same key wait for the first call instead of calling STS again. The STS call is
+// only canceled when the contexts of all the calls waiting for it are done.
+func (c *CredentialsProvider) assumeShared(ctx context.Context, key, containerIP string, container ContainerInfo, role ContainerRole, sessionName string, threshold time.Duration) (Credentials, error) {
+	creds, err, coalesced := c.assuming.Do(ctx, key, func(ctx context.Context) (Credentials, error) {
+		// another call may have stored the credentials after the caller checked
+		c.lock.Lock()
+		shared, found := c.lookupShared(key, threshold)
+		c.lock.Unlock()
+
+		if found {
+			return shared, nil
+		}
+
+		creds, err := c.assumeContainerRole(ctx, container, role, sessionName)
+
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		c.audit.Grant(containerIP, container, creds)
+
+		c.lock.Lock()
+		c.sharedCredentials[key] = creds
+		c.lock.Unlock()
+
+		return creds, nil
+	})
+
+	if coalesced && err == nil {
+		c.audit.CacheHit(containerIP, container, creds)
+	}
+
+	return creds, err
+}
+
+// ContainerRole is the role, and the parameters to assume it with, resolved for a container.
+type ContainerRole struct {
+	RoleArn    RoleArn
+	Policy     string
+	PolicyArns []string
+	ExternalID string
+
+	// SessionDuration overrides the default session duration: the duration of the
+	// container, or else of its image mapping.
+	SessionDuration time.Duration
+}
+
+// ContainerIDForIP returns the ID of the container whose credentials are cached for the IP.
+// Looks up the container if the cache is disabled.
+func (c *CredentialsProvider) ContainerIDForIP(containerIP string) (string, bool) {
+	if c.disableCache {
+		container, err := c.containerForIP(containerIP)
+		return container.ID, err == nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.cache.Peek(containerIP)
+	return entry.ContainerInfo.ID, found
+}
+
+// containerForIP looks up the container, remembering failures for the negative
+// cache TTL so that repeated requests from unknown IPs do not hit the container service.
+// The container service is called without the lock.
+func (c *CredentialsProvider) containerForIP(containerIP string) (ContainerInfo, error) {
+	now := time.Now()
+
+	c.lock.Lock()
+	failed, found := c.failedLookups[containerIP]
+	c.lock.Unlock()
+
+	if found && now.Before(failed.expires) {
+		return ContainerInfo{}, failed.err
+	}
+
+	container, err := c.container.ContainerForIP(containerIP)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		if c.negativeCacheTTL > 0 {
+			c.failedLookups[containerIP] = failedLookup{err, now.Add(c.negativeCacheTTL)}
+		}
+
+		return ContainerInfo{}, err
+	}
+
+	delete(c.failedLookups, containerIP)
+	return container, nil
+}
+
+// resolveRole returns the role and policy for the container. Containers that do not
+// specify a role use the role mapped to their image, then the role mapped to the
+// subnet of their IP, falling back to the defaults. The policy of the container always
+// scopes the resolved role, including the default role, and takes precedence over the
+// policy of the mapping or the default policy, which only apply to containers without
+// a policy.
+func (c *CredentialsProvider) resolveRole(containerIP string, container ContainerInfo) ContainerRole {
+	role := ContainerRole{
+		RoleArn:         container.IamRole,
+		Policy:          container.IamPolicy,
+		PolicyArns:      container.IamPolicyArns,
+		ExternalID:      container.IamExternalID,
+		SessionDuration: container.SessionDuration,
+	}
+
+	mapping, imageFound := c.imageRoles.RoleForImage(container.Image)
+
+	// the session duration of the image applies to containers with their own role too
+	if role.SessionDuration == 0 && imageFound {
+		role.SessionDuration = time.Duration(mapping.SessionDuration)
+	}
+
+	if !role.RoleArn.Empty() {
+		return role
+	}
+
+	if imageFound {
+		role.RoleArn = mapping.Role
+		role.ExternalID = mapping.ExternalID
+
+		if len(role.Policy) == 0 {
+			role.Policy = mapping.Policy
+		}
+	} else if mapping, found := c.networkRoles.RoleForIP(containerIP); found {
+		role.RoleArn = mapping.Role
+		role.ExternalID = mapping.ExternalID
+
+		if len(role.Policy) == 0 {
+			role.Policy = mapping.Policy
+		}
+	} else {
+		role.RoleArn = c.defaultIamRoleArn
+		role.ExternalID = c.defaultIamExternalID
+
+		if len(role.Policy) == 0 {
+			role.Policy = c.defaultIamPolicy
+		}
+	}
+
+	return role
+}
+
+// roleAllowed checks the role the container requests against the allowlists of
+// the mappings of its image and network. The roles of the mappings and the default
+// role are always allowed.
+func (c *CredentialsProvider) roleAllowed(containerIP string, container ContainerInfo) bool {
+	if container.IamRole.Empty() {
+		return true
+	}
+
+	if mapping, found := c.imageRoles.RoleForImage(container.Image); found && !mapping.AllowedRoles.Allows(container.IamRole) {
+		return false
+	}
+
+	if mapping, found := c.networkRoles.RoleForIP(containerIP); found && !mapping.AllowedRoles.Allows(container.IamRole) {
+		return false
+	}
+
+	return true
+}
+
+// Reconfigure replaces the default role settings, the image and network to role
+// mappings and the static credentials. Cached credentials are kept and pick up the new settings when they are
+// refreshed.
+func (c *CredentialsProvider) Reconfigure(defaults RoleDefaults, imageRoles ImageRoleTable, networkRoles NetworkRoleTable, staticCreds StaticCredentialsTable) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.defaultIamRoleArn.Equals(defaults.RoleArn) {
+		log.Infof("Default IAM role changed: %q -> %q", c.defaultIamRoleArn, defaults.RoleArn)
+	}
+
+	if c.defaultIamPolicy != defaults.Policy {
+		log.Info("Default IAM policy changed")
+	}
+
+	if c.defaultIamExternalID != defaults.ExternalID {
+		log.Info("Default IAM external ID changed")
+	}
+
+	log.Infof("Image role mappings: %d -> %d", len(c.imageRoles), len(imageRoles))
+	log.Infof("Network role mappings: %d -> %d", len(c.networkRoles), len(networkRoles))
+	log.Infof("Static credentials mappings: %d -> %d", len(c.staticCreds), len(staticCreds))
+
+	c.defaultIamRoleArn = defaults.RoleArn
+	c.defaultIamPolicy = defaults.Policy
+	c.defaultIamExternalID = defaults.ExternalID
+	c.imageRoles = imageRoles
+	c.networkRoles = networkRoles
+	c.staticCreds = staticCreds
+}
+
+// sharedKey identifies the credentials a container can share with other containers
+// that resolve to the same role and policy and render the same session name, so every
+// session is attributed to its container in CloudTrail. Credentials obtained with a web
+// identity token are never shared since the token identifies the container.
+func sharedKey(container ContainerInfo, role ContainerRole, sessionName string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%d\x00%s\x00%s", role.RoleArn, role.Policy, strings.Join(role.PolicyArns, ","), role.ExternalID, role.SessionDuration, container.SessionTags, sessionName)
+
+	if len(container.WebIdentityTokenFile) > 0 {
+		fmt.Fprintf(hash, "\x00%s\x00%s", container.ID, container.WebIdentityTokenFile)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// expiresIn checks if the credentials expire within d, accounting for the measured
+// clock skew and the safety margin. The threshold is scaled down for credentials with
+// shorter sessions, see thresholdFor.
+func (c *CredentialsProvider) expiresIn(creds Credentials, d time.Duration) bool {
+	return creds.ExpiresInWithSkew(c.thresholdFor(creds, d)+c.clockSkewMargin, c.ClockSkew())
+}
+
+// thresholdFor scales the refresh threshold down for credentials whose session is
+// shorter than the session duration, like sessions capped by the maximum session
+// duration of the role, so they are not refreshed on every request. The scaled
+// threshold is at least the minimum lifetime, unless that is more than half of the
+// session.
+func (c *CredentialsProvider) thresholdFor(creds Credentials, threshold time.Duration) time.Duration {
+	lifetime := creds.Expiration.Sub(creds.GeneratedAt)
+
+	if creds.GeneratedAt.IsZero() || lifetime <= 0 || lifetime >= c.sessionDuration {
+		return threshold
+	}
+
+	scaled := time.Duration(float64(threshold) * float64(lifetime) / float64(c.sessionDuration))
+
+	if scaled < c.minLifetime {
+		scaled = c.minLifetime
+	}
+
+	if scaled > lifetime/2 {
+		scaled = lifetime / 2
+	}
+
+	return scaled
+}
+
+// scheduledExpiration is the expiration the refresh of the credentials is scheduled
+// for. Credentials with shorter sessions are scheduled as if they expired later, so
+// they are refreshed at their scaled threshold.
+func (c *CredentialsProvider) scheduledExpiration(creds Credentials) time.Time {
+	threshold := c.BackgroundRefreshThreshold()
+	return creds.Expiration.Add(threshold - c.thresholdFor(creds, threshold))
+}
+
+// checkNearExpiry warns about credentials that are served although they expire within
+// the refresh threshold, which happens when the role limits the session duration to
+// less than the configured duration.
+func (c *CredentialsProvider) checkNearExpiry(containerIP string, creds Credentials) {
+	if !creds.ExpiresInWithSkew(c.RefreshThreshold()+c.clockSkewMargin, c.ClockSkew()) {
+		return
+	}
+
+	credentialsNearExpiry.Inc()
+	log.Warnf("Served credentials of role %s to %s that expire in %s (session duration %s), check the maximum session duration of the role",
+		creds.RoleArn, containerIP, creds.Expiration.Sub(time.Now()).Truncate(time.Second), creds.Expiration.Sub(creds.GeneratedAt))
+}
+
+// ClockSkew is how far the STS clock was ahead of the local clock when credentials
+// were last obtained. Negative if the local clock is ahead.
+func (c *CredentialsProvider) ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.clockSkew))
+}
+
+// observeSession measures the clock skew from the expiration of credentials that were
+// requested between start and end. Sessions that are much shorter than requested are
+// capped by the role instead, and recorded to request the shorter duration next time.
+func (c *CredentialsProvider) observeSession(in AssumeRoleInput, expiration, start, end time.Time) {
+	local := start.Add(end.Sub(start) / 2)
+
+	if lifetime := expiration.Sub(local.Add(c.ClockSkew())); in.Duration-lifetime > shortSessionTolerance {
+		c.roleSessions.Observe(in.RoleArn, in.Duration, lifetime)
+		return
+	}
+
+	skew := expiration.Add(-in.Duration).Sub(local)
+
+	if previous := c.ClockSkew(); skew-previous > time.Second || previous-skew > time.Second {
+		log.Info("Clock skew with STS: ", skew)
+	}
+
+	atomic.StoreInt64(&c.clockSkew, int64(skew))
+}
+
+// lookupShared returns the shared credentials for the key if they do not expire
+// within the threshold.
+func (c *CredentialsProvider) lookupShared(key string, threshold time.Duration) (Credentials, bool) {
+	role, found := c.sharedCredentials[key]
+	return role, found && !c.expiresIn(role, threshold)
+}
+
+// assumeContainerRole assumes the role resolved for the container.
+func (c *CredentialsProvider) assumeContainerRole(ctx context.Context, container ContainerInfo, role ContainerRole, sessionName string) (Credentials, error) {
+	if err := validatePolicyJSON(role.Policy); err != nil {
+		return Credentials{}, InvalidPolicyError{container.ID, err}
+	}
+
+	policy, err := c.guardrail.Apply(role.Policy)
+
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Error applying guardrail policy for container %s: %s", container.ID, err)
+	}
+
+	if size := utf8.RuneCountInString(policy); size > maxPolicySize {
+		return Credentials{}, PolicyTooLargeError{container.ID, size}
+	}
+
+	in := AssumeRoleInput{
+		RoleArn:     role.RoleArn,
+		Policy:      policy,
+		PolicyArns:  role.PolicyArns,
+		SessionName: sessionName,
+		Duration:    c.sessionDurationFor(container, role),
+	}
+
+	if len(container.WebIdentityTokenFile) > 0 {
+		token, err := ioutil.ReadFile(container.WebIdentityTokenFile)
+
+		if err != nil {
+			return Credentials{}, fmt.Errorf("Error reading web identity token for container %s: %s", container.ID, err)
+		}
+
+		return c.assumeRoleWithWebIdentity(ctx, in, strings.TrimSpace(string(token)))
+	}
+
+	in.ExternalID = role.ExternalID
+	in.Tags = container.SessionTags
+	return c.AssumeRole(ctx, in)
+}
+
+// sessionDurationFor returns the session duration override of the role, limited to the
+// STS range, or the default session duration.
+func (c *CredentialsProvider) sessionDurationFor(container ContainerInfo, role ContainerRole) time.Duration {
+	duration := c.sessionDuration
+
+	if role.SessionDuration != 0 {
+		duration = clampSessionDuration(role.SessionDuration)
+
+		if duration > c.maxSessionDuration {
+			duration = c.maxSessionDuration
+		}
+	}
+
+	log.Debugf("Session duration of container %s: %s", container.ID, duration)
+	return duration
+}
+
+// ValidateSessionDuration checks that STS accepts the session duration.
+func ValidateSessionDuration(d time.Duration) error {
+	if d < minSessionDuration || d > maxSessionDuration {
+		return fmt.Errorf("Session duration %s is not between %s and %s", d, minSessionDuration, maxSessionDuration)
+	}
+
+	return nil
+}
+
+// Invalidate removes the cached credentials of the containers that match, including
+// the credentials they share with other containers, which are removed from those
+// containers as well. Returns the number of containers whose credentials were removed.
+func (c *CredentialsProvider) Invalidate(match func(containerIP string, entry ContainerCredentials) bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	matched := make(map[string]bool)
+	shared := make(map[string]bool)
+
+	c.cache.Each(func(containerIP string, entry ContainerCredentials) {
+		if match(containerIP, entry) {
+			matched[containerIP] = true
+
+			if len(entry.sharedKey) > 0 {
+				shared[entry.sharedKey] = true
+			}
+		}
+	})
+
+	count := 0
+
+	c.cache.Each(func(containerIP string, entry ContainerCredentials) {
+		if matched[containerIP] || shared[entry.sharedKey] {
+			c.cache.Delete(containerIP)
+			c.schedule.Unschedule(containerIP)
+			count++
+		}
+	})
+
+	for key := range shared {
+		delete(c.sharedCredentials, key)
+	}
+
+	return count
+}
+
+// CachedEntry describes the cached credentials of a container IP, without the secrets.
+type CachedEntry struct {
+	ContainerIP string    `json:"container_ip"`
+	ContainerID string    `json:"container_id"`
+	Name        string    `json:"name"`
+	Image       string    `json:"image"`
+	RoleArn     string    `json:"role_arn"`
+	SessionName string    `json:"session_name"`
+	AccessKey   string    `json:"access_key"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Expiration  time.Time `json:"expiration"`
+	RefreshIn   int64     `json:"refresh_in_seconds"`
+}
+
+// CachedEntries lists the cached credentials of all container IPs. RefreshIn is the
+// number of seconds until the background refresh renews the credentials.
+func (c *CredentialsProvider) CachedEntries() []CachedEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	entries := make([]CachedEntry, 0, c.cache.Len())
+
+	c.cache.Each(func(containerIP string, entry ContainerCredentials) {
+		refreshAt := entry.Expiration.Add(-c.refreshMargin())
+		refreshIn := refreshAt.Sub(now)
+
+		if refreshIn < 0 {
+			refreshIn = 0
+		}
+
+		entries = append(entries, CachedEntry{
+			ContainerIP: containerIP,
+			ContainerID: entry.ContainerInfo.ID,
+			Name:        entry.ContainerInfo.Name,
+			Image:       entry.ContainerInfo.Image,
+			RoleArn:     entry.Credentials.RoleArn.String(),
+			SessionName: entry.SessionName,
+			AccessKey:   maskAccessKey(entry.AccessKey),
+			GeneratedAt: entry.GeneratedAt,
+			Expiration:  entry.Expiration,
+			RefreshIn:   int64(refreshIn / time.Second),
+		})
+	})
+
+	sort.Sort(cachedEntriesByIP(entries))
+	return entries
+}
+
+type cachedEntriesByIP []CachedEntry
+
+func (e cachedEntriesByIP) Len() int           { return len(e) }
+func (e cachedEntriesByIP) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e cachedEntriesByIP) Less(i, j int) bool { return e[i].ContainerIP < e[j].ContainerIP }
+
+// maskAccessKey keeps the first 4 and last 4 characters of an access key ID, which
+// are enough to match it with CloudTrail entries.
+func maskAccessKey(accessKey string) string {
+	if len(accessKey) <= 8 {
+		return strings.Repeat("*", len(accessKey))
+	}
+
+	return accessKey[:4] + strings.Repeat("*", len(accessKey)-8) + accessKey[len(accessKey)-4:]
+}
+
+// StartRefresh starts a background goroutine that refreshes cached credentials
+// before they expire so that CredentialsForIP rarely has to wait on STS. The
+// credentials are refreshed when they reach the background refresh threshold, from
+// a schedule of their expirations. Every interval, all cached credentials are
+// checked as well, to retry refreshes that failed. Every purgeInterval, it also
+// removes the credentials of containers that no longer exist, so they are not
+// refreshed. Purging is disabled if purgeInterval is zero. All run on the same
+// goroutine so they never work on the same entries at once.
+func (c *CredentialsProvider) StartRefresh(interval, purgeInterval time.Duration) {
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+
+	go func() {
+		defer close(c.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		timer := time.NewTimer(c.nextRefresh())
+		defer timer.Stop()
+
+		var purge <-chan time.Time
+
+		if purgeInterval > 0 {
+			purgeTicker := time.NewTicker(purgeInterval)
+			defer purgeTicker.Stop()
+			purge = purgeTicker.C
+		}
+
+		var probe <-chan time.Time
+
+		if c.stsProbeInterval > 0 && len(c.stsClients) > 1 {
+			c.probeStsLatency()
+			probeTicker := time.NewTicker(c.stsProbeInterval)
+			defer probeTicker.Stop()
+			probe = probeTicker.C
+		}
+
+		for {
+			select {
+			case <-timer.C:
+				c.refreshDue()
+			case <-c.schedule.wake:
+			case <-ticker.C:
+				c.refreshExpiring()
+			case <-purge:
+				c.purgeStale()
+			case <-probe:
+				c.probeStsLatency()
+			case <-c.stop:
+				return
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+			timer.Reset(c.nextRefresh())
+		}
+	}()
+}
+
+// refreshMargin is the remaining lifetime at which scheduled credentials are
+// refreshed: the background refresh threshold, corrected for clock skew.
+func (c *CredentialsProvider) refreshMargin() time.Duration {
+	return c.BackgroundRefreshThreshold() + c.clockSkewMargin + c.ClockSkew()
+}
+
+// nextRefresh returns the time until the next scheduled refresh.
+func (c *CredentialsProvider) nextRefresh() time.Duration {
+	c.lock.Lock()
+	expiration, found := c.schedule.Next()
+	c.lock.Unlock()
+
+	if !found {
+		// woken up by the schedule when credentials are cached
+		return time.Hour
+	}
+
+	if wait := expiration.Add(-c.refreshMargin()).Sub(time.Now()); wait > 0 {
+		return wait
+	}
+
+	return 0
+}
+
+// refreshDue refreshes the credentials whose scheduled refresh is due.
+func (c *CredentialsProvider) refreshDue() {
+	c.lock.Lock()
+	due := make(map[string]ContainerCredentials)
+
+	for _, containerIP := range c.schedule.PopDue(time.Now().Add(c.refreshMargin())) {
+		if entry, found := c.cache.Peek(containerIP); found {
+			due[containerIP] = entry
+		}
+	}
+
+	c.lock.Unlock()
+
+	c.refreshEntries(due, c.BackgroundRefreshThreshold())
+}
+
+// purgeStale removes the cached credentials of container IPs that no longer map to
+// the container the credentials were obtained for. Nothing is removed while the
+// container service is unavailable. Returns the number of entries removed.
+func (c *CredentialsProvider) purgeStale() int {
+	if err := c.container.Ping(); err != nil {
+		log.Warn("Skipping purge of cached credentials, container service unavailable: ", err)
+		return 0
+	}
+
+	c.lock.Lock()
+	cached := make(map[string]string)
+
+	c.cache.Each(func(containerIP string, entry ContainerCredentials) {
+		cached[containerIP] = entry.ContainerInfo.ID
+	})
+
+	c.lock.Unlock()
+
+	count := 0
+
+	for containerIP, containerID := range cached {
+		// The container service is called without the lock, like for requests
+		container, err := c.container.ContainerForIP(containerIP)
+
+		if err == nil && container.ID == containerID {
+			continue
+		}
+
+		c.lock.Lock()
+
+		if err != nil && c.exitGracePeriod > 0 && c.inGracePeriod(containerIP, time.Now()) {
+			c.lock.Unlock()
+			continue
+		}
+
+		// A request may have replaced the entry with one for a new container
+		if current, found := c.cache.Peek(containerIP); found && current.ContainerInfo.ID == containerID {
+			c.deleteEntry(containerIP, current)
+			count++
+		}
+
+		c.lock.Unlock()
+	}
+
+	if count > 0 {
+		log.Info("Purged cached credentials of ", count, " containers that no longer exist")
+	} else {
+		log.Debug("Purged cached credentials of 0 containers that no longer exist")
+	}
+
+	return count
+}
+
+// Stop stops the background refresh goroutine and waits for it to exit.
+func (c *CredentialsProvider) Stop() {
+	if c.stop == nil {
+		return
+	}
+
+	close(c.stop)
+	<-c.stopped
+	c.stop = nil
+}
+
+// refreshExpiring refreshes all cached credentials that reached the background
+// refresh threshold and drops the shared credentials and failed lookups that are
+// no longer needed.
+func (c *CredentialsProvider) refreshExpiring() {
+	threshold := c.BackgroundRefreshThreshold()
+
+	c.lock.Lock()
+	expiring := make(map[string]ContainerCredentials)
+	referenced := make(map[string]bool)
+
+	c.cache.Each(func(containerIP string, entry ContainerCredentials) {
+		referenced[entry.sharedKey] = true
+
+		if c.expiresIn(entry.Credentials, threshold) {
+			expiring[containerIP] = entry
+		}
+	})
+
+	// Drop shared credentials that are no longer used by any container
+	for key := range c.sharedCredentials {
+		if !referenced[key] {
+			delete(c.sharedCredentials, key)
+		}
+	}
+
+	now := time.Now()
+
+	for containerIP, failed := range c.failedLookups {
+		if !now.Before(failed.expires) {
+			delete(c.failedLookups, containerIP)
+		}
+	}
+
+	for containerIP, since := range c.lookupFailedSince {
+		if now.Sub(since) >= c.exitGracePeriod {
+			delete(c.lookupFailedSince, containerIP)
+		}
+	}
+
+	c.lock.Unlock()
+
+	c.refreshEntries(expiring, threshold)
+}
+
+// refreshEntries refreshes the credentials of the entries, unless other containers
+// already refreshed the credentials they share.
+func (c *CredentialsProvider) refreshEntries(expiring map[string]ContainerCredentials, threshold time.Duration) {
+	for containerIP, entry := range expiring {
+		// The role is resolved again in case the configuration changed
+		c.lock.Lock()
+
+		if !c.roleAllowed(containerIP, entry.ContainerInfo) {
+			log.Warn("Not refreshing credentials for container ", entry.ContainerInfo.ID, ": role ", entry.ContainerInfo.IamRole, " is no longer allowed")
+			c.deleteEntry(containerIP, entry)
+			c.lock.Unlock()
+			continue
+		}
+
+		role := c.resolveRole(containerIP, entry.ContainerInfo)
+		key := sharedKey(entry.ContainerInfo, role, entry.sessionName)
+		refreshed, found := c.lookupShared(key, threshold)
+		c.lock.Unlock()
+
+		if !found {
+			log.Debug("Refreshing credentials for container: ", entry.ContainerInfo.ID)
+			var err error
+			refreshed, err = c.assumeShared(context.Background(), key, containerIP, entry.ContainerInfo, role, entry.sessionName, threshold)
+
+			if err != nil {
+				log.Warn("Error refreshing credentials for container: ", entry.ContainerInfo.ID, ": ", err)
+				continue
+			}
+		}
+
+		c.lock.Lock()
+
+		// Only replace the entry if the IP was not reassigned while refreshing
+		if current, found := c.cache.Peek(containerIP); found && current.ContainerInfo.ID == entry.ContainerInfo.ID {
+			current.Credentials = refreshed
+			current.sharedKey = key
+			c.cache.Replace(containerIP, current)
+			c.schedule.Schedule(containerIP, c.scheduledExpiration(refreshed))
+		}
+
+		c.lock.Unlock()
+	}
+}
+
+// AssumeRoleInput are the parameters of AssumeRole.
+type AssumeRoleInput struct {
+	RoleArn RoleArn
+
+	// Policy is the session policy JSON and PolicyArns are the ARNs of the managed
+	// session policies. Optional.
+	Policy     string
+	PolicyArns []string
+
+	SessionName string
+
+	// Duration is the requested session duration. It is lowered for roles whose
+	// sessions were capped before.
+	Duration time.Duration
+
+	// ExternalID and Tags are only supported by AssumeRole, not by web identities.
+	ExternalID string
+	Tags       SessionTags
+}
+
+// extraParams adds the parameters of the input that the vendored SDK does not know.
+func (in AssumeRoleInput) extraParams() stsParams {
+	return func(values url.Values) {
+		in.Tags.addParams(values)
+
+		for i, arn := range in.PolicyArns {
+			values.Set(fmt.Sprintf("PolicyArns.member.%d.arn", i+1), arn)
+		}
+	}
+}
+
+func (in AssumeRoleInput) hasExtraParams() bool {
+	return !in.Tags.Empty() || len(in.PolicyArns) > 0
+}
+
+// stsClientsFor returns the STS clients that assume the role: the endpoint of the
+// role, if it matches an override, signed with the base credentials of the account of
+// the role, if configured, or the default clients.
+func (c *CredentialsProvider) stsClientsFor(role RoleArn) []stsAPI {
+	if override, found := c.stsEndpoints.EndpointForRole(role); found && c.newEndpointSts != nil {
+		return c.endpointClients(override, role.AccountID())
+	}
+
+	if clients, found := c.accountSts[role.AccountID()]; found {
+		return clients
+	}
+
+	return c.stsClients
+}
+
+// endpointClients returns the client of the endpoint override, creating it on first
+// use. Accounts with their own base credentials get their own client.
+func (c *CredentialsProvider) endpointClients(override StsEndpointOverride, accountID string) []stsAPI {
+	if _, found := c.accountSts[accountID]; !found {
+		accountID = ""
+	}
+
+	key := override.Endpoint + " " + override.Region + " " + accountID
+
+	c.endpointStsLock.Lock()
+	defer c.endpointStsLock.Unlock()
+
+	clients, found := c.endpointSts[key]
+
+	if !found {
+		log.Infof("Assuming roles matching %s through STS endpoint %s", override.Role, override.Endpoint)
+		clients = []stsAPI{c.newEndpointSts(override, accountID)}
+		c.endpointSts[key] = clients
+	}
+
+	return clients
+}
+
+// withFailover calls fn with the client of each STS endpoint in order until one of
+// them can be reached. Errors returned by STS do not fail over.
+func (c *CredentialsProvider) withFailover(ctx context.Context, clients []stsAPI, fn func(client stsAPI) error) error {
+	if err := c.stsLimit.Acquire(ctx); err != nil {
+		return err
+	}
+
+	defer c.stsLimit.Release()
+
+	var err error
+	clients = c.stsOrder(clients)
+
+	for i, client := range clients {
+		if err = fn(client); err == nil {
+			if len(clients) > 1 {
+				log.Info("STS call served by ", client.Endpoint())
+			}
+
+			return nil
+		}
+
+		if !IsConnectionError(err) {
+			return err
+		}
+
+		if i+1 < len(clients) {
+			log.Warn("Error reaching STS endpoint ", client.Endpoint(), ", failing over to ", clients[i+1].Endpoint(), ": ", err)
+		}
+	}
+
+	return err
+}
+
+// AssumeRole assumes the role for the duration. A duration above the maximum session
+// duration of the role falls back to the default session duration.
+func (c *CredentialsProvider) AssumeRole(ctx context.Context, in AssumeRoleInput) (Credentials, error) {
+	var policy, externalID *string
+
+	if len(in.Policy) > 0 {
+		policy = aws.String(in.Policy)
+	}
+
+	if len(in.ExternalID) > 0 {
+		externalID = aws.String(in.ExternalID)
+	}
+
+	var params stsParams
+
+	if in.hasExtraParams() {
+		params = in.extraParams()
+	}
+
+	return c.assume(ctx, in, func(client stsAPI, duration time.Duration) (*sts.Credentials, *sts.AssumedRoleUser, error) {
+		resp, err := client.AssumeRole(ctx, &sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(int64(duration / time.Second)),
+			ExternalId:      externalID,
+			Policy:          policy,
+			RoleArn:         aws.String(in.RoleArn.String()),
+			RoleSessionName: aws.String(in.SessionName),
+		}, params)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return resp.Credentials, resp.AssumedRoleUser, nil
+	})
+}
+
+// AssumeRoleWithWebIdentity assumes the role with the OIDC token of a workload for the
+// default session duration.
+func (c *CredentialsProvider) AssumeRoleWithWebIdentity(ctx context.Context, roleArn RoleArn, token, sessionName string) (Credentials, error) {
+	return c.assumeRoleWithWebIdentity(ctx, AssumeRoleInput{
+		RoleArn:     roleArn,
+		SessionName: sessionName,
+		Duration:    c.sessionDuration,
+	}, token)
+}
+
+func (c *CredentialsProvider) assumeRoleWithWebIdentity(ctx context.Context, in AssumeRoleInput, token string) (Credentials, error) {
+	var policy *string
+
+	if len(in.Policy) > 0 {
+		policy = aws.String(in.Policy)
+	}
+
+	var params stsParams
+
+	if len(in.PolicyArns) > 0 {
+		params = in.extraParams()
+	}
+
+	return c.assume(ctx, in, func(client stsAPI, duration time.Duration) (*sts.Credentials, *sts.AssumedRoleUser, error) {
+		resp, err := client.AssumeRoleWithWebIdentity(ctx, &sts.AssumeRoleWithWebIdentityInput{
+			DurationSeconds:  aws.Int64(int64(duration / time.Second)),
+			Policy:           policy,
+			RoleArn:          aws.String(in.RoleArn.String()),
+			RoleSessionName:  aws.String(in.SessionName),
+			WebIdentityToken: aws.String(token),
+		}, params)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return resp.Credentials, resp.AssumedRoleUser, nil
+	})
+}
+
+// stsCall calls STS through the client for a session of the duration.
+type stsCall func(client stsAPI, duration time.Duration) (*sts.Credentials, *sts.AssumedRoleUser, error)
+
+// assume assumes the role of the input with the STS call, failing over between the STS
+// clients of the role and retrying throttled calls. A duration above the maximum session
+// duration of the role is retried once with the default session duration.
+func (c *CredentialsProvider) assume(ctx context.Context, in AssumeRoleInput, call stsCall) (Credentials, error) {
+	in.Duration = c.roleSessions.Duration(in.RoleArn, in.Duration)
+
+	defer assumeRoleDuration.ObserveSince(time.Now())
+	assumeRoleCalls.Inc()
+
+	for {
+		var stsCredentials *sts.Credentials
+		var user *sts.AssumedRoleUser
+
+		start := time.Now()
+		err := c.withFailover(ctx, c.stsClientsFor(in.RoleArn), func(client stsAPI) error {
+			return c.retry.Do(ctx, func() (err error) {
+				stsCredentials, user, err = call(client, in.Duration)
+				return err
+			})
+		})
+
+		if isMaxSessionDurationError(err) && in.Duration > c.sessionDuration {
+			log.Warn("Session duration ", in.Duration, " exceeds the maximum session duration of role ", in.RoleArn, ", using ", c.sessionDuration)
+			in.Duration = c.sessionDuration
+			continue
+		}
+
+		if err != nil {
+			assumeRoleErrors.Inc(errorCode(err))
+
+			if isMaxSessionDurationError(err) {
+				return Credentials{}, fmt.Errorf("Session duration %s exceeds the maximum session duration of role %s", in.Duration, in.RoleArn)
+			}
+
+			return Credentials{}, err
+		}
+
+		c.observeSession(in, *stsCredentials.Expiration, start, time.Now())
+		return newCredentials(stsCredentials, user, in.RoleArn, in.SessionName), nil
+	}
+}
+
+func newCredentials(stsCredentials *sts.Credentials, user *sts.AssumedRoleUser, role RoleArn, sessionName string) Credentials {
+	var roleID string
+
+	// The assumed role ID is the unique ID of the role followed by the session name
+	if user != nil && user.AssumedRoleId != nil {
+		roleID = strings.SplitN(*user.AssumedRoleId, ":", 2)[0]
+	}
+
+	return Credentials{
+		AccessKey:   *stsCredentials.AccessKeyId,
+		SecretKey:   *stsCredentials.SecretAccessKey,
+		Token:       *stsCredentials.SessionToken,
+		Expiration:  *stsCredentials.Expiration,
+		GeneratedAt: time.Now(),
+		RoleArn:     role,
+		RoleID:      roleID,
+		SessionName: sessionName,
+	}
+}
+
+func isMaxSessionDurationError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "ValidationError" && strings.Contains(awsErr.Message(), "MaxSessionDuration")
+	}
+
+	return false
+}
+
+func clampSessionDuration(d time.Duration) time.Duration {
+	if d < minSessionDuration {
+		return minSessionDuration
+	}
+
+	if d > maxSessionDuration {
+		return maxSessionDuration
+	}
+
+	return d
+}
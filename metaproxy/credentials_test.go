@@ -0,0 +1,1160 @@
+package metaproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+// testContainerService counts the lookups of the containers and adds the latency of
+// the container platform.
+type testContainerService struct {
+	*MemoryContainerService
+
+	// delay simulates the latency of the container platform
+	delay   time.Duration
+	lookups int
+	lock    sync.Mutex
+}
+
+func newTestContainerService(containers map[string]ContainerInfo) *testContainerService {
+	return &testContainerService{MemoryContainerService: NewMemoryContainerService("test", containers)}
+}
+
+func (t *testContainerService) ContainerForIP(containerIP string) (ContainerInfo, error) {
+	time.Sleep(t.delay)
+
+	t.lock.Lock()
+	t.lookups++
+	t.lock.Unlock()
+
+	return t.MemoryContainerService.ContainerForIP(containerIP)
+}
+
+// Lookups returns the number of calls to ContainerForIP.
+func (t *testContainerService) Lookups() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.lookups
+}
+
+func newTestProvider(stsServer *ststest.Server, containers ContainerService) *CredentialsProvider {
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+
+	return NewCredentialsProvider(stsServer.Session(), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+	})
+}
+
+func TestCredentialsForIPCacheHit(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	first, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/default", first.RoleArn.String())
+
+	second, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(first.AccessKey, second.AccessKey)
+	assert.Equal(1, stsServer.Calls())
+}
+
+func TestCredentialsForIPMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	deniedRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/denied")
+	stsServer.Deny(deniedRole.String())
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamRole: deniedRole},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	hits := atomic.LoadUint64(&credentialCacheHits.value)
+	misses := atomic.LoadUint64(&credentialCacheMisses.value)
+	denied := counterVecValue(assumeRoleErrors, "AccessDenied")
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(hits, atomic.LoadUint64(&credentialCacheHits.value))
+	assert.Equal(misses+1, atomic.LoadUint64(&credentialCacheMisses.value))
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(hits+1, atomic.LoadUint64(&credentialCacheHits.value))
+	assert.Equal(misses+1, atomic.LoadUint64(&credentialCacheMisses.value))
+	assert.Equal(denied, counterVecValue(assumeRoleErrors, "AccessDenied"))
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.NotNil(err)
+	assert.Equal(denied+1, counterVecValue(assumeRoleErrors, "AccessDenied"))
+}
+
+func counterVecValue(c *counterVec, labelValue string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.values[labelValue]
+}
+
+func TestCredentialsForIPNoRole(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.Reconfigure(RoleDefaults{}, nil, nil, nil)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	noRole, ok := err.(NoRoleForContainerError)
+	assert.True(ok, "%v", err)
+	assert.Equal(NoRoleForContainerError{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}, noRole)
+	assert.Equal(0, stsServer.Calls())
+}
+
+func TestCredentialsForIPReusedByNewContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	old, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	// The first container exits and a new one starts with the same IP and role
+	containers.Set("172.17.0.2", ContainerInfo{ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"})
+
+	fresh, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.NotEqual(old.AccessKey, fresh.AccessKey)
+	assert.Equal(2, stsServer.Calls())
+
+	id, _ := provider.ContainerIDForIP("172.17.0.2")
+	assert.Equal("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", id)
+}
+
+func TestCredentialsForIPReusedKeepsSharedCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	otherRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/other")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.sessionName = "shared-session"
+
+	for _, containerIP := range []string{"172.17.0.2", "172.17.0.3"} {
+		_, err := provider.CredentialsForIP(context.Background(), containerIP)
+		assert.Nil(err)
+	}
+
+	assert.Equal(1, stsServer.Calls())
+	shared, _ := provider.cache.Peek("172.17.0.3")
+
+	// the IP of the first container is reused, the second still uses the credentials
+	containers.Set("172.17.0.2", ContainerInfo{ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", IamRole: otherRole})
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(2, stsServer.Calls())
+	assert.Contains(provider.sharedCredentials, shared.sharedKey)
+
+	// removed with the last container that uses them
+	containers.Set("172.17.0.3", ContainerInfo{ID: "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd", IamRole: otherRole})
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+	assert.NotContains(provider.sharedCredentials, shared.sharedKey)
+}
+
+func TestCredentialsForIPNegativeCache(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{})
+	provider := newTestProvider(stsServer, containers)
+	provider.negativeCacheTTL = 50 * time.Millisecond
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+	_, cached := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Equal(err, cached)
+	assert.Equal(1, containers.Lookups())
+
+	// the container starts, but the failure is remembered until the TTL passes
+	containers.Set("172.17.0.2", ContainerInfo{ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"})
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+	assert.Equal(1, containers.Lookups())
+
+	time.Sleep(provider.negativeCacheTTL)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(2, containers.Lookups())
+	assert.NotContains(provider.failedLookups, "172.17.0.2", "removed by the successful lookup")
+
+	// other IPs are looked up
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.NotNil(err)
+	assert.Equal(3, containers.Lookups())
+}
+
+func TestInvalidateSharedCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	otherRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/other")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", IamRole: otherRole},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.sessionName = "shared-session"
+
+	for _, containerIP := range []string{"172.17.0.2", "172.17.0.3", "172.17.0.4"} {
+		_, err := provider.CredentialsForIP(context.Background(), containerIP)
+		assert.Nil(err)
+	}
+
+	assert.Equal(2, stsServer.Calls())
+	shared, _ := provider.cache.Peek("172.17.0.3")
+
+	// the second container shares the credentials of the first
+	count := provider.Invalidate(func(containerIP string, entry ContainerCredentials) bool {
+		return containerIP == "172.17.0.2"
+	})
+	assert.Equal(2, count)
+	assert.NotContains(provider.sharedCredentials, shared.sharedKey)
+
+	provider.lock.Lock()
+	_, found := provider.cache.Peek("172.17.0.3")
+	assert.False(found)
+	_, found = provider.cache.Peek("172.17.0.4")
+	assert.True(found)
+	assert.NotContains(provider.schedule.scheduled, "172.17.0.2")
+	assert.NotContains(provider.schedule.scheduled, "172.17.0.3")
+	assert.Contains(provider.schedule.scheduled, "172.17.0.4")
+	provider.lock.Unlock()
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+	assert.NotEqual(shared.AccessKey, creds.AccessKey)
+	assert.Equal(3, stsServer.Calls())
+}
+
+func TestCredentialsForIPSharesBySessionName(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"},
+		"172.17.0.5": {ID: "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	// the same role, but the session names identify the containers
+	first, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	second, err := provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+
+	assert.Equal(2, stsServer.Calls())
+	assert.NotEqual(first.AccessKey, second.AccessKey)
+	assert.Equal("test-aaaaaaaaaaaaaaaaaaaaaaaaaaa", first.SessionName)
+	assert.Equal("test-bbbbbbbbbbbbbbbbbbbbbbbbbbb", second.SessionName)
+
+	// a template without container fields renders the same session name
+	provider.sessionName = "shared-session"
+	third, err := provider.CredentialsForIP(context.Background(), "172.17.0.4")
+	assert.Nil(err)
+	fourth, err := provider.CredentialsForIP(context.Background(), "172.17.0.5")
+	assert.Nil(err)
+
+	assert.Equal(3, stsServer.Calls())
+	assert.Equal(third.AccessKey, fourth.AccessKey)
+}
+
+func TestCredentialsForIPSessionDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", SessionDuration: 12 * time.Hour},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", SessionDuration: time.Minute},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("43200", stsServer.LastForm().Get("DurationSeconds"))
+
+	// too short for STS, raised to the minimum and not shared with the first container
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+	assert.Equal("900", stsServer.LastForm().Get("DurationSeconds"))
+	assert.Equal(2, stsServer.Calls())
+}
+
+func TestCredentialsForIPSessionDurationLimitedByRoleMaximum(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", SessionDuration: 12 * time.Hour},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.maxSessionDuration = 2 * time.Hour
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("7200", stsServer.LastForm().Get("DurationSeconds"))
+}
+
+func TestCredentialsForIPMaxSessionDurationFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetMaxSessionDuration(time.Hour)
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", SessionDuration: 12 * time.Hour},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	calls := atomic.LoadUint64(&assumeRoleCalls.value)
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("ASIATEST2", creds.AccessKey)
+
+	forms := stsServer.Forms()
+	assert.Equal(2, len(forms))
+	assert.Equal("43200", forms[0].Get("DurationSeconds"))
+	assert.Equal("3600", forms[1].Get("DurationSeconds"))
+
+	// the fallback is part of the same call
+	assert.Equal(calls+1, atomic.LoadUint64(&assumeRoleCalls.value))
+
+	// the default session duration is too long as well
+	stsServer.SetMaxSessionDuration(30 * time.Minute)
+	containers.Set("172.17.0.3", ContainerInfo{ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"})
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "exceeds the maximum session duration of role arn:aws:iam::123456789012:role/default")
+	assert.Equal(3, stsServer.Calls())
+}
+
+func TestCredentialsForIPSessionTags(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {
+			ID:          "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			SessionTags: NewSessionTags("a", map[string]string{"team": "payments", "env": "prod"}, []string{"team"}),
+		},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	form := stsServer.LastForm()
+	assert.Equal("AssumeRole", form.Get("Action"))
+	assert.Equal("env", form.Get("Tags.member.1.Key"))
+	assert.Equal("prod", form.Get("Tags.member.1.Value"))
+	assert.Equal("team", form.Get("Tags.member.2.Key"))
+	assert.Equal("payments", form.Get("Tags.member.2.Value"))
+	assert.Equal("team", form.Get("TransitiveTagKeys.member.1"))
+}
+
+func TestCredentialsForIPExternalID(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	partnerRole, _ := NewRoleArn("arn:aws:iam::210987654321:role/partner")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamRole: partnerRole, IamExternalID: "partner-external-id"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("partner-external-id", stsServer.LastForm().Get("ExternalId"))
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+	_, found := stsServer.LastForm()["ExternalId"]
+	assert.False(found, "no external ID is sent unless set")
+}
+
+func TestCredentialsForIPPolicyArns(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {
+			ID:            "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			IamPolicy:     `{"Version":"2012-10-17","Statement":{"Effect":"Allow","Action":"s3:*","Resource":"*"}}`,
+			IamPolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::123456789012:policy/app"},
+		},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	form := stsServer.LastForm()
+	container, _ := containers.ContainerForIP("172.17.0.2")
+	assert.Equal(container.IamPolicy, form.Get("Policy"))
+	assert.Equal("arn:aws:iam::aws:policy/ReadOnlyAccess", form.Get("PolicyArns.member.1.arn"))
+	assert.Equal("arn:aws:iam::123456789012:policy/app", form.Get("PolicyArns.member.2.arn"))
+}
+
+func TestCredentialsForIPCoalescesConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetDelay(100 * time.Millisecond)
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	var wg sync.WaitGroup
+	keys := make([]string, 10)
+
+	for i := range keys {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+			assert.Nil(err)
+			keys[i] = creds.AccessKey
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(1, stsServer.Calls())
+
+	for _, key := range keys {
+		assert.Equal("ASIATEST1", key)
+	}
+}
+
+// BenchmarkCredentialsForIPParallel measures cached requests from many containers when
+// every container lookup takes a millisecond.
+func BenchmarkCredentialsForIPParallel(b *testing.B) {
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(nil)
+	ips := make([]string, 100)
+
+	for i := range ips {
+		ips[i] = fmt.Sprintf("172.17.0.%d", i+2)
+		containers.Set(ips[i], ContainerInfo{ID: fmt.Sprintf("%064d", i)})
+	}
+
+	provider := newTestProvider(stsServer, containers)
+
+	for _, ip := range ips {
+		if _, err := provider.CredentialsForIP(context.Background(), ip); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	containers.delay = time.Millisecond
+	b.SetParallelism(8)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+
+		for pb.Next() {
+			if _, err := provider.CredentialsForIP(context.Background(), ips[i%len(ips)]); err != nil {
+				b.Fatal(err)
+			}
+
+			i++
+		}
+	})
+}
+
+func TestRefreshThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	provider := &CredentialsProvider{sessionDuration: time.Hour}
+	assert.Equal(5*time.Minute, provider.RefreshThreshold())
+	assert.Equal(10*time.Minute, provider.BackgroundRefreshThreshold())
+
+	provider.refreshThreshold = 15 * time.Minute
+	assert.Equal(15*time.Minute, provider.RefreshThreshold())
+	assert.Equal(30*time.Minute, provider.BackgroundRefreshThreshold())
+
+	provider.minLifetime = 20 * time.Minute
+	assert.Equal(20*time.Minute, provider.RefreshThreshold())
+	assert.Equal(40*time.Minute, provider.BackgroundRefreshThreshold())
+}
+
+func TestRefreshThresholdsOfShortSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	provider := &CredentialsProvider{sessionDuration: 15 * time.Minute}
+	assert.Equal(75*time.Second, provider.RefreshThreshold())
+
+	// sessions capped below the session duration refresh at a scaled threshold
+	provider.sessionDuration = time.Hour
+	now := time.Now()
+	short := Credentials{GeneratedAt: now, Expiration: now.Add(15 * time.Minute)}
+	full := Credentials{GeneratedAt: now, Expiration: now.Add(time.Hour)}
+
+	assert.Equal(75*time.Second, provider.thresholdFor(short, 5*time.Minute))
+	assert.Equal(5*time.Minute, provider.thresholdFor(full, 5*time.Minute))
+
+	provider.minLifetime = 2 * time.Minute
+	assert.Equal(2*time.Minute, provider.thresholdFor(short, 5*time.Minute))
+
+	// at most half of the session
+	provider.minLifetime = 10 * time.Minute
+	assert.Equal(7*time.Minute+30*time.Second, provider.thresholdFor(short, 5*time.Minute))
+}
+
+func TestBackoffRetriesThrottledCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff := Backoff{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	throttled := awserr.New("Throttling", "Rate exceeded", nil)
+	attempts := 0
+
+	err := backoff.Do(context.Background(), func() error {
+		attempts++
+
+		if attempts < 3 {
+			return throttled
+		}
+
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(3, attempts)
+
+	// gives up after the maximum attempts with the last error
+	attempts = 0
+	err = backoff.Do(context.Background(), func() error {
+		attempts++
+		return throttled
+	})
+	assert.Equal(throttled, err)
+	assert.Equal(3, attempts)
+
+	// other errors are not retried
+	attempts = 0
+	err = backoff.Do(context.Background(), func() error {
+		attempts++
+		return awserr.New("AccessDenied", "Not authorized", nil)
+	})
+	assert.NotNil(err)
+	assert.Equal(1, attempts)
+
+	// stops waiting for the next attempt when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts = 0
+	err = Backoff{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}.Do(ctx, func() error {
+		attempts++
+		cancel()
+		return throttled
+	})
+	assert.Equal(context.Canceled, err)
+	assert.Equal(1, attempts)
+
+	for attempt := 1; attempt < 40; attempt++ {
+		assert.True(backoff.Delay(attempt) < backoff.MaxDelay, "the delay is capped")
+	}
+
+	assert.Equal(time.Duration(0), Backoff{}.Delay(1))
+}
+
+func TestAssumeRoleFailsOverUnreachableEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := NewCredentialsProvider(stsServer.Session(), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+		Sts:             &aws.Config{Endpoint: aws.String(unreachable.URL)},
+		StsFailover:     []*aws.Config{{Endpoint: aws.String(stsServer.URL)}},
+	})
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("ASIATEST1", creds.AccessKey)
+	assert.Equal(1, stsServer.Calls())
+}
+
+func TestProbeStsLatencyPrefersFastestEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	slow := ststest.NewServer()
+	defer slow.Close()
+	slow.SetDelay(100 * time.Millisecond)
+
+	fast := ststest.NewServer()
+	defer fast.Close()
+
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := NewCredentialsProvider(slow.Session(), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+		StsFailover:     []*aws.Config{{Endpoint: aws.String(fast.URL)}},
+	})
+
+	provider.probeStsLatency()
+	assert.Equal(fast.URL, provider.stsOrder(provider.stsClients)[0].Endpoint())
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(1, slow.Calls())
+	assert.Equal(2, fast.Calls())
+
+	// no endpoint responds, fall back to the primary endpoint
+	slow.Close()
+	fast.Close()
+	provider.probeStsLatency()
+	assert.Equal(slow.URL, provider.stsOrder(provider.stsClients)[0].Endpoint())
+}
+
+func TestCredentialsForIPDisableCache(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.disableCache = true
+
+	first, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	second, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	assert.NotEqual(first.AccessKey, second.AccessKey)
+	assert.Equal(2, stsServer.Calls())
+	assert.Equal(0, provider.cache.Len())
+	assert.Empty(provider.sharedCredentials)
+
+	id, found := provider.ContainerIDForIP("172.17.0.2")
+	assert.True(found)
+	assert.Equal("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", id)
+}
+
+func TestCredentialsForIPStaticCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	legacyRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/legacy")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Image: "example/legacy:1.0"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Image: "example/app:1.0", Labels: map[string]string{"env": "dev"}},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", Image: "example/app:1.0"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.staticCreds = StaticCredentialsTable{
+		{Image: "example/legacy", Role: legacyRole, AccessKey: "AKIALEGACY", SecretKey: "legacy-secret"},
+		{Labels: map[string]string{"env": "dev"}, Role: legacyRole, AccessKey: "AKIADEV", SecretKey: "dev-secret", Token: "dev-token"},
+	}
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("AKIALEGACY", creds.AccessKey)
+	assert.Equal("legacy", creds.RoleArn.RoleName())
+	assert.True(creds.Expiration.After(time.Now().Add(50 * time.Minute)))
+
+	creds, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+	assert.Equal("AKIADEV", creds.AccessKey)
+	assert.Equal("dev-token", creds.Token)
+	assert.Equal(0, stsServer.Calls())
+
+	creds, err = provider.CredentialsForIP(context.Background(), "172.17.0.4")
+	assert.Nil(err)
+	assert.Equal("ASIATEST1", creds.AccessKey)
+	assert.Equal(1, stsServer.Calls())
+
+	provider.staticCreds[0].Expiration = time.Now().Add(-time.Minute)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+}
+
+func TestCredentialsForIPDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.dryRun = true
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	dryRun, ok := err.(DryRunError)
+	assert.True(ok)
+	assert.Equal("arn:aws:iam::123456789012:role/default", dryRun.Role.RoleArn.String())
+	assert.Equal(0, stsServer.Calls())
+}
+
+func TestStartRefreshRenewsExpiringCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	old, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	provider.lock.Lock()
+	entry, _ := provider.cache.Get("172.17.0.2")
+	entry.Expiration = time.Now().Add(5 * time.Minute)
+	entry.GeneratedAt = entry.Expiration.Add(-time.Hour)
+	provider.cache.Set("172.17.0.2", entry)
+	delete(provider.sharedCredentials, entry.sharedKey)
+	provider.lock.Unlock()
+
+	provider.StartRefresh(10*time.Millisecond, 0)
+
+	for i := 0; i < 200 && stsServer.Calls() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	provider.Stop()
+	provider.Stop()
+	assert.Equal(2, stsServer.Calls())
+
+	// the request gets the refreshed credentials from the cache
+	fresh, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.NotEqual(old.AccessKey, fresh.AccessKey)
+	assert.Equal(2, stsServer.Calls())
+}
+
+func TestRefreshKeepsSessionName(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	sessionName := stsServer.LastForm().Get("RoleSessionName")
+
+	// expire the credentials and change the template, the session name must not change
+	provider.sessionName = "changed-{shortId}"
+	entry, _ := provider.cache.Get("172.17.0.2")
+	entry.Expiration = time.Now().Add(time.Minute)
+	entry.GeneratedAt = entry.Expiration.Add(-time.Hour)
+	provider.cache.Set("172.17.0.2", entry)
+	delete(provider.sharedCredentials, entry.sharedKey)
+
+	provider.refreshExpiring()
+	assert.Equal(2, stsServer.Calls())
+	assert.Equal(sessionName, stsServer.LastForm().Get("RoleSessionName"))
+
+	// a new container on the IP gets a new session name
+	containers.Set("172.17.0.2", ContainerInfo{ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"})
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("changed-bbbbbbbbbbbb", stsServer.LastForm().Get("RoleSessionName"))
+}
+
+func TestRefreshKeepsSessionPerContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	for _, containerIP := range []string{"172.17.0.2", "172.17.0.3"} {
+		_, err := provider.CredentialsForIP(context.Background(), containerIP)
+		assert.Nil(err)
+
+		entry, _ := provider.cache.Get(containerIP)
+		entry.Expiration = time.Now().Add(time.Minute)
+		entry.GeneratedAt = entry.Expiration.Add(-time.Hour)
+		provider.cache.Set(containerIP, entry)
+		provider.sharedCredentials[entry.sharedKey] = entry.Credentials
+	}
+
+	// both containers refresh their own session, not the one refreshed first
+	provider.refreshExpiring()
+	assert.Equal(4, stsServer.Calls())
+
+	first, _ := provider.cache.Peek("172.17.0.2")
+	second, _ := provider.cache.Peek("172.17.0.3")
+	assert.NotEqual(first.AccessKey, second.AccessKey)
+	assert.Equal("test-aaaaaaaaaaaaaaaaaaaaaaaaaaa", first.SessionName)
+	assert.Equal("test-bbbbbbbbbbbbbbbbbbbbbbbbbbb", second.SessionName)
+}
+
+func TestPurgeStale(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	for _, ip := range []string{"172.17.0.2", "172.17.0.3", "172.17.0.4"} {
+		_, err := provider.CredentialsForIP(context.Background(), ip)
+		assert.Nil(err)
+	}
+
+	// .3 exited and .4 was reused by another container
+	containers.Remove("172.17.0.3")
+	containers.Set("172.17.0.4", ContainerInfo{ID: "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd"})
+
+	assert.Equal(2, provider.purgeStale())
+
+	_, found := provider.ContainerIDForIP("172.17.0.2")
+	assert.True(found)
+	_, found = provider.ContainerIDForIP("172.17.0.3")
+	assert.False(found)
+	_, found = provider.ContainerIDForIP("172.17.0.4")
+	assert.False(found)
+}
+
+func TestCredentialsForIPRoleAllowlist(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	var networks NetworkRoleTable
+	err := json.Unmarshal([]byte(`[{
+		"cidr": "172.18.0.0/16",
+		"role": "arn:aws:iam::123456789012:role/tenant",
+		"allowed_roles": ["arn:aws:iam::123456789012:role/tenant/*"]
+	}]`), &networks)
+	assert.Nil(err)
+	_, networks[0].Network, _ = net.ParseCIDR(networks[0].CIDR)
+
+	allowed, _ := NewRoleArn("arn:aws:iam::123456789012:role/tenant/app")
+	denied, _ := NewRoleArn("arn:aws:iam::123456789012:role/admin")
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.18.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamRole: allowed},
+		"172.18.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamRole: denied},
+		"172.18.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"},
+		"172.17.0.2": {ID: "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd", IamRole: denied},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.Reconfigure(RoleDefaults{RoleArn: provider.defaultIamRoleArn}, nil, networks, nil)
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.18.0.2")
+	assert.Nil(err)
+	assert.Equal(allowed, creds.RoleArn)
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.18.0.3")
+	assert.Equal(RoleNotAllowedError{"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", denied}, err)
+	assert.Equal(1, stsServer.Calls())
+
+	// the role of the network mapping is allowed, and other networks are not restricted
+	_, err = provider.CredentialsForIP(context.Background(), "172.18.0.4")
+	assert.Nil(err)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+}
+
+func TestRefreshDue(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	// not due until the background refresh threshold
+	provider.refreshDue()
+	assert.Equal(1, stsServer.Calls())
+
+	provider.lock.Lock()
+	entry, _ := provider.cache.Peek("172.17.0.2")
+	entry.Expiration = time.Now().Add(time.Minute)
+	entry.GeneratedAt = entry.Expiration.Add(-time.Hour)
+	provider.cache.Replace("172.17.0.2", entry)
+	provider.schedule.Schedule("172.17.0.2", entry.Expiration)
+	delete(provider.sharedCredentials, entry.sharedKey)
+	provider.lock.Unlock()
+
+	assert.True(provider.nextRefresh() == 0)
+	provider.refreshDue()
+	assert.Equal(2, stsServer.Calls())
+
+	// the refreshed credentials are scheduled again
+	assert.True(provider.nextRefresh() > time.Minute)
+}
+
+func TestCredentialsForIPNearExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	before := atomic.LoadUint64(&credentialsNearExpiry.value)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(before, atomic.LoadUint64(&credentialsNearExpiry.value))
+
+	// STS issues 1 hour sessions, shorter than the threshold
+	provider.refreshThreshold = 90 * time.Minute
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(before+1, atomic.LoadUint64(&credentialsNearExpiry.value))
+}
+
+func TestAssumeRoleTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetDelay(500 * time.Millisecond)
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.stsClients[0].(*stsClient).timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.True(IsTimeoutError(err), "%v", err)
+	assert.True(IsConnectionError(err))
+	assert.True(time.Since(start) < 400*time.Millisecond)
+}
+
+func TestCredentialsForIPCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetDelay(200 * time.Millisecond)
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := provider.CredentialsForIP(ctx, "172.17.0.2")
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// the STS call was canceled with the request, so the next request calls STS again
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("ASIATEST2", creds.AccessKey)
+	assert.Equal(2, stsServer.Calls())
+
+	_, err = provider.CredentialsForIP(ctx, "172.17.0.2")
+	assert.Equal(context.DeadlineExceeded, err)
+}
+
+// rotatingBaseCredentials issues new base credentials on every retrieval, like the
+// instance profile after a rotation.
+type rotatingBaseCredentials struct {
+	generation int
+	expires    time.Time
+	lock       sync.Mutex
+}
+
+func (r *rotatingBaseCredentials) Retrieve() (awscredentials.Value, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.generation++
+	r.expires = time.Now().Add(time.Hour)
+	return awscredentials.Value{AccessKeyID: fmt.Sprintf("AKIDBASE%d", r.generation), SecretAccessKey: "base-secret"}, nil
+}
+
+func (r *rotatingBaseCredentials) IsExpired() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return !time.Now().Before(r.expires)
+}
+
+func TestAssumeRoleAfterBaseCredentialsRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	var validKey atomic.Value
+	validKey.Store("AKIDBASE1")
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	// STS only accepts the current base credentials
+	rotating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential="+validKey.Load().(string)+"/") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><Error><Type>Sender</Type><Code>ExpiredToken</Code><Message>The security token included in the request is expired</Message></Error><RequestId>request</RequestId></ErrorResponse>`)
+			return
+		}
+
+		stsServer.ServeHTTP(w, r)
+	}))
+	defer rotating.Close()
+
+	base := &rotatingBaseCredentials{}
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+	containers := newTestContainerService(map[string]ContainerInfo{})
+	provider := NewCredentialsProvider(session.New(&aws.Config{
+		Credentials: awscredentials.NewCredentials(base),
+		Endpoint:    aws.String(rotating.URL),
+		Region:      aws.String("us-east-1"),
+		MaxRetries:  aws.Int(0),
+	}), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+	})
+
+	request := func(containerIP, role string) error {
+		roleArn, _ := NewRoleArn(role)
+		containers.Set(containerIP, ContainerInfo{ID: strings.Repeat(containerIP[len(containerIP)-1:], 64), IamRole: roleArn})
+		_, err := provider.CredentialsForIP(context.Background(), containerIP)
+		return err
+	}
+
+	assert.Nil(request("172.17.0.2", "arn:aws:iam::123456789012:role/a"))
+
+	// the base credentials expire and the SDK retrieves the rotated ones
+	base.lock.Lock()
+	base.expires = time.Now()
+	base.lock.Unlock()
+	validKey.Store("AKIDBASE2")
+	assert.Nil(request("172.17.0.3", "arn:aws:iam::123456789012:role/b"))
+
+	// the base credentials are revoked before they expire
+	validKey.Store("AKIDBASE3")
+	assert.Nil(request("172.17.0.4", "arn:aws:iam::123456789012:role/c"))
+
+	assert.Equal(3, base.generation)
+	assert.Equal(3, stsServer.Calls())
+}
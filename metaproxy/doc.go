@@ -0,0 +1,17 @@
+// Package metaproxy resolves the IAM roles of containers and caches their temporary
+// credentials. It is the core of the ec2metaproxy daemon and can be embedded in other
+// programs that serve credentials to containers.
+//
+// Container platforms are supported by implementing ContainerService. A
+// CredentialsProvider calls ContainerForIP to find the container of a request and
+// assumes the role in its ContainerInfo, or the configured default role:
+//
+//	provider := metaproxy.NewCredentialsProvider(session.New(), myPlatform{}, metaproxy.CredentialsProviderConfig{
+//		Defaults:        metaproxy.RoleDefaults{RoleArn: defaultRole},
+//		SessionDuration: 15 * time.Minute,
+//	})
+//	provider.StartRefresh(time.Minute, 5*time.Minute)
+//	defer provider.Stop()
+//
+//	creds, err := provider.CredentialsForIP(ctx, "172.17.0.2")
+package metaproxy
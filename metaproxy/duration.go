@@ -0,0 +1,83 @@
+package metaproxy
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// shortSessionTolerance is how much shorter than requested a session must be to be
+	// taken as capped by the role, like role chaining caps sessions to 1 hour, rather
+	// than caused by clock skew.
+	shortSessionTolerance = 15 * time.Minute
+
+	// shortSessionObservations is the number of consecutive short sessions after which
+	// the shorter duration is requested for the role.
+	shortSessionObservations = 2
+
+	// shortSessionTTL is how long the shorter duration of a role is requested before
+	// the configured duration is tried again, in case the role was changed.
+	shortSessionTTL = 24 * time.Hour
+)
+
+type roleSession struct {
+	duration time.Duration
+	count    int
+	expires  time.Time
+}
+
+// roleSessionDurations remembers the roles whose sessions are consistently shorter
+// than requested, so the shorter duration is requested instead. Safe for concurrent use.
+type roleSessionDurations struct {
+	roles map[string]roleSession
+	lock  sync.Mutex
+}
+
+func newRoleSessionDurations() *roleSessionDurations {
+	return &roleSessionDurations{roles: make(map[string]roleSession)}
+}
+
+// Duration returns the duration to request for the role: the requested duration,
+// unless the sessions of the role were consistently shorter.
+func (d *roleSessionDurations) Duration(role RoleArn, requested time.Duration) time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	session, found := d.roles[role.String()]
+
+	if !found || session.count < shortSessionObservations || session.duration >= requested {
+		return requested
+	}
+
+	if !time.Now().Before(session.expires) {
+		delete(d.roles, role.String())
+		return requested
+	}
+
+	return session.duration
+}
+
+// Observe records a session of the role that is shorter than requested.
+func (d *roleSessionDurations) Observe(role RoleArn, requested, lifetime time.Duration) {
+	duration := clampSessionDuration(lifetime.Round(time.Minute))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	session := d.roles[role.String()]
+
+	if session.duration == duration {
+		session.count++
+	} else {
+		session = roleSession{duration: duration, count: 1}
+	}
+
+	if session.count == shortSessionObservations {
+		log.Infof("Role %s issued %d sessions of %s instead of the requested %s, requesting %s for the role", role, session.count, duration, requested, duration)
+		session.expires = time.Now().Add(shortSessionTTL)
+	}
+
+	d.roles[role.String()] = session
+}
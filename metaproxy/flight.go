@@ -0,0 +1,79 @@
+package metaproxy
+
+import (
+	"context"
+	"sync"
+)
+
+type flightCall struct {
+	done    chan struct{}
+	creds   Credentials
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces concurrent calls with the same key into one call.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do calls fn unless a call for the key is in progress, in which case it waits for
+// that call and returns its result. shared is true if the result came from another call.
+// fn runs on its own goroutine, so when ctx is done Do returns the error of ctx while
+// fn completes for the other callers. The context of fn is canceled when no caller
+// waits for the call anymore.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (Credentials, error)) (creds Credentials, err error, shared bool) {
+	g.lock.Lock()
+
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+
+	call, shared := g.calls[key]
+
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.Background())
+		call = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+
+		go func() {
+			call.creds, call.err = fn(callCtx)
+
+			g.lock.Lock()
+			g.remove(key, call)
+			g.lock.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+
+	call.waiters++
+	g.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.creds, call.err, shared
+	case <-ctx.Done():
+		g.lock.Lock()
+		call.waiters--
+
+		if call.waiters == 0 {
+			// later callers start a new call instead of waiting for the canceled one
+			g.remove(key, call)
+			call.cancel()
+		}
+
+		g.lock.Unlock()
+		return Credentials{}, ctx.Err(), shared
+	}
+}
+
+// remove removes the call of the key, unless it was replaced by a new call. Must be
+// called with the lock.
+func (g *flightGroup) remove(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
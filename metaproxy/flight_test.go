@@ -0,0 +1,94 @@
+package metaproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroupCancelsAbandonedCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	var group flightGroup
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	release := make(chan struct{})
+
+	call := func(ctx context.Context) (Credentials, error) {
+		close(started)
+
+		select {
+		case <-ctx.Done():
+			close(canceled)
+			return Credentials{}, ctx.Err()
+		case <-release:
+			return Credentials{AccessKey: "ASIATEST1"}, nil
+		}
+	}
+
+	// the call goes on while another caller waits for it
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+
+	go func() {
+		_, err, _ := group.Do(first, "role", call)
+		firstErr <- err
+	}()
+
+	<-started
+	secondDone := make(chan Credentials)
+
+	go func() {
+		creds, _, shared := group.Do(context.Background(), "role", call)
+		assert.True(shared)
+		secondDone <- creds
+	}()
+
+	for waiters(&group, "role") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancelFirst()
+	assert.Equal(context.Canceled, <-firstErr)
+
+	select {
+	case <-canceled:
+		assert.Fail("call canceled while a caller waits for it")
+	default:
+	}
+
+	close(release)
+	assert.Equal("ASIATEST1", (<-secondDone).AccessKey)
+
+	// the call is canceled once no caller waits for it
+	started = make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err, shared := group.Do(ctx, "role", func(ctx context.Context) (Credentials, error) {
+		<-ctx.Done()
+		close(canceled)
+		return Credentials{}, ctx.Err()
+	})
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.False(shared)
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		assert.Fail("abandoned call not canceled")
+	}
+}
+
+func waiters(group *flightGroup, key string) int {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	if call, found := group.calls[key]; found {
+		return call.waiters
+	}
+
+	return 0
+}
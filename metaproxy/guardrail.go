@@ -0,0 +1,110 @@
+package metaproxy
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// allowAllStatement keeps the role permissions when the guardrail is the only session
+// policy. Session policies only grant what they allow, so a policy of only deny
+// statements would deny everything.
+var allowAllStatement = map[string]interface{}{
+	"Effect":   "Allow",
+	"Action":   "*",
+	"Resource": "*",
+}
+
+// policyDocument is an IAM policy with the statements left as raw JSON.
+type policyDocument struct {
+	Version   string            `json:"Version,omitempty"`
+	Statement []json.RawMessage `json:"Statement"`
+}
+
+// GuardrailPolicy is a session policy of deny statements that is added to every
+// assumed role, on top of the policy of the container. Statements of session policies
+// are combined, so only deny statements can restrict what the container policy allows.
+type GuardrailPolicy struct {
+	statements []json.RawMessage
+}
+
+// NewGuardrailPolicy parses the guardrail policy. Returns nil if the policy is empty.
+func NewGuardrailPolicy(policy string) (*GuardrailPolicy, error) {
+	if len(policy) == 0 {
+		return nil, nil
+	}
+
+	doc, err := parsePolicy(policy)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid guardrail policy: %s", err)
+	}
+
+	for _, statement := range doc.Statement {
+		var s struct{ Effect string }
+
+		if err := json.Unmarshal(statement, &s); err != nil || s.Effect != "Deny" {
+			return nil, fmt.Errorf("Guardrail policy must only have Deny statements: %s", statement)
+		}
+	}
+
+	return &GuardrailPolicy{doc.Statement}, nil
+}
+
+// Apply adds the guardrail statements to the session policy of the container.
+func (g *GuardrailPolicy) Apply(policy string) (string, error) {
+	if g == nil {
+		return policy, nil
+	}
+
+	doc := policyDocument{Version: "2012-10-17"}
+
+	if len(policy) > 0 {
+		containerDoc, err := parsePolicy(policy)
+
+		if err != nil {
+			return "", fmt.Errorf("Invalid container policy: %s", err)
+		}
+
+		doc = containerDoc
+	} else {
+		allowAll, _ := json.Marshal(allowAllStatement)
+		doc.Statement = append(doc.Statement, allowAll)
+	}
+
+	doc.Statement = append(doc.Statement, g.statements...)
+	merged, err := json.Marshal(doc)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(merged), nil
+}
+
+// parsePolicy parses a policy document whose Statement is a single statement or a list.
+func parsePolicy(policy string) (policyDocument, error) {
+	var raw struct {
+		Version   string          `json:"Version"`
+		Statement json.RawMessage `json:"Statement"`
+	}
+
+	if err := json.Unmarshal([]byte(policy), &raw); err != nil {
+		return policyDocument{}, err
+	}
+
+	doc := policyDocument{Version: raw.Version}
+
+	if len(raw.Statement) > 0 && raw.Statement[0] == '[' {
+		if err := json.Unmarshal(raw.Statement, &doc.Statement); err != nil {
+			return policyDocument{}, err
+		}
+	} else if len(raw.Statement) > 0 {
+		doc.Statement = []json.RawMessage{raw.Statement}
+	}
+
+	if len(doc.Statement) == 0 {
+		return policyDocument{}, fmt.Errorf("Policy has no statements")
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,50 @@
+package metaproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGuardrail = `{"Version":"2012-10-17","Statement":{"Effect":"Deny","Action":"iam:*","Resource":"*"}}`
+
+func TestGuardrailApplyWithoutContainerPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	guardrail, err := NewGuardrailPolicy(testGuardrail)
+	assert.Nil(err)
+
+	policy, err := guardrail.Apply("")
+	assert.Nil(err)
+	assert.JSONEq(`{"Version":"2012-10-17","Statement":[
+		{"Effect":"Allow","Action":"*","Resource":"*"},
+		{"Effect":"Deny","Action":"iam:*","Resource":"*"}
+	]}`, policy)
+}
+
+func TestGuardrailApplyWithContainerPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	guardrail, err := NewGuardrailPolicy(testGuardrail)
+	assert.Nil(err)
+
+	policy, err := guardrail.Apply(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`)
+	assert.Nil(err)
+	assert.JSONEq(`{"Version":"2012-10-17","Statement":[
+		{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"},
+		{"Effect":"Deny","Action":"iam:*","Resource":"*"}
+	]}`, policy)
+}
+
+func TestNewGuardrailPolicyRejectsAllow(t *testing.T) {
+	_, err := NewGuardrailPolicy(`{"Statement":[{"Effect":"Allow","Action":"*","Resource":"*"}]}`)
+	assert.NotNil(t, err)
+}
+
+func TestNilGuardrailKeepsPolicy(t *testing.T) {
+	var guardrail *GuardrailPolicy
+
+	policy, err := guardrail.Apply("policy")
+	assert.Nil(t, err)
+	assert.Equal(t, "policy", policy)
+}
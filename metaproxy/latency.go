@@ -0,0 +1,73 @@
+package metaproxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// stsOrder returns the STS clients in the order they are tried: the preferred endpoint
+// followed by the others in the configured order. The clients of every account are
+// created for the same endpoints as stsClients, so they share the preferred endpoint.
+func (c *CredentialsProvider) stsOrder(stsClients []stsAPI) []stsAPI {
+	preferred := int(atomic.LoadInt32(&c.preferredSts))
+
+	if preferred == 0 || preferred >= len(stsClients) {
+		return stsClients
+	}
+
+	clients := make([]stsAPI, 0, len(stsClients))
+	clients = append(clients, stsClients[preferred])
+
+	for i, client := range stsClients {
+		if i != preferred {
+			clients = append(clients, client)
+		}
+	}
+
+	return clients
+}
+
+// probeStsLatency measures the latency of each STS endpoint with GetCallerIdentity and
+// prefers the fastest one. Falls back to the primary endpoint if no endpoint responds.
+func (c *CredentialsProvider) probeStsLatency() {
+	fastest := -1
+	var fastestLatency time.Duration
+
+	for i, client := range c.stsClients {
+		start := time.Now()
+
+		if err := client.GetCallerIdentity(context.Background()); err != nil {
+			log.Debug("Error probing STS endpoint ", client.Endpoint(), ": ", err)
+			stsEndpointLatency.Set(client.Endpoint(), -1)
+			continue
+		}
+
+		latency := time.Since(start)
+		stsEndpointLatency.Set(client.Endpoint(), int64(latency/time.Millisecond))
+
+		if fastest < 0 || latency < fastestLatency {
+			fastest = i
+			fastestLatency = latency
+		}
+	}
+
+	if fastest < 0 {
+		log.Warn("No STS endpoint responded to the latency probe, preferring ", c.stsClients[0].Endpoint())
+		fastest = 0
+	}
+
+	if previous := atomic.SwapInt32(&c.preferredSts, int32(fastest)); int(previous) != fastest && fastestLatency > 0 {
+		log.Infof("Preferring STS endpoint %s (latency %s)", c.stsClients[fastest].Endpoint(), fastestLatency)
+	}
+
+	for i, client := range c.stsClients {
+		if i == fastest {
+			stsPreferredEndpoint.Set(client.Endpoint(), 1)
+		} else {
+			stsPreferredEndpoint.Set(client.Endpoint(), 0)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package metaproxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// stsLimiter bounds the number of concurrent STS calls that assume roles, so the
+// containers that start at once, for example after a host boot, are not throttled by
+// STS. Callers beyond the limit wait in line for at most the timeout.
+type stsLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	waiting int64 // accessed atomically
+}
+
+// newStsLimiter returns nil, which does not limit the calls, if max is not positive.
+func newStsLimiter(max int, timeout time.Duration) *stsLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &stsLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// Acquire waits for a free slot. Returns StsQueueTimeoutError if none became free
+// within the timeout.
+func (l *stsLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	stsQueueDepth.Set(atomic.AddInt64(&l.waiting, 1))
+	defer func() { stsQueueDepth.Set(atomic.AddInt64(&l.waiting, -1)) }()
+
+	var timeout <-chan time.Time
+
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return StsQueueTimeoutError{Limit: cap(l.slots), Waited: l.timeout}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *stsLimiter) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
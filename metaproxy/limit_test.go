@@ -0,0 +1,37 @@
+package metaproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStsLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := newStsLimiter(1, 20*time.Millisecond)
+	assert.Nil(limiter.Acquire(context.Background()))
+
+	err := limiter.Acquire(context.Background())
+	_, ok := err.(StsQueueTimeoutError)
+	assert.True(ok, "%v", err)
+
+	// a waiting call gets the slot once it is released
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		limiter.Release()
+	}()
+
+	assert.Nil(limiter.Acquire(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, limiter.Acquire(ctx))
+
+	// a nil limiter does not limit
+	var unlimited *stsLimiter
+	assert.Nil(unlimited.Acquire(context.Background()))
+	unlimited.Release()
+}
@@ -0,0 +1,129 @@
+package metaproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// Marks messages logged by logStructured so the JSON formatter emits their fields
+// instead of escaping the message.
+const structuredLogMarker = "\x1e"
+
+var jsonLogging bool
+
+// logFields are the fields of a structured log message. Never add secret values
+// such as the secret key or session token.
+type logFields map[string]interface{}
+
+// ConfigureLogging logs to the console from the minimum level, like info, in the format:
+// text or json.
+func ConfigureLogging(minLevel, format string) {
+	logger, err := newLogger(minLevel, format, os.Stdout)
+
+	if err != nil {
+		panic(err)
+	}
+
+	log.ReplaceLogger(logger)
+}
+
+// newLogger creates a logger that writes to output from the minimum level in the format.
+func newLogger(minLevel, format string, output io.Writer) (log.LoggerInterface, error) {
+	level, found := log.LogLevelFromString(minLevel)
+
+	if !found {
+		return nil, fmt.Errorf("Unknown log level %s", minLevel)
+	}
+
+	msgFormat := "%Date %Time [%LEVEL] %Msg%n"
+	jsonLogging = format == "json"
+
+	if jsonLogging {
+		msgFormat = `{"time":"%UTCDate(2006-01-02T15:04:05.000Z)","level":"%Level",%JSONMsg}%n`
+	}
+
+	// seelog closes the output with the logger, which must not close stdout
+	return log.LoggerFromWriterWithMinLevelAndFormat(struct{ io.Writer }{output}, level, msgFormat)
+}
+
+func init() {
+	err := log.RegisterCustomFormatter("JSONMsg", func(param string) log.FormatterFunc {
+		return formatJSONMessage
+	})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// formatJSONMessage formats a message as the members of a JSON object.
+func formatJSONMessage(message string, level log.LogLevel, context log.LogContextInterface) interface{} {
+	if strings.HasPrefix(message, structuredLogMarker) {
+		return message[len(structuredLogMarker):]
+	}
+
+	msg, _ := json.Marshal(message)
+	return `"msg":` + string(msg)
+}
+
+// logStructured logs a message with fields. The fields are JSON members in JSON
+// format and key=value pairs in text format.
+func logStructured(level log.LogLevel, msg string, fields logFields) {
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+
+	if jsonLogging {
+		value, _ := json.Marshal(msg)
+		buf.WriteString(structuredLogMarker + `"msg":`)
+		buf.Write(value)
+
+		for _, key := range keys {
+			name, _ := json.Marshal(key)
+			value, err := json.Marshal(fields[key])
+
+			if err != nil {
+				value, _ = json.Marshal(fmt.Sprint(fields[key]))
+			}
+
+			buf.WriteString(",")
+			buf.Write(name)
+			buf.WriteString(":")
+			buf.Write(value)
+		}
+	} else {
+		buf.WriteString(msg)
+
+		for _, key := range keys {
+			fmt.Fprintf(&buf, " %s=%v", key, fields[key])
+		}
+	}
+
+	switch level {
+	case log.TraceLvl:
+		log.Trace(buf.String())
+	case log.DebugLvl:
+		log.Debug(buf.String())
+	case log.InfoLvl:
+		log.Info(buf.String())
+	case log.WarnLvl:
+		log.Warn(buf.String())
+	case log.ErrorLvl:
+		log.Error(buf.String())
+	default:
+		log.Critical(buf.String())
+	}
+}
@@ -0,0 +1,86 @@
+package metaproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStructuredJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	logger, err := newLogger("debug", "json", &out)
+	assert.Nil(err)
+	defer useLogger(logger)()
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	log.Flush()
+
+	var request map[string]interface{}
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		assert.Nil(json.Unmarshal([]byte(line), &entry), line)
+
+		if entry["msg"] == "Credentials request" {
+			request = entry
+		}
+	}
+
+	assert.NotNil(request, out.String())
+	assert.Equal("Info", request["level"])
+	assert.NotEmpty(request["time"])
+	assert.Equal("172.17.0.2", request["container_ip"])
+	assert.Equal("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", request["container_id"])
+	assert.Equal("arn:aws:iam::123456789012:role/default", request["role_arn"])
+	assert.Equal("miss", request["cache"])
+	assert.Contains(request, "sts_latency_ms")
+
+	assert.NotContains(out.String(), creds.SecretKey)
+	assert.NotContains(out.String(), creds.Token)
+}
+
+func TestLogStructuredText(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	logger, err := newLogger("info", "text", &out)
+	assert.Nil(err)
+	defer useLogger(logger)()
+
+	logStructured(log.DebugLvl, "Hidden", logFields{"a": 1})
+	logStructured(log.InfoLvl, "Credentials request", logFields{"container_ip": "172.17.0.2", "cache": "hit"})
+	log.Flush()
+
+	assert.NotContains(out.String(), "Hidden")
+	assert.Contains(out.String(), "[INFO] Credentials request cache=hit container_ip=172.17.0.2\n")
+
+	_, err = newLogger("loud", "text", &out)
+	assert.NotNil(err)
+}
+
+// useLogger logs to the logger until the returned func restores the previous logger.
+func useLogger(logger log.LoggerInterface) func() {
+	previous, previousJSON := log.Current, jsonLogging
+	log.UseLogger(logger)
+
+	return func() {
+		log.UseLogger(previous)
+		jsonLogging = previousJSON
+	}
+}
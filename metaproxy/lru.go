@@ -0,0 +1,106 @@
+package metaproxy
+
+import (
+	"container/list"
+)
+
+// credentialsCache maps container IPs to their cached credentials. When it holds
+// more than size entries, the least recently used entry is evicted. An evicted
+// container assumes its role again on the next request. Not safe for concurrent use.
+type credentialsCache struct {
+	size    int
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type cacheElement struct {
+	containerIP string
+	entry       ContainerCredentials
+}
+
+// newCredentialsCache creates a cache of at most size entries. The size is
+// unbounded if it is not positive.
+func newCredentialsCache(size int) *credentialsCache {
+	return &credentialsCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry of the IP and marks it as recently used.
+func (c *credentialsCache) Get(containerIP string) (ContainerCredentials, bool) {
+	elem, found := c.entries[containerIP]
+
+	if !found {
+		return ContainerCredentials{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheElement).entry, true
+}
+
+// Peek returns the entry of the IP without marking it as used.
+func (c *credentialsCache) Peek(containerIP string) (ContainerCredentials, bool) {
+	if elem, found := c.entries[containerIP]; found {
+		return elem.Value.(*cacheElement).entry, true
+	}
+
+	return ContainerCredentials{}, false
+}
+
+// Set stores the entry of the IP as the most recently used, evicting the least
+// recently used entry if the cache is full.
+func (c *credentialsCache) Set(containerIP string, entry ContainerCredentials) {
+	if elem, found := c.entries[containerIP]; found {
+		elem.Value.(*cacheElement).entry = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[containerIP] = c.order.PushFront(&cacheElement{containerIP, entry})
+
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheElement).containerIP)
+		credentialCacheEvictions.Inc()
+	}
+
+	credentialCacheSize.Set(int64(c.order.Len()))
+}
+
+// Replace updates the entry of the IP if it is still cached, without marking it as
+// used. The background refresh uses it so refreshes do not keep unused entries alive.
+func (c *credentialsCache) Replace(containerIP string, entry ContainerCredentials) bool {
+	elem, found := c.entries[containerIP]
+
+	if found {
+		elem.Value.(*cacheElement).entry = entry
+	}
+
+	return found
+}
+
+func (c *credentialsCache) Delete(containerIP string) {
+	if elem, found := c.entries[containerIP]; found {
+		c.order.Remove(elem)
+		delete(c.entries, containerIP)
+		credentialCacheSize.Set(int64(c.order.Len()))
+	}
+}
+
+func (c *credentialsCache) Len() int {
+	return c.order.Len()
+}
+
+// Each calls fn for every entry, from the most to the least recently used. fn may
+// delete the entry it is called with.
+func (c *credentialsCache) Each(fn func(containerIP string, entry ContainerCredentials)) {
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		e := elem.Value.(*cacheElement)
+		fn(e.containerIP, e.entry)
+		elem = next
+	}
+}
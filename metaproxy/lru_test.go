@@ -0,0 +1,34 @@
+package metaproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newCredentialsCache(2)
+	cache.Set("172.17.0.2", ContainerCredentials{ContainerInfo: ContainerInfo{ID: "a"}})
+	cache.Set("172.17.0.3", ContainerCredentials{ContainerInfo: ContainerInfo{ID: "b"}})
+
+	// reading .2 makes .3 the least recently used
+	_, found := cache.Get("172.17.0.2")
+	assert.True(found)
+
+	cache.Set("172.17.0.4", ContainerCredentials{ContainerInfo: ContainerInfo{ID: "c"}})
+	assert.Equal(2, cache.Len())
+
+	_, found = cache.Peek("172.17.0.3")
+	assert.False(found)
+
+	// replacing does not mark .2 as used, so it is evicted next
+	assert.True(cache.Replace("172.17.0.2", ContainerCredentials{ContainerInfo: ContainerInfo{ID: "d"}}))
+	cache.Set("172.17.0.5", ContainerCredentials{})
+
+	_, found = cache.Peek("172.17.0.2")
+	assert.False(found)
+	_, found = cache.Peek("172.17.0.4")
+	assert.True(found)
+}
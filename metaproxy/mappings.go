@@ -0,0 +1,234 @@
+package metaproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RoleDefaults are the role settings of containers that do not specify a role.
+type RoleDefaults struct {
+	RoleArn    RoleArn
+	Policy     string
+	ExternalID string
+}
+
+// ImageRole is the role of the containers of the images that match a pattern.
+type ImageRole struct {
+	Image        string        `json:"image"`
+	Role         RoleArn       `json:"role"`
+	Policy       string        `json:"policy"`
+	ExternalID   string        `json:"external_id"`
+	AllowedRoles RoleAllowlist `json:"allowed_roles"`
+
+	// SessionDuration is the session duration of the containers of the images that
+	// do not set their own. Uses the default session duration if zero.
+	SessionDuration Duration `json:"session_duration"`
+}
+
+// Duration is a duration that is a string like "2h" in JSON.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration from a JSON string like "2h".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q: %s", value, err)
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// ImageRoleTable maps image name patterns to roles. The first matching pattern wins.
+type ImageRoleTable []ImageRole
+
+// RoleForImage returns the first mapping that matches the image.
+func (t ImageRoleTable) RoleForImage(image string) (ImageRole, bool) {
+	if len(image) == 0 {
+		return ImageRole{}, false
+	}
+
+	for _, mapping := range t {
+		if matchImage(mapping.Image, image) {
+			return mapping, true
+		}
+	}
+
+	return ImageRole{}, false
+}
+
+// matchImage matches the image against a glob pattern. Patterns without a tag or
+// digest match every tag of the image.
+func matchImage(pattern, image string) bool {
+	if matched, _ := path.Match(pattern, image); matched {
+		return true
+	}
+
+	if name := imageName(image); name != image && imageName(pattern) == pattern {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}
+
+	return false
+}
+
+// imageName strips the tag and digest from an image reference.
+func imageName(image string) string {
+	if index := strings.Index(image, "@"); index >= 0 {
+		image = image[:index]
+	}
+
+	if index := strings.LastIndex(image, ":"); index > strings.LastIndex(image, "/") {
+		image = image[:index]
+	}
+
+	return image
+}
+
+// NetworkRole is the default role of the containers in a subnet.
+type NetworkRole struct {
+	CIDR         string        `json:"cidr"`
+	Role         RoleArn       `json:"role"`
+	Policy       string        `json:"policy"`
+	ExternalID   string        `json:"external_id"`
+	AllowedRoles RoleAllowlist `json:"allowed_roles"`
+
+	// Network is the parsed CIDR that RoleForIP matches.
+	Network *net.IPNet `json:"-"`
+}
+
+// NetworkRoleTable maps container subnets to default roles. The first matching
+// subnet wins.
+type NetworkRoleTable []NetworkRole
+
+// RoleForIP returns the first mapping whose network contains the IP.
+func (t NetworkRoleTable) RoleForIP(containerIP string) (NetworkRole, bool) {
+	ip := net.ParseIP(containerIP)
+
+	if ip == nil {
+		return NetworkRole{}, false
+	}
+
+	for _, mapping := range t {
+		if mapping.Network != nil && mapping.Network.Contains(ip) {
+			return mapping, true
+		}
+	}
+
+	return NetworkRole{}, false
+}
+
+// RoleAllowlist are glob patterns of the role ARNs that containers may request with
+// their labels or metadata, where * matches any characters, including /. A nil
+// allowlist allows every role and an empty one allows none.
+type RoleAllowlist []*regexp.Regexp
+
+// UnmarshalJSON parses the allowlist from a JSON array of patterns.
+func (a *RoleAllowlist) UnmarshalJSON(data []byte) error {
+	var patterns []string
+
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return err
+	}
+
+	allowlist := make(RoleAllowlist, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		if len(pattern) == 0 {
+			return fmt.Errorf("Empty allowed role pattern")
+		}
+
+		allowlist = append(allowlist, rolePattern(pattern))
+	}
+
+	*a = allowlist
+	return nil
+}
+
+// Allows checks if the role matches one of the patterns.
+func (a RoleAllowlist) Allows(role RoleArn) bool {
+	if a == nil {
+		return true
+	}
+
+	for _, pattern := range a {
+		if pattern.MatchString(role.String()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rolePattern compiles a glob pattern of role ARNs, where * matches any characters,
+// including /.
+func rolePattern(pattern string) *regexp.Regexp {
+	expr := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// StsEndpointOverride is the STS endpoint that assumes the roles that match a pattern,
+// for example the FIPS endpoint for compliance-scoped roles.
+type StsEndpointOverride struct {
+	Role     string `json:"role"`
+	Endpoint string `json:"endpoint"`
+
+	// Region is the region that requests to the endpoint are signed for.
+	Region string `json:"region"`
+
+	pattern *regexp.Regexp
+}
+
+func (o *StsEndpointOverride) UnmarshalJSON(data []byte) error {
+	type plain StsEndpointOverride
+	var override plain
+
+	if err := json.Unmarshal(data, &override); err != nil {
+		return err
+	}
+
+	if len(override.Role) == 0 {
+		return fmt.Errorf("Empty STS endpoint role pattern")
+	}
+
+	override.pattern = rolePattern(override.Role)
+	*o = StsEndpointOverride(override)
+	return nil
+}
+
+// Matches checks if the role matches the pattern of the override.
+func (o StsEndpointOverride) Matches(role RoleArn) bool {
+	if o.pattern == nil {
+		o.pattern = rolePattern(o.Role)
+	}
+
+	return o.pattern.MatchString(role.String())
+}
+
+// StsEndpointTable maps role ARN patterns to STS endpoints. The first matching pattern
+// wins.
+type StsEndpointTable []StsEndpointOverride
+
+// EndpointForRole returns the first override that matches the role.
+func (t StsEndpointTable) EndpointForRole(role RoleArn) (StsEndpointOverride, bool) {
+	for _, override := range t {
+		if override.Matches(role) {
+			return override, true
+		}
+	}
+
+	return StsEndpointOverride{}, false
+}
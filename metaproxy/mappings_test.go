@@ -0,0 +1,46 @@
+package metaproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchImage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(matchImage("example/app", "example/app"))
+	assert.True(matchImage("example/app", "example/app:1.0"))
+	assert.True(matchImage("example/app", "example/app@sha256:abcd"))
+	assert.False(matchImage("example/app", "registry:5000/example/app"))
+	assert.True(matchImage("*/example/app", "registry:5000/example/app"))
+	assert.True(matchImage("example/app:1.*", "example/app:1.0"))
+	assert.False(matchImage("example/app:1.*", "example/app:2.0"))
+	assert.True(matchImage("example/*", "example/other:latest"))
+	assert.False(matchImage("example/*", "other/app"))
+}
+
+func TestRoleForImageFirstMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	first, _ := NewRoleArn("arn:aws:iam::123456789012:role/first")
+	second, _ := NewRoleArn("arn:aws:iam::123456789012:role/second")
+	table := ImageRoleTable{
+		{Image: "example/app", Role: first},
+		{Image: "example/*", Role: second},
+	}
+
+	role, found := table.RoleForImage("example/app:1.0")
+	assert.True(found)
+	assert.Equal(first, role.Role)
+
+	role, found = table.RoleForImage("example/other")
+	assert.True(found)
+	assert.Equal(second, role.Role)
+
+	_, found = table.RoleForImage("other/app")
+	assert.False(found)
+
+	_, found = table.RoleForImage("")
+	assert.False(found)
+}
@@ -0,0 +1,80 @@
+package metaproxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryContainerService is a ContainerService of the containers set on it, for
+// programs that track their containers themselves and for tests.
+type MemoryContainerService struct {
+	typeName   string
+	containers map[string]ContainerInfo
+	lock       sync.Mutex
+}
+
+// NewMemoryContainerService creates a service of the containers by IP. The type name is
+// the platform of the containers, as in the {platform} token of the session names.
+func NewMemoryContainerService(typeName string, containers map[string]ContainerInfo) *MemoryContainerService {
+	s := &MemoryContainerService{typeName: typeName, containers: make(map[string]ContainerInfo)}
+
+	for containerIP, container := range containers {
+		s.containers[containerIP] = container
+	}
+
+	return s
+}
+
+// ContainerForIP returns the container set for the IP.
+func (s *MemoryContainerService) ContainerForIP(containerIP string) (ContainerInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	container, found := s.containers[containerIP]
+
+	if !found {
+		return ContainerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
+	}
+
+	return container, nil
+}
+
+// TypeName returns the type name the service was created with.
+func (s *MemoryContainerService) TypeName() string {
+	return s.typeName
+}
+
+// Ping always succeeds.
+func (s *MemoryContainerService) Ping() error {
+	return nil
+}
+
+// Set sets the container of the IP, replacing the previous container.
+func (s *MemoryContainerService) Set(containerIP string, container ContainerInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.containers[containerIP] = container
+}
+
+// Remove removes the container of the IP, like when it exits.
+func (s *MemoryContainerService) Remove(containerIP string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.containers, containerIP)
+}
+
+// IPs returns the IPs of the containers.
+func (s *MemoryContainerService) IPs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ips := make([]string, 0, len(s.containers))
+
+	for containerIP := range s.containers {
+		ips = append(ips, containerIP)
+	}
+
+	return ips
+}
@@ -0,0 +1,348 @@
+package metaproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Metrics exported in the prometheus text format. Metrics registers the metrics
+// of the container services as well.
+var (
+	Metrics = &MetricsRegistry{}
+
+	assumeRoleCalls = Metrics.Counter(
+		"assume_role_calls_total",
+		"Number of calls to STS to assume a role.")
+
+	assumeRoleErrors = Metrics.CounterVec(
+		"assume_role_errors_total",
+		"Number of failed calls to STS to assume a role.",
+		"code")
+
+	assumeRoleDuration = Metrics.Histogram(
+		"assume_role_duration_seconds",
+		"Duration of the calls to STS to assume a role.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+
+	credentialCacheHits = Metrics.Counter(
+		"credential_cache_hits_total",
+		"Number of credential requests served from the cache.")
+
+	credentialCacheMisses = Metrics.Counter(
+		"credential_cache_misses_total",
+		"Number of credential requests that required assuming a role.")
+
+	credentialCacheSize = Metrics.Gauge(
+		"credential_cache_size",
+		"Number of container IPs with cached credentials.")
+
+	credentialCacheEvictions = Metrics.Counter(
+		"credential_cache_evictions_total",
+		"Number of cached credentials evicted to stay within the maximum cache size.")
+
+	credentialsNearExpiry = Metrics.Counter(
+		"credentials_near_expiry_total",
+		"Number of credential requests served credentials that expire within the refresh threshold.")
+
+	credentialsServedStale = Metrics.Counter(
+		"credentials_served_stale_total",
+		"Number of credential requests served cached credentials because the refresh failed.")
+
+	baseCredentialsRefreshed = Metrics.Counter(
+		"base_credentials_refreshed_total",
+		"Number of times the base credentials were retrieved again because STS rejected them.")
+
+	credentialsServedGrace = Metrics.Counter(
+		"credentials_served_grace_total",
+		"Number of credential requests served cached credentials during the exit grace period of the container.")
+
+	credentialAge = Metrics.SampledHistogram(
+		"credential_age_seconds",
+		"Time since the cached credentials were issued, at the time of the scrape.",
+		[]float64{60, 300, 600, 1800, 3600, 7200, 21600, 43200})
+
+	credentialRemainingLifetime = Metrics.SampledHistogram(
+		"credential_remaining_lifetime_seconds",
+		"Time until the cached credentials expire, at the time of the scrape. Expired credentials count as 0.",
+		[]float64{0, 60, 300, 600, 900, 1800, 3600, 7200, 21600, 43200})
+
+	stsQueueDepth = Metrics.Gauge(
+		"sts_queue_depth",
+		"Number of STS calls waiting for the limit of concurrent calls.")
+
+	stsEndpointLatency = Metrics.GaugeVec(
+		"sts_endpoint_latency_milliseconds",
+		"Latency of the last probe of each STS endpoint, or -1 if the probe failed.",
+		"endpoint")
+
+	stsPreferredEndpoint = Metrics.GaugeVec(
+		"sts_preferred_endpoint",
+		"1 for the STS endpoint that is tried first, 0 for the others.",
+		"endpoint")
+)
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+type registeredMetric struct {
+	name   string
+	help   string
+	kind   string
+	metric metric
+}
+
+// MetricsRegistry are the metrics that are exported in the Prometheus text format.
+type MetricsRegistry struct {
+	metrics []registeredMetric
+}
+
+func (r *MetricsRegistry) register(name, help, kind string, m metric) {
+	r.metrics = append(r.metrics, registeredMetric{name, help, kind, m})
+}
+
+// Counter registers a counter.
+func (r *MetricsRegistry) Counter(name, help string) *counter {
+	c := &counter{}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// CounterVec registers a counter with a label.
+func (r *MetricsRegistry) CounterVec(name, help, label string) *counterVec {
+	c := &counterVec{label: label, values: make(map[string]uint64)}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// Gauge registers a gauge.
+func (r *MetricsRegistry) Gauge(name, help string) *gauge {
+	g := &gauge{}
+	r.register(name, help, "gauge", g)
+	return g
+}
+
+// GaugeVec registers a gauge with a label.
+func (r *MetricsRegistry) GaugeVec(name, help, label string) *gaugeVec {
+	g := &gaugeVec{label: label, values: make(map[string]int64)}
+	r.register(name, help, "gauge", g)
+	return g
+}
+
+// Histogram registers a histogram of the bucket upper bounds.
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// SampledHistogram is a histogram of the values its source returns at the time of
+// each scrape.
+func (r *MetricsRegistry) SampledHistogram(name, help string, buckets []float64) *sampledHistogram {
+	h := &sampledHistogram{buckets: buckets}
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// Write writes the metrics in registration order.
+func (r *MetricsRegistry) Write(w io.Writer) {
+	for _, m := range r.metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		m.metric.write(w, m.name)
+	}
+}
+
+// ServeHTTP serves the metrics to Prometheus scrapes.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+type counter struct {
+	value uint64
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, atomic.LoadUint64(&c.value))
+}
+
+type gauge struct {
+	value int64
+}
+
+func (g *gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+func (g *gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, atomic.LoadInt64(&g.value))
+}
+
+type counterVec struct {
+	label  string
+	values map[string]uint64
+	lock   sync.Mutex
+}
+
+func (c *counterVec) Inc(labelValue string) {
+	c.lock.Lock()
+	c.values[labelValue]++
+	c.lock.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	labelValues := make([]string, 0, len(c.values))
+
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+
+	sort.Strings(labelValues)
+
+	for _, v := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, c.label, v, c.values[v])
+	}
+}
+
+type gaugeVec struct {
+	label  string
+	values map[string]int64
+	lock   sync.Mutex
+}
+
+func (g *gaugeVec) Set(labelValue string, value int64) {
+	g.lock.Lock()
+	g.values[labelValue] = value
+	g.lock.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer, name string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	labelValues := make([]string, 0, len(g.values))
+
+	for v := range g.values {
+		labelValues = append(labelValues, v)
+	}
+
+	sort.Strings(labelValues)
+
+	for _, v := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, g.label, v, g.values[v])
+	}
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+	lock    sync.Mutex
+}
+
+func (h *histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type sampledHistogram struct {
+	buckets []float64
+	source  func() []float64
+	lock    sync.Mutex
+}
+
+// SetSource sets the function that returns the values on every scrape.
+func (h *sampledHistogram) SetSource(source func() []float64) {
+	h.lock.Lock()
+	h.source = source
+	h.lock.Unlock()
+}
+
+func (h *sampledHistogram) write(w io.Writer, name string) {
+	h.lock.Lock()
+	source := h.source
+	h.lock.Unlock()
+
+	var values []float64
+
+	if source != nil {
+		values = source()
+	}
+
+	sum := 0.0
+
+	for _, value := range values {
+		sum += value
+	}
+
+	for _, bound := range h.buckets {
+		count := 0
+
+		for _, value := range values {
+			if value <= bound {
+				count++
+			}
+		}
+
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, count)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, len(values))
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, len(values))
+}
+
+// errorCode returns the AWS error code of err, for use as a metric label.
+func errorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+
+	if _, ok := err.(StsQueueTimeoutError); ok {
+		return "QueueTimeout"
+	}
+
+	return "Unknown"
+}
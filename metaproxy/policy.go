@@ -0,0 +1,27 @@
+package metaproxy
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// maxPolicySize is the maximum number of characters of the session policy of
+// sts:AssumeRole. STS also limits the packed size of the policy and the session tags,
+// which can only be checked by STS.
+const maxPolicySize = 2048
+
+// validatePolicyJSON checks that the policy is a JSON object, so a syntax error in a
+// label is reported before STS rejects it. An empty policy is valid.
+func validatePolicyJSON(policy string) error {
+	if len(policy) == 0 {
+		return nil
+	}
+
+	var doc map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return fmt.Errorf("Policy is not a JSON object: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,629 @@
+package metaproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsForIPScenarios(t *testing.T) {
+	const (
+		containerA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		containerB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+
+	cases := []struct {
+		name     string
+		stsErr   string
+		ip       string
+		requests int
+
+		// between runs after every request but the last
+		between func(provider *CredentialsProvider, containers *testContainerService)
+
+		wantCalls  int
+		wantErr    string
+		wantKeys   int // distinct access keys served
+		wantCached string
+	}{
+		{
+			name:       "cache miss",
+			ip:         "172.17.0.2",
+			requests:   1,
+			wantCalls:  1,
+			wantKeys:   1,
+			wantCached: containerA,
+		},
+		{
+			name:       "cache hit",
+			ip:         "172.17.0.2",
+			requests:   3,
+			wantCalls:  1,
+			wantKeys:   1,
+			wantCached: containerA,
+		},
+		{
+			name:     "refresh expiring credentials",
+			ip:       "172.17.0.2",
+			requests: 2,
+			between: func(provider *CredentialsProvider, containers *testContainerService) {
+				entry, _ := provider.cache.Get("172.17.0.2")
+				entry.Expiration = time.Now().Add(time.Minute)
+				entry.GeneratedAt = entry.Expiration.Add(-time.Hour)
+				provider.cache.Set("172.17.0.2", entry)
+				delete(provider.sharedCredentials, entry.sharedKey)
+			},
+			wantCalls:  2,
+			wantKeys:   2,
+			wantCached: containerA,
+		},
+		{
+			name:     "ip reused by another container",
+			ip:       "172.17.0.2",
+			requests: 2,
+			between: func(provider *CredentialsProvider, containers *testContainerService) {
+				containers.Set("172.17.0.2", ContainerInfo{ID: containerB})
+			},
+			wantCalls:  2,
+			wantKeys:   2,
+			wantCached: containerB,
+		},
+		{
+			name:      "sts error",
+			stsErr:    "AccessDenied",
+			ip:        "172.17.0.2",
+			requests:  2,
+			wantCalls: 2,
+			wantErr:   "AccessDenied",
+		},
+		{
+			name:      "unknown container",
+			ip:        "172.17.0.9",
+			requests:  1,
+			wantCalls: 0,
+			wantErr:   "No container found for IP 172.17.0.9",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			stsServer := ststest.NewServer()
+			defer stsServer.Close()
+
+			if len(tc.stsErr) > 0 {
+				stsServer.Fail(tc.stsErr, http.StatusForbidden)
+			}
+
+			containers := newTestContainerService(map[string]ContainerInfo{
+				"172.17.0.2": {ID: containerA},
+			})
+			provider := newTestProvider(stsServer, containers)
+
+			keys := make(map[string]bool)
+			var err error
+
+			for i := 0; i < tc.requests; i++ {
+				var creds Credentials
+				creds, err = provider.CredentialsForIP(context.Background(), tc.ip)
+
+				if err == nil {
+					keys[creds.AccessKey] = true
+				}
+
+				if tc.between != nil && i+1 < tc.requests {
+					tc.between(provider, containers)
+				}
+			}
+
+			assert.Equal(tc.wantCalls, stsServer.Calls())
+
+			if len(tc.wantErr) > 0 {
+				assert.NotNil(err)
+				assert.Contains(fmt.Sprint(err), tc.wantErr)
+				_, found := provider.ContainerIDForIP(tc.ip)
+				assert.False(found)
+				return
+			}
+
+			assert.Nil(err)
+			assert.Equal(tc.wantKeys, len(keys))
+
+			id, found := provider.ContainerIDForIP(tc.ip)
+			assert.True(found)
+			assert.Equal(tc.wantCached, id)
+		})
+	}
+}
+
+func TestCredentialsForIPRetriesThrottling(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.Throttle(2)
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.retry = Backoff{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("ASIATEST3", creds.AccessKey)
+
+	// the last error is returned once the attempts are used up
+	stsServer.Throttle(3)
+	provider.Invalidate(func(containerIP string, entry ContainerCredentials) bool { return true })
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+	assert.True(IsRetryableStsError(err))
+	assert.Equal(6, stsServer.Calls())
+}
+
+func TestCredentialsForIPValidatesPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamPolicy: `{"Version": "2012-10-17",`},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamPolicy: `{"Version": "2012-10-17", "Statement": []}` + strings.Repeat(" ", 2048)},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	_, ok := err.(InvalidPolicyError)
+	assert.True(ok, "%v", err)
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	tooLarge, ok := err.(PolicyTooLargeError)
+	assert.True(ok, "%v", err)
+	assert.Equal(2090, tooLarge.Size)
+	assert.Equal(0, stsServer.Calls())
+}
+
+func TestCredentialsForIPShortSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetMaxLifetime(time.Hour)
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.sessionDuration = 12 * time.Hour
+
+	// the 1 hour sessions are within the 1 hour threshold of 12 hour sessions
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(1, stsServer.Calls())
+	assert.Equal(time.Duration(0), provider.ClockSkew())
+
+	in := AssumeRoleInput{RoleArn: provider.defaultIamRoleArn, SessionName: "test", Duration: 12 * time.Hour}
+	_, err = provider.AssumeRole(context.Background(), in)
+	assert.Nil(err)
+	_, err = provider.AssumeRole(context.Background(), in)
+	assert.Nil(err)
+
+	forms := stsServer.Forms()
+	assert.Equal("43200", forms[1].Get("DurationSeconds"))
+	assert.Equal("3600", forms[2].Get("DurationSeconds"))
+}
+
+func TestCredentialsForIPClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	stsServer.SetClockSkew(10 * time.Minute)
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.InDelta(float64(10*time.Minute), float64(provider.ClockSkew()), float64(2*time.Second))
+
+	// the sessions last an hour by the local clock
+	assert.False(provider.expiresIn(creds, 55*time.Minute))
+	assert.True(provider.expiresIn(creds, 65*time.Minute))
+
+	// the margin is added to the threshold
+	provider.clockSkewMargin = 56 * time.Minute
+	assert.True(provider.expiresIn(creds, 5*time.Minute))
+
+	// STS behind the local clock
+	stsServer.SetClockSkew(-10 * time.Minute)
+	provider = newTestProvider(stsServer, containers)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.InDelta(float64(-10*time.Minute), float64(provider.ClockSkew()), float64(2*time.Second))
+
+	now := time.Now()
+	expiring := Credentials{Expiration: now.Add(12 * time.Minute)}
+	assert.True(expiring.ExpiresInWithSkew(5*time.Minute, 10*time.Minute))
+	assert.False(expiring.ExpiresInWithSkew(5*time.Minute, 0))
+	assert.False(expiring.ExpiresInWithSkew(5*time.Minute, -10*time.Minute))
+}
+
+func TestCredentialsForIPServesStaleOnRefreshError(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	first, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	age := func(remaining time.Duration) {
+		entry, _ := provider.cache.Get("172.17.0.2")
+		entry.Expiration = time.Now().Add(remaining)
+		entry.GeneratedAt = entry.Expiration.Add(-time.Hour)
+		provider.cache.Set("172.17.0.2", entry)
+		delete(provider.sharedCredentials, entry.sharedKey)
+	}
+
+	// STS is down while the credentials are within the refresh threshold
+	age(2 * time.Minute)
+	stsServer.Fail("ServiceUnavailable", http.StatusServiceUnavailable)
+
+	stale, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(first.AccessKey, stale.AccessKey)
+	assert.Equal(2, stsServer.Calls())
+
+	// expired credentials are not served
+	age(-time.Minute)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.True(IsServerError(err), "%v", err)
+
+	stsServer.Fail("", 0)
+	refreshed, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.NotEqual(first.AccessKey, refreshed.AccessKey)
+}
+
+func TestCacheAgeMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	ages := provider.cacheAges(false)
+	assert.Equal(1, len(ages))
+	assert.True(ages[0] < 60, "%v", ages)
+
+	remaining := provider.cacheAges(true)
+	assert.Equal(1, len(remaining))
+	assert.InDelta(3600, remaining[0], 60)
+
+	var out strings.Builder
+	credentialRemainingLifetime.write(&out, "remaining")
+	assert.Contains(out.String(), "remaining_bucket{le=\"1800\"} 0\n")
+	assert.Contains(out.String(), "remaining_bucket{le=\"3600\"} 1\n")
+	assert.Contains(out.String(), "remaining_count 1\n")
+}
+
+func TestCredentialsForIPRoutesByAccount(t *testing.T) {
+	assert := assert.New(t)
+
+	otherRole, _ := NewRoleArn("arn:aws:iam::210987654321:role/app")
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	accountServer := ststest.NewServer()
+	defer accountServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamRole: otherRole},
+	})
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+	provider := NewCredentialsProvider(stsServer.Session(), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+		AccountSessions: map[string]*session.Session{"210987654321": accountServer.Session()},
+	})
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.3")
+	assert.Nil(err)
+
+	assert.Equal(1, stsServer.Calls())
+	assert.Equal(1, accountServer.Calls())
+	assert.Equal(otherRole.String(), accountServer.LastForm().Get("RoleArn"))
+}
+
+func TestCredentialsForIPRoutesByStsEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	complianceRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/compliance/app")
+	otherComplianceRole, _ := NewRoleArn("arn:aws:iam::210987654321:role/compliance/batch")
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	fipsServer := ststest.NewServer()
+	defer fipsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", IamRole: complianceRole},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", IamRole: otherComplianceRole},
+	})
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+	provider := NewCredentialsProvider(stsServer.Session(), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+		StsEndpoints:    StsEndpointTable{{Role: "arn:aws:iam::*:role/compliance/*", Endpoint: fipsServer.URL, Region: "us-east-1"}},
+	})
+
+	for _, ip := range []string{"172.17.0.2", "172.17.0.3", "172.17.0.4"} {
+		_, err := provider.CredentialsForIP(context.Background(), ip)
+		assert.Nil(err)
+	}
+
+	assert.Equal(1, len(provider.endpointSts))
+	assert.Equal(1, stsServer.Calls())
+	assert.Equal(2, fipsServer.Calls())
+	assert.Equal(complianceRole.String(), fipsServer.Forms()[0].Get("RoleArn"))
+}
+
+func TestCredentialsForIPRoutesWebIdentityByStsEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenFile, err := ioutil.TempFile("", "token")
+	assert.Nil(err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("oidc-token")
+	tokenFile.Close()
+
+	complianceRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/compliance/app")
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	fipsServer := ststest.NewServer()
+	defer fipsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamRole: complianceRole, WebIdentityTokenFile: tokenFile.Name()},
+	})
+	defaultRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/default")
+	provider := NewCredentialsProvider(stsServer.Session(), containers, CredentialsProviderConfig{
+		Defaults:        RoleDefaults{RoleArn: defaultRole},
+		SessionDuration: time.Hour,
+		Retry:           Backoff{MaxAttempts: 1},
+		StsEndpoints:    StsEndpointTable{{Role: "arn:aws:iam::*:role/compliance/*", Endpoint: fipsServer.URL, Region: "us-east-1"}},
+	})
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(complianceRole, creds.RoleArn)
+
+	assert.Equal(0, stsServer.Calls())
+	assert.Equal(1, fipsServer.Calls())
+	assert.Equal("AssumeRoleWithWebIdentity", fipsServer.LastForm().Get("Action"))
+	assert.Equal("oidc-token", fipsServer.LastForm().Get("WebIdentityToken"))
+}
+
+func TestAssumeRoleWithWebIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	provider := newTestProvider(stsServer, newTestContainerService(nil))
+	role, _ := NewRoleArn("arn:aws:iam::123456789012:role/app")
+
+	creds, err := provider.AssumeRoleWithWebIdentity(context.Background(), role, "oidc-token", "job-1")
+	assert.Nil(err)
+	assert.Equal(role, creds.RoleArn)
+	assert.Equal("job-1", creds.SessionName)
+	assert.Equal("ASIATEST1", creds.AccessKey)
+
+	form := stsServer.LastForm()
+	assert.Equal("AssumeRoleWithWebIdentity", form.Get("Action"))
+	assert.Equal("oidc-token", form.Get("WebIdentityToken"))
+	assert.Equal("3600", form.Get("DurationSeconds"))
+}
+
+func TestCredentialsForIPExitGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.exitGracePeriod = time.Minute
+
+	first, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	containers.Remove("172.17.0.2")
+
+	creds, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(first.AccessKey, creds.AccessKey)
+	assert.Equal(0, provider.purgeStale())
+
+	// the grace period started with the first failed lookup
+	provider.lock.Lock()
+	provider.lookupFailedSince["172.17.0.2"] = time.Now().Add(-time.Minute)
+	provider.lock.Unlock()
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+	assert.Equal(1, stsServer.Calls())
+
+	// disabled by default
+	containers.Set("172.17.0.2", ContainerInfo{ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"})
+	provider = newTestProvider(stsServer, containers)
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	containers.Remove("172.17.0.2")
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.NotNil(err)
+}
+
+func TestCredentialsForIPMaxEntryAge(t *testing.T) {
+	assert := assert.New(t)
+
+	const policy = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "*"}]}`
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.maxEntryAge = time.Hour
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+
+	// a policy label added to the running container is not picked up by a cache hit
+	containers.Set("172.17.0.2", ContainerInfo{ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamPolicy: policy})
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(1, stsServer.Calls())
+
+	provider.lock.Lock()
+	entry, _ := provider.cache.Peek("172.17.0.2")
+	entry.createdAt = time.Now().Add(-time.Hour)
+	provider.cache.Set("172.17.0.2", entry)
+	provider.lock.Unlock()
+
+	_, err = provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(2, stsServer.Calls())
+	assert.Equal(policy, stsServer.Forms()[1].Get("Policy"))
+}
+
+func TestCredentialsForIPImageSessionDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	appRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/app")
+	ownRole, _ := NewRoleArn("arn:aws:iam::123456789012:role/own")
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Image: "example/app:1"},
+		"172.17.0.3": {ID: "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Image: "example/app:1", SessionDuration: 2 * time.Hour},
+		"172.17.0.4": {ID: "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", Image: "example/app:2", IamRole: ownRole},
+		"172.17.0.5": {ID: "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd", Image: "example/other:1"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.imageRoles = ImageRoleTable{{Image: "example/app", Role: appRole, SessionDuration: Duration(4 * time.Hour)}}
+
+	// container label > image mapping > default, for the mapped role and the container role
+	for ip, want := range map[string]time.Duration{
+		"172.17.0.2": 4 * time.Hour,
+		"172.17.0.3": 2 * time.Hour,
+		"172.17.0.4": 4 * time.Hour,
+		"172.17.0.5": time.Hour,
+	} {
+		creds, err := provider.CredentialsForIP(context.Background(), ip)
+
+		if assert.Nil(err, ip) {
+			assert.WithinDuration(time.Now().Add(want), creds.Expiration, time.Minute, ip)
+		}
+	}
+
+	assert.Equal(4, stsServer.Calls())
+}
+
+func TestCredentialsForIPPolicyPrecedence(t *testing.T) {
+	const containerPolicy = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "*"}]}`
+	const defaultPolicy = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:*", "Resource": "*"}]}`
+
+	cases := []struct {
+		name          string
+		role          string
+		policy        string
+		defaultPolicy string
+		wantRole      string
+		wantPolicy    string
+	}{
+		{"default role", "", "", "", "arn:aws:iam::123456789012:role/default", ""},
+		{"default role and policy", "", "", defaultPolicy, "arn:aws:iam::123456789012:role/default", defaultPolicy},
+		{"default role scoped by container policy", "", containerPolicy, "", "arn:aws:iam::123456789012:role/default", containerPolicy},
+		{"container policy replaces default policy", "", containerPolicy, defaultPolicy, "arn:aws:iam::123456789012:role/default", containerPolicy},
+		{"container role and policy", "arn:aws:iam::123456789012:role/app", containerPolicy, defaultPolicy, "arn:aws:iam::123456789012:role/app", containerPolicy},
+		{"container role without policy", "arn:aws:iam::123456789012:role/app", "", defaultPolicy, "arn:aws:iam::123456789012:role/app", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			container := ContainerInfo{ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", IamPolicy: tc.policy}
+
+			if len(tc.role) > 0 {
+				container.IamRole, _ = NewRoleArn(tc.role)
+			}
+
+			stsServer := ststest.NewServer()
+			defer stsServer.Close()
+			provider := newTestProvider(stsServer, newTestContainerService(map[string]ContainerInfo{"172.17.0.2": container}))
+			provider.defaultIamPolicy = tc.defaultPolicy
+
+			_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+			assert.Nil(err)
+			assert.Equal(1, stsServer.Calls())
+			assert.Equal(tc.wantRole, stsServer.LastForm().Get("RoleArn"))
+			assert.Equal(tc.wantPolicy, stsServer.LastForm().Get("Policy"))
+		})
+	}
+}
+
+func TestCheckDefaultRole(t *testing.T) {
+	assert := assert.New(t)
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+	provider := newTestProvider(stsServer, newTestContainerService(map[string]ContainerInfo{}))
+	provider.sessionNamePrefix = "prod-"
+
+	assert.Nil(provider.CheckDefaultRole(context.Background()))
+	assert.Equal(1, stsServer.Calls())
+	form := stsServer.LastForm()
+	assert.Equal("arn:aws:iam::123456789012:role/default", form.Get("RoleArn"))
+	assert.Equal("prod-ec2metaproxy-startup-check", form.Get("RoleSessionName"))
+	assert.Equal("900", form.Get("DurationSeconds"))
+
+	stsServer.Deny("arn:aws:iam::123456789012:role/default")
+	err := provider.CheckDefaultRole(context.Background())
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "role/default")
+
+	// nothing to check without a default role
+	provider.defaultIamRoleArn = RoleArn{}
+	assert.Nil(provider.CheckDefaultRole(context.Background()))
+	assert.Equal(2, stsServer.Calls())
+}
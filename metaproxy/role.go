@@ -0,0 +1,102 @@
+package metaproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var (
+	// arn:<partition>:iam::<12 digit account>:role/<optional path/><name>
+	// IAM roles are global, so the region of the ARN is always empty.
+	roleArnRegex = regexp.MustCompile(`^arn:(aws|aws-us-gov|aws-cn):iam::(\d{12}):role/((?:[\x21-\x7E]+/)?)([\w+=,.@-]{1,64})$`)
+)
+
+// RoleArn is a parsed IAM role ARN.
+type RoleArn struct {
+	value     string
+	path      string
+	name      string
+	accountID string
+	partition string
+}
+
+// NewRoleArn parses an IAM role ARN like arn:aws:iam::123456789012:role/path/name.
+func NewRoleArn(value string) (RoleArn, error) {
+	result := roleArnRegex.FindStringSubmatch(value)
+
+	if result == nil {
+		return RoleArn{}, fmt.Errorf("invalid role ARN %q: expected arn:<aws|aws-us-gov|aws-cn>:iam::<account-id>:role/<name>", value)
+	}
+
+	return RoleArn{value, "/" + result[3], result[4], result[2], result[1]}, nil
+}
+
+// UnmarshalJSON parses a role ARN from a JSON string. An empty string is an empty ARN.
+func (r *RoleArn) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	if len(value) == 0 {
+		*r = RoleArn{}
+		return nil
+	}
+
+	arn, err := NewRoleArn(value)
+	*r = arn
+	return err
+}
+
+// RoleName is the name of the role, without the path.
+func (r RoleArn) RoleName() string {
+	return r.name
+}
+
+// Path is the path of the role, starting and ending with /.
+func (r RoleArn) Path() string {
+	return r.path
+}
+
+// AccountID is the ID of the AWS account of the role.
+func (r RoleArn) AccountID() string {
+	return r.accountID
+}
+
+// Partition is the AWS partition of the role: aws, aws-us-gov or aws-cn.
+func (r RoleArn) Partition() string {
+	return r.partition
+}
+
+// String returns the ARN as parsed.
+func (r RoleArn) String() string {
+	return r.value
+}
+
+// Empty checks if the ARN is the zero value, like when no role is set.
+func (r RoleArn) Empty() bool {
+	return len(r.value) == 0
+}
+
+// Equals checks if the ARNs are the same.
+func (r RoleArn) Equals(other RoleArn) bool {
+	return r.value == other.value
+}
+
+type roleCredentials struct {
+	AccessKey  string
+	SecretKey  string
+	Token      string
+	Expiration time.Time
+}
+
+func (t *roleCredentials) ExpiredNow() bool {
+	return t.ExpiredAt(time.Now())
+}
+
+func (t *roleCredentials) ExpiredAt(at time.Time) bool {
+	return at.After(t.Expiration)
+}
@@ -0,0 +1,68 @@
+package metaproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRoleArn(t *testing.T) {
+	assert := assert.New(t)
+
+	arn, err := NewRoleArn("arn:aws:iam::123456789012:role/test-role-name")
+	assert.Nil(err)
+	assert.Equal("test-role-name", arn.RoleName())
+	assert.Equal("/", arn.Path())
+	assert.Equal("123456789012", arn.AccountID())
+	assert.Equal("arn:aws:iam::123456789012:role/test-role-name", arn.String())
+}
+
+func TestNewRoleArnWithPath(t *testing.T) {
+	assert := assert.New(t)
+
+	arn, err := NewRoleArn("arn:aws:iam::123456789012:role/this/is/the/path/test-role-name")
+	assert.Nil(err)
+	assert.Equal("test-role-name", arn.RoleName())
+	assert.Equal("/this/is/the/path/", arn.Path())
+	assert.Equal("123456789012", arn.AccountID())
+	assert.Equal("arn:aws:iam::123456789012:role/this/is/the/path/test-role-name", arn.String())
+}
+
+func TestNewRoleArnPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	arn, err := NewRoleArn("arn:aws-us-gov:iam::123456789012:role/gov-role")
+	assert.Nil(err)
+	assert.Equal("gov-role", arn.RoleName())
+	assert.Equal("123456789012", arn.AccountID())
+	assert.Equal("aws-us-gov", arn.Partition())
+
+	arn, err = NewRoleArn("arn:aws-cn:iam::210987654321:role/path/cn-role")
+	assert.Nil(err)
+	assert.Equal("cn-role", arn.RoleName())
+	assert.Equal("/path/", arn.Path())
+	assert.Equal("210987654321", arn.AccountID())
+	assert.Equal("aws-cn", arn.Partition())
+
+	arn, err = NewRoleArn("arn:aws:iam::123456789012:role/test-role-name")
+	assert.Nil(err)
+	assert.Equal("aws", arn.Partition())
+}
+
+func TestNewRoleArnInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, value := range []string{
+		"",
+		"test-role-name",
+		"arn:aws:iam::123456789012:user/test-user-name",
+		"arn:aws:iam::1234:role/test-role-name",
+		"arn:aws:iam:us-east-1:123456789012:role/test-role-name",
+		"arn:aws:iam::123456789012:role/",
+		"arn:aws:iam::123456789012:role/test role name",
+		"arn:aws-iso:iam::123456789012:role/test-role-name",
+	} {
+		_, err := NewRoleArn(value)
+		assert.NotNil(err, value)
+	}
+}
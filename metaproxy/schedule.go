@@ -0,0 +1,101 @@
+package metaproxy
+
+import (
+	"container/heap"
+	"time"
+)
+
+// refreshSchedule orders the cached container IPs by the expiration of their
+// credentials, so the background refresh can wake up right before the next
+// credentials expire instead of polling. Not safe for concurrent use.
+type refreshSchedule struct {
+	queue     refreshQueue
+	scheduled map[string]time.Time // latest expiration scheduled for each IP
+
+	// wake is signaled when an IP is scheduled, since the next refresh may be
+	// earlier than the one the refresh goroutine waits for
+	wake chan struct{}
+}
+
+type refreshItem struct {
+	containerIP string
+	expiration  time.Time
+}
+
+// refreshQueue is a min-heap of refresh items by expiration.
+type refreshQueue []refreshItem
+
+func (q refreshQueue) Len() int            { return len(q) }
+func (q refreshQueue) Less(i, j int) bool  { return q[i].expiration.Before(q[j].expiration) }
+func (q refreshQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *refreshQueue) Push(x interface{}) { *q = append(*q, x.(refreshItem)) }
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func newRefreshSchedule() *refreshSchedule {
+	return &refreshSchedule{
+		scheduled: make(map[string]time.Time),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Schedule schedules the refresh of the IP for credentials with the expiration.
+// An earlier schedule of the IP is replaced.
+func (s *refreshSchedule) Schedule(containerIP string, expiration time.Time) {
+	if current, found := s.scheduled[containerIP]; found && current.Equal(expiration) {
+		return
+	}
+
+	s.scheduled[containerIP] = expiration
+	heap.Push(&s.queue, refreshItem{containerIP, expiration})
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Unschedule cancels the refresh of the IP.
+func (s *refreshSchedule) Unschedule(containerIP string) {
+	delete(s.scheduled, containerIP)
+}
+
+// Next returns the earliest scheduled expiration.
+func (s *refreshSchedule) Next() (time.Time, bool) {
+	for len(s.queue) > 0 {
+		if item := s.queue[0]; s.current(item) {
+			return item.expiration, true
+		}
+
+		// replaced by a later schedule of the same IP
+		heap.Pop(&s.queue)
+	}
+
+	return time.Time{}, false
+}
+
+// PopDue removes and returns the IPs whose credentials expire before the deadline.
+func (s *refreshSchedule) PopDue(deadline time.Time) []string {
+	var due []string
+
+	for len(s.queue) > 0 && s.queue[0].expiration.Before(deadline) {
+		item := heap.Pop(&s.queue).(refreshItem)
+
+		if s.current(item) {
+			delete(s.scheduled, item.containerIP)
+			due = append(due, item.containerIP)
+		}
+	}
+
+	return due
+}
+
+func (s *refreshSchedule) current(item refreshItem) bool {
+	expiration, found := s.scheduled[item.containerIP]
+	return found && expiration.Equal(item.expiration)
+}
@@ -0,0 +1,38 @@
+package metaproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	schedule := newRefreshSchedule()
+	schedule.Schedule("172.17.0.2", now.Add(time.Hour))
+	schedule.Schedule("172.17.0.3", now.Add(30*time.Minute))
+	schedule.Schedule("172.17.0.4", now.Add(10*time.Minute))
+
+	// rescheduling replaces the earlier schedule of the IP
+	schedule.Schedule("172.17.0.4", now.Add(2*time.Hour))
+
+	next, found := schedule.Next()
+	assert.True(found)
+	assert.Equal(now.Add(30*time.Minute), next)
+
+	assert.Equal([]string{"172.17.0.3", "172.17.0.2"}, schedule.PopDue(now.Add(90*time.Minute)))
+	assert.Empty(schedule.PopDue(now.Add(90 * time.Minute)))
+
+	next, found = schedule.Next()
+	assert.True(found)
+	assert.Equal(now.Add(2*time.Hour), next)
+
+	// the refresh of unscheduled IPs is skipped
+	schedule.Unschedule("172.17.0.4")
+	_, found = schedule.Next()
+	assert.False(found)
+	assert.Empty(schedule.PopDue(now.Add(3 * time.Hour)))
+}
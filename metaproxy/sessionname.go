@@ -0,0 +1,152 @@
+package metaproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultSessionNameTemplate = "{platform}-{containerId}"
+
+	// STS rejects role session names shorter than this
+	minSessionNameLen int = 2
+
+	shortIDLen = 12
+
+	// leaves room for a separator and the short container ID
+	maxSessionNamePrefixLen = maxSessionNameLen - shortIDLen - 1
+)
+
+var sessionNameTokenRegexp = regexp.MustCompile(`\{(\w+)\}`)
+
+// SessionNameTemplate renders the role session name of a container. The session
+// name shows up in CloudTrail, so it should identify the container.
+//
+// Supported tokens:
+//
+//	{platform}    container platform, like docker
+//	{containerId} full container ID
+//	{shortId}     first 12 characters of the container ID
+//	{image}       image name without registry, path, tag and digest
+type SessionNameTemplate string
+
+// NewSessionNameTemplate checks that the template only uses known tokens. An empty
+// template is the default template.
+func NewSessionNameTemplate(template string) (SessionNameTemplate, error) {
+	for _, match := range sessionNameTokenRegexp.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "platform", "containerId", "shortId", "image":
+		default:
+			return "", fmt.Errorf("Unknown token %s in session name template %q", match[0], template)
+		}
+	}
+
+	if len(template) == 0 {
+		return DefaultSessionNameTemplate, nil
+	}
+
+	return SessionNameTemplate(template), nil
+}
+
+// NewSessionNamePrefix validates the prefix of the role session names, for example the
+// name of the environment, so the sessions of a proxy can be told apart in CloudTrail.
+func NewSessionNamePrefix(prefix string) (string, error) {
+	if invalidSessionNameRegexp.MatchString(prefix) {
+		return "", fmt.Errorf("Session name prefix %q contains characters other than letters, digits and +=,.@_-", prefix)
+	}
+
+	if len(prefix) > maxSessionNamePrefixLen {
+		return "", fmt.Errorf("Session name prefix %q is longer than %d characters", prefix, maxSessionNamePrefixLen)
+	}
+
+	return prefix, nil
+}
+
+// ipContainerID is a stable stand-in for the ID of a container without one, so its
+// sessions can still be attributed. The IP itself is not used, since it is reused by
+// other containers.
+func ipContainerID(containerIP string) string {
+	hash := sha256.Sum256([]byte(containerIP))
+	return "ip" + hex.EncodeToString(hash[:])[:shortIDLen-2]
+}
+
+func shortContainerID(containerID string) string {
+	if len(containerID) > shortIDLen {
+		return containerID[:shortIDLen]
+	}
+
+	return containerID
+}
+
+func (t SessionNameTemplate) render(platform string, container ContainerInfo) string {
+	shortID := shortContainerID(container.ID)
+
+	image := ""
+
+	if len(container.Image) > 0 {
+		image = path.Base(imageName(container.Image))
+	}
+
+	return strings.NewReplacer(
+		"{platform}", platform,
+		"{containerId}", container.ID,
+		"{shortId}", shortID,
+		"{image}", image,
+	).Replace(string(t))
+}
+
+// generateSessionName renders the template and makes the result a valid STS role
+// session name. Falls back to the default template if the result is too short, for
+// example when the template only contains the image and the container has none.
+// Containers without an ID are named by a hash of their IP.
+func generateSessionName(prefix string, template SessionNameTemplate, platform, containerIP string, container ContainerInfo) string {
+	if len(strings.TrimSpace(container.ID)) == 0 {
+		container.ID = ipContainerID(containerIP)
+	}
+
+	sessionName := sanitizeSessionName(template.render(platform, container))
+
+	if len(sessionName) < minSessionNameLen && template != DefaultSessionNameTemplate {
+		sessionName = sanitizeSessionName(SessionNameTemplate(DefaultSessionNameTemplate).render(platform, container))
+	}
+
+	return prefixSessionName(sanitizeSessionName(prefix), sessionName, container)
+}
+
+// prefixSessionName prepends the prefix to the session name. When the result is too
+// long, the session name is truncated, and ends with the short container ID if the
+// truncated name does not contain it.
+func prefixSessionName(prefix, sessionName string, container ContainerInfo) string {
+	if len(prefix) > maxSessionNamePrefixLen {
+		prefix = prefix[:maxSessionNamePrefixLen]
+	}
+
+	room := maxSessionNameLen - len(prefix)
+
+	if len(sessionName) <= room {
+		return prefix + sessionName
+	}
+
+	truncated := sessionName[:room]
+	shortID := sanitizeSessionName(shortContainerID(container.ID))
+
+	if len(shortID) > 0 && !strings.Contains(truncated, shortID) {
+		truncated = truncated[:room-len(shortID)-1] + "-" + shortID
+	}
+
+	return prefix + truncated
+}
+
+func sanitizeSessionName(sessionName string) string {
+	sessionName = invalidSessionNameRegexp.ReplaceAllString(sessionName, "_")
+
+	if len(sessionName) > maxSessionNameLen {
+		sessionName = sessionName[:maxSessionNameLen]
+	}
+
+	return sessionName
+}
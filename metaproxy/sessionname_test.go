@@ -0,0 +1,94 @@
+package metaproxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSessionNameTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	container := ContainerInfo{
+		ID:    "0123456789abcdef0123456789abcdef",
+		Image: "registry.example.com:5000/team/app-server:1.2",
+	}
+
+	template, err := NewSessionNameTemplate("{image}@{shortId}")
+	assert.Nil(err)
+	assert.Equal("app-server@0123456789ab", generateSessionName("", template, "docker", "172.17.0.2", container))
+
+	template, err = NewSessionNameTemplate("")
+	assert.Nil(err)
+	assert.Equal("docker-0123456789abcdef012345678", generateSessionName("", template, "docker", "172.17.0.2", container))
+}
+
+func TestGenerateSessionNameFallsBackToDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	template, err := NewSessionNameTemplate("{image}")
+	assert.Nil(err)
+	assert.Equal("docker-abc", generateSessionName("", template, "docker", "172.17.0.2", ContainerInfo{ID: "abc"}))
+}
+
+func TestGenerateSessionNamePrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	container := ContainerInfo{
+		ID:    "0123456789abcdef0123456789abcdef",
+		Image: "registry.example.com:5000/team/application-server:1.2",
+	}
+
+	template, _ := NewSessionNameTemplate("")
+	assert.Equal("prod-docker-0123456789abcdef0123", generateSessionName("prod-", template, "docker", "172.17.0.2", container))
+
+	// the truncated name keeps the short container ID
+	template, _ = NewSessionNameTemplate("{image}@{shortId}")
+	assert.Equal("staging-application-0123456789ab", generateSessionName("staging-", template, "docker", "172.17.0.2", container))
+	assert.Equal("app-application-ser-0123456789ab", generateSessionName("app-", template, "docker", "172.17.0.2", container))
+
+	_, err := NewSessionNamePrefix("prod env")
+	assert.NotNil(err)
+	_, err = NewSessionNamePrefix("a-very-long-environment-name")
+	assert.NotNil(err)
+}
+
+func TestNewSessionNameTemplateUnknownToken(t *testing.T) {
+	_, err := NewSessionNameTemplate("{platform}-{podName}")
+	assert.NotNil(t, err)
+}
+
+func TestSanitizeSessionNameLength(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("docker-abc", sanitizeSessionName("docker-abc"))
+	assert.Equal("docker-0123456789abcdef012345678", sanitizeSessionName("docker-0123456789abcdef012345678"))
+	assert.Equal("docker-0123456789abcdef012345678", sanitizeSessionName("docker-0123456789abcdef0123456789abcdef"))
+}
+
+func TestSanitizeSessionNameMultibyte(t *testing.T) {
+	assert := assert.New(t)
+
+	// each multibyte character is replaced by a single underscore before truncating
+	assert.Equal("docker-_b_", sanitizeSessionName("docker-äbç"))
+	assert.Equal("docker-________________________x", sanitizeSessionName("docker-ääääääääääääääääääääääääxyz"))
+}
+
+func TestGenerateSessionNameContainerIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	template, _ := NewSessionNameTemplate("")
+	shortTemplate, _ := NewSessionNameTemplate("{shortId}")
+
+	// containers without an ID are named by a hash of their IP
+	empty := generateSessionName("", template, "docker", "172.17.0.2", ContainerInfo{})
+	assert.Regexp(`^docker-ip[0-9a-f]{10}$`, empty)
+	assert.Equal(empty, generateSessionName("", template, "docker", "172.17.0.2", ContainerInfo{ID: " \t"}))
+	assert.NotEqual(empty, generateSessionName("", template, "docker", "172.17.0.3", ContainerInfo{}))
+	assert.Equal(empty[len("docker-"):], generateSessionName("", shortTemplate, "docker", "172.17.0.2", ContainerInfo{}))
+
+	assert.Equal("docker-a", generateSessionName("", template, "docker", "172.17.0.2", ContainerInfo{ID: "a"}))
+	assert.Equal("docker-aaaaaaaaaaaaaaaaaaaaaaaaa", generateSessionName("", template, "docker", "172.17.0.2", ContainerInfo{ID: strings.Repeat("a", 64)}))
+	assert.Equal("aaaaaaaaaaaa", generateSessionName("", shortTemplate, "docker", "172.17.0.2", ContainerInfo{ID: strings.Repeat("a", 64)}))
+}
@@ -0,0 +1,100 @@
+package metaproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// StaticCredentialsMapping are fixed credentials, such as the access key of an IAM user,
+// served to the containers that match the image pattern and labels without calling STS.
+type StaticCredentialsMapping struct {
+	Image  string            `json:"image"`
+	Labels map[string]string `json:"labels"`
+
+	// Role names the credentials in the metadata paths. It is not assumed.
+	Role RoleArn `json:"role"`
+
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Token     string `json:"token"`
+
+	// Expiration is reported to the containers. Credentials without an expiration are
+	// reported to expire after the session duration, so the SDKs request them again.
+	Expiration time.Time `json:"expiration"`
+}
+
+// Matches checks the image pattern, if set, and that the container has all the labels.
+func (m StaticCredentialsMapping) Matches(container ContainerInfo) bool {
+	if len(m.Image) > 0 && !matchImage(m.Image, container.Image) {
+		return false
+	}
+
+	for key, value := range m.Labels {
+		if actual, found := container.Labels[key]; !found || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// StaticCredentialsTable maps containers to static credentials. The first matching
+// mapping wins.
+type StaticCredentialsTable []StaticCredentialsMapping
+
+// ForContainer returns the first mapping that matches the container.
+func (t StaticCredentialsTable) ForContainer(container ContainerInfo) (StaticCredentialsMapping, bool) {
+	for _, mapping := range t {
+		if mapping.Matches(container) {
+			return mapping, true
+		}
+	}
+
+	return StaticCredentialsMapping{}, false
+}
+
+// staticCredentials returns the static credentials of the container. Found is false if
+// no mapping matches it, in which case the role of the container is assumed.
+func (c *CredentialsProvider) staticCredentials(containerIP string, fields logFields) (creds Credentials, found bool, err error) {
+	c.lock.Lock()
+	table := c.staticCreds
+	c.lock.Unlock()
+
+	if len(table) == 0 {
+		return Credentials{}, false, nil
+	}
+
+	container, err := c.containerForIP(containerIP)
+
+	if err != nil {
+		return Credentials{}, false, err
+	}
+
+	mapping, found := table.ForContainer(container)
+
+	if !found {
+		return Credentials{}, false, nil
+	}
+
+	now := time.Now()
+	creds = Credentials{
+		AccessKey:   mapping.AccessKey,
+		SecretKey:   mapping.SecretKey,
+		Token:       mapping.Token,
+		Expiration:  mapping.Expiration,
+		GeneratedAt: now,
+		RoleArn:     mapping.Role,
+	}
+
+	if creds.Expiration.IsZero() {
+		creds.Expiration = now.Add(c.sessionDuration)
+	} else if creds.ExpiredAt(now) {
+		return Credentials{}, false, fmt.Errorf("Static credentials of container %s expired at %s", container.ID, creds.Expiration)
+	}
+
+	fields["container_id"] = container.ID
+	fields["cache"] = "static"
+
+	c.audit.Static(containerIP, container, creds)
+	return creds, true, nil
+}
@@ -0,0 +1,131 @@
+package metaproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/cihub/seelog"
+)
+
+// stsAPI is the part of STS that the credentials provider calls, so tests can replace
+// the SDK client with a fake. The params add the parameters the vendored SDK predates
+// and may be nil.
+type stsAPI interface {
+	AssumeRole(ctx context.Context, in *sts.AssumeRoleInput, params stsParams) (*sts.AssumeRoleOutput, error)
+	AssumeRoleWithWebIdentity(ctx context.Context, in *sts.AssumeRoleWithWebIdentityInput, params stsParams) (*sts.AssumeRoleWithWebIdentityOutput, error)
+	GetCallerIdentity(ctx context.Context) error
+	Endpoint() string
+}
+
+// stsClient implements stsAPI with the SDK client of an STS endpoint.
+type stsClient struct {
+	client  *sts.STS
+	timeout time.Duration
+}
+
+func (s *stsClient) AssumeRole(ctx context.Context, in *sts.AssumeRoleInput, params stsParams) (*sts.AssumeRoleOutput, error) {
+	var resp *sts.AssumeRoleOutput
+
+	err := s.withBaseCredentials(func() error {
+		var req *request.Request
+		req, resp = s.client.AssumeRoleRequest(in)
+
+		if params != nil {
+			req.Handlers.Build.PushBack(params.buildHandler)
+		}
+
+		return s.send(ctx, req)
+	})
+
+	return resp, err
+}
+
+func (s *stsClient) AssumeRoleWithWebIdentity(ctx context.Context, in *sts.AssumeRoleWithWebIdentityInput, params stsParams) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	req, resp := s.client.AssumeRoleWithWebIdentityRequest(in)
+
+	if params != nil {
+		req.Handlers.Build.PushBack(params.buildHandler)
+	}
+
+	return resp, s.send(ctx, req)
+}
+
+func (s *stsClient) GetCallerIdentity(ctx context.Context) error {
+	return s.withBaseCredentials(func() error {
+		req, _ := s.client.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+		return s.send(ctx, req)
+	})
+}
+
+func (s *stsClient) Endpoint() string {
+	return s.client.Endpoint
+}
+
+// withBaseCredentials calls send once more if STS rejects the base credentials that
+// signed the request as expired or invalid, after retrieving them again. The SDK only
+// retrieves credentials, like those of the instance profile or the ECS task, shortly
+// before they expire, but they can be rotated or revoked earlier.
+func (s *stsClient) withBaseCredentials(send func() error) error {
+	err := send()
+
+	if !isBaseCredentialsError(err) || s.client.Config.Credentials == nil || s.client.Config.Credentials == credentials.AnonymousCredentials {
+		return err
+	}
+
+	log.Warn("STS endpoint ", s.Endpoint(), " rejected the base credentials, retrieving them again: ", err)
+	baseCredentialsRefreshed.Inc()
+	s.client.Config.Credentials.Expire()
+	return send()
+}
+
+func isBaseCredentialsError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "ExpiredToken", "InvalidClientTokenId":
+			return true
+		}
+	}
+
+	return false
+}
+
+// send sends the STS request with the context. If ctx is done, the request is canceled
+// and the error of ctx is returned. If STS does not respond within the STS timeout, a
+// RequestTimeout error is returned.
+func (s *stsClient) send(ctx context.Context, req *request.Request) error {
+	callCtx := ctx
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	// the SDK predates contexts, so the context is set on every attempt
+	req.Handlers.Send.PushFront(func(r *request.Request) {
+		r.HTTPRequest = r.HTTPRequest.WithContext(callCtx)
+	})
+	req.Handlers.Retry.PushBack(func(r *request.Request) {
+		if callCtx.Err() != nil {
+			r.Retryable = aws.Bool(false)
+		}
+	})
+
+	err := req.Send()
+
+	if err == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if callCtx.Err() == context.DeadlineExceeded {
+		return awserr.New("RequestTimeout", fmt.Sprintf("STS did not respond within %s", s.timeout), err)
+	}
+
+	return err
+}
@@ -0,0 +1,37 @@
+package metaproxy
+
+import (
+	"io/ioutil"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// stsParams adds parameters to an STS request that the vendored SDK predates, like
+// session tags and policy ARNs.
+type stsParams func(values url.Values)
+
+// buildHandler adds the parameters to the encoded query after the request is built,
+// so they are signed with the rest of the request.
+func (p stsParams) buildHandler(r *request.Request) {
+	if r.Error != nil || r.Body == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	values, err := url.ParseQuery(string(body))
+
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	p(values)
+	r.SetBufferBody([]byte(values.Encode()))
+}
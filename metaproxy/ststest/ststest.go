@@ -0,0 +1,268 @@
+// Package ststest provides a fake STS endpoint for the tests of programs that assume
+// roles through it, like the tests of the credentials provider and its handlers.
+package ststest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+var signerRegexp = regexp.MustCompile(`Credential=([^/]+)/`)
+
+// Server is a fake STS endpoint that issues unique credentials for every call: the
+// access key ASIATEST<n>, secret key secret<n> and token token<n> for the nth call.
+// Sessions last the requested duration.
+type Server struct {
+	URL string
+
+	server             *httptest.Server
+	forms              []url.Values
+	signers            []string
+	denied             map[string]bool
+	errCode            string
+	errStatus          int
+	throttle           int
+	delay              time.Duration
+	maxSessionDuration time.Duration
+	maxLifetime        time.Duration
+	clockSkew          time.Duration
+	lock               sync.Mutex
+}
+
+// NewServer starts a fake STS endpoint. Close it when done.
+func NewServer() *Server {
+	s := &Server{denied: make(map[string]bool)}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the endpoint. Calls fail to connect afterwards.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Session returns an AWS session that calls the endpoint with the base credentials
+// AKIDBASE and no retries of the SDK.
+func (s *Server) Session() *session.Session {
+	return session.New(&aws.Config{
+		Credentials: awscredentials.NewStaticCredentials("AKIDBASE", "base-secret", ""),
+		Endpoint:    aws.String(s.URL),
+		Region:      aws.String("us-east-1"),
+		MaxRetries:  aws.Int(0),
+	})
+}
+
+// Calls returns the number of calls, including failed calls.
+func (s *Server) Calls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.forms)
+}
+
+// Forms returns the parameters of the calls in order.
+func (s *Server) Forms() []url.Values {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]url.Values(nil), s.forms...)
+}
+
+// LastForm returns the parameters of the last call, or nil if there were no calls.
+func (s *Server) LastForm() url.Values {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.forms) == 0 {
+		return nil
+	}
+
+	return s.forms[len(s.forms)-1]
+}
+
+// Signers returns the access keys that signed the calls in order.
+func (s *Server) Signers() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.signers...)
+}
+
+// SetDelay slows down the responses to simulate STS latency.
+func (s *Server) SetDelay(delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.delay = delay
+}
+
+// Deny makes the calls that assume the role fail with AccessDenied.
+func (s *Server) Deny(role string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.denied[role] = true
+}
+
+// Fail makes all calls fail with the error code and HTTP status, until it is called
+// with an empty code.
+func (s *Server) Fail(code string, status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.errCode, s.errStatus = code, status
+}
+
+// Throttle makes the next n calls fail with Throttling.
+func (s *Server) Throttle(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.throttle = n
+}
+
+// SetMaxSessionDuration rejects calls for longer sessions with the ValidationError STS
+// returns for durations above the MaxSessionDuration of the role. Not limited if zero.
+func (s *Server) SetMaxSessionDuration(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.maxSessionDuration = d
+}
+
+// SetMaxLifetime issues sessions that last at most d, even if a longer duration was
+// requested, like the sessions of chained roles. Not limited if zero.
+func (s *Server) SetMaxLifetime(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.maxLifetime = d
+}
+
+// SetClockSkew sets how far the clock of the endpoint is ahead of the local clock, which
+// shifts the expiration of the sessions. Negative if behind.
+func (s *Server) SetClockSkew(skew time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clockSkew = skew
+}
+
+// ServeHTTP answers an STS call, for servers that wrap the endpoint.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	signer := ""
+
+	if match := signerRegexp.FindStringSubmatch(r.Header.Get("Authorization")); match != nil {
+		signer = match[1]
+	}
+
+	s.lock.Lock()
+	s.forms = append(s.forms, r.Form)
+	s.signers = append(s.signers, signer)
+	call := len(s.forms)
+	delay := s.delay
+	code, status, message := s.errorFor(r.Form)
+	lifetime := s.lifetimeFor(r.Form)
+	skew := s.clockSkew
+	s.lock.Unlock()
+
+	time.Sleep(delay)
+	w.Header().Set("Content-Type", "text/xml")
+
+	if len(code) > 0 {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>%s</Code>
+    <Message>%s</Message>
+  </Error>
+  <RequestId>request-%d</RequestId>
+</ErrorResponse>`, code, message, call)
+		return
+	}
+
+	action := r.Form.Get("Action")
+
+	if action == "GetCallerIdentity" {
+		fmt.Fprintf(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::123456789012:user/base</Arn>
+    <UserId>AIDABASE</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>request-%d</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`, call)
+		return
+	}
+
+	expiration := time.Now().Add(skew + lifetime).UTC().Format(time.RFC3339)
+
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>ASIATEST%[2]d</AccessKeyId>
+      <SecretAccessKey>secret%[2]d</SecretAccessKey>
+      <SessionToken>token%[2]d</SessionToken>
+      <Expiration>%[3]s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>%[4]s</Arn>
+      <AssumedRoleId>AROATEST:%[5]s</AssumedRoleId>
+    </AssumedRoleUser>
+  </%[1]sResult>
+  <ResponseMetadata><RequestId>request-%[2]d</RequestId></ResponseMetadata>
+</%[1]sResponse>`, action, call, expiration, r.Form.Get("RoleArn"), r.Form.Get("RoleSessionName"))
+}
+
+// errorFor returns the error of the call, if it fails. Must be called with the lock.
+func (s *Server) errorFor(form url.Values) (code string, status int, message string) {
+	if len(s.errCode) > 0 {
+		return s.errCode, s.errStatus, "Injected error"
+	}
+
+	if s.throttle > 0 {
+		s.throttle--
+		return "Throttling", http.StatusBadRequest, "Rate exceeded"
+	}
+
+	if s.denied[form.Get("RoleArn")] {
+		return "AccessDenied", http.StatusForbidden, "Not authorized to perform sts:AssumeRole"
+	}
+
+	if s.maxSessionDuration > 0 && requestedDuration(form) > s.maxSessionDuration {
+		return "ValidationError", http.StatusBadRequest, "The requested DurationSeconds exceeds the MaxSessionDuration set for this role."
+	}
+
+	return "", 0, ""
+}
+
+// lifetimeFor returns the lifetime of the session of the call. Must be called with the lock.
+func (s *Server) lifetimeFor(form url.Values) time.Duration {
+	if lifetime := requestedDuration(form); s.maxLifetime <= 0 || lifetime < s.maxLifetime {
+		return lifetime
+	}
+
+	return s.maxLifetime
+}
+
+// requestedDuration returns the session duration of the call, 1 hour unless requested.
+func requestedDuration(form url.Values) time.Duration {
+	if seconds, err := strconv.Atoi(form.Get("DurationSeconds")); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return time.Hour
+}
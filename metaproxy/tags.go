@@ -0,0 +1,126 @@
+package metaproxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/cihub/seelog"
+)
+
+// STS limits on session tags
+const (
+	maxSessionTags      = 50
+	maxSessionTagKeyLen = 128
+	maxSessionTagValLen = 256
+)
+
+var sessionTagRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// SessionTags are passed to sts:AssumeRole for attribute based access control.
+type SessionTags struct {
+	Tags map[string]string
+
+	// TransitiveKeys are the keys of the tags that persist to chained role sessions.
+	TransitiveKeys []string
+}
+
+// Empty checks if there are no tags.
+func (t SessionTags) Empty() bool {
+	return len(t.Tags) == 0
+}
+
+// String returns the tags as key=value pairs sorted by key, for logging.
+func (t SessionTags) String() string {
+	var pairs []string
+
+	for _, key := range t.sortedKeys() {
+		pairs = append(pairs, key+"="+t.Tags[key])
+	}
+
+	return strings.Join(pairs, ",") + ";" + strings.Join(t.TransitiveKeys, ",")
+}
+
+func (t SessionTags) sortedKeys() []string {
+	keys := make([]string, 0, len(t.Tags))
+
+	for key := range t.Tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// addParams adds the Tags and TransitiveTagKeys parameters of AssumeRole.
+func (t SessionTags) addParams(values url.Values) {
+	for i, key := range t.sortedKeys() {
+		values.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), key)
+		values.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), t.Tags[key])
+	}
+
+	for i, key := range t.TransitiveKeys {
+		values.Set(fmt.Sprintf("TransitiveTagKeys.member.%d", i+1), key)
+	}
+}
+
+// NewSessionTags validates the tags of a container. Invalid tags are logged and
+// dropped rather than failing the credentials request.
+func NewSessionTags(containerID string, tags map[string]string, transitiveKeys []string) SessionTags {
+	result := SessionTags{Tags: make(map[string]string)}
+
+	for key, value := range tags {
+		if err := validateSessionTag(key, value); err != nil {
+			log.Warn("Ignoring session tag ", key, " of container ", containerID, ": ", err)
+			continue
+		}
+
+		result.Tags[key] = value
+	}
+
+	if len(result.Tags) > maxSessionTags {
+		log.Warn("Container ", containerID, " has more than ", maxSessionTags, " session tags, ignoring the rest")
+
+		for _, key := range result.sortedKeys()[maxSessionTags:] {
+			delete(result.Tags, key)
+		}
+	}
+
+	for _, key := range transitiveKeys {
+		if _, found := result.Tags[key]; !found {
+			log.Warn("Ignoring transitive tag key ", key, " of container ", containerID, ": no such tag")
+			continue
+		}
+
+		result.TransitiveKeys = append(result.TransitiveKeys, key)
+	}
+
+	if len(result.Tags) == 0 {
+		return SessionTags{}
+	}
+
+	return result
+}
+
+func validateSessionTag(key, value string) error {
+	if len(key) == 0 || utf8.RuneCountInString(key) > maxSessionTagKeyLen {
+		return fmt.Errorf("Key must be 1 to %d characters", maxSessionTagKeyLen)
+	}
+
+	if utf8.RuneCountInString(value) > maxSessionTagValLen {
+		return fmt.Errorf("Value must be at most %d characters", maxSessionTagValLen)
+	}
+
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		return fmt.Errorf("Key must not start with aws:")
+	}
+
+	if !sessionTagRegexp.MatchString(key) || !sessionTagRegexp.MatchString(value) {
+		return fmt.Errorf("Only letters, numbers, spaces and _.:/=+-@ are allowed")
+	}
+
+	return nil
+}
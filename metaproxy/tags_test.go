@@ -0,0 +1,22 @@
+package metaproxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSessionTagsDropsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := NewSessionTags("abc", map[string]string{
+		"team":      "payments",
+		"aws:owner": "me",
+		"bad#key":   "value",
+		"long":      strings.Repeat("x", maxSessionTagValLen+1),
+	}, []string{"team", "missing"})
+
+	assert.Equal(map[string]string{"team": "payments"}, tags.Tags)
+	assert.Equal([]string{"team"}, tags.TransitiveKeys)
+}
@@ -0,0 +1,280 @@
+package metaproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	traceBatchSize     = 100
+	traceQueueSize     = 1000
+	traceFlushInterval = 5 * time.Second
+
+	// OTLP span kinds and status codes
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusError = 2
+)
+
+// tracer exports spans to an OpenTelemetry collector with OTLP over HTTP, using the
+// JSON encoding. A nil tracer creates nil spans, which discard everything.
+type Tracer struct {
+	endpoint string
+	client   *http.Client
+	spans    chan *span
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// span is an operation of a trace. The methods of a nil span do nothing, so
+// tracing can be disabled without checks at every call site.
+type span struct {
+	tracer   *Tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+}
+
+// newTracer creates a tracer that sends spans to the OTLP HTTP endpoint of a
+// collector, like http://localhost:4318. Returns nil if the endpoint is empty.
+func NewTracer(endpoint string) *Tracer {
+	if len(endpoint) == 0 {
+		return nil
+	}
+
+	t := &Tracer{
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, traceQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go t.run()
+	return t
+}
+
+// Start starts the root span of a new trace.
+func (t *Tracer) Start(name string) *span {
+	if t == nil {
+		return nil
+	}
+
+	return &span{
+		tracer:  t,
+		traceID: randomID(16),
+		spanID:  randomID(8),
+		name:    name,
+		kind:    spanKindServer,
+		start:   time.Now(),
+		attrs:   make(map[string]string),
+	}
+}
+
+// Stop exports the queued spans and stops the tracer. Spans that end later are
+// not exported.
+func (t *Tracer) Stop() {
+	if t == nil {
+		return
+	}
+
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.stopped
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+
+			t.export(batch)
+			return
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpRequest(batch))
+
+	if err != nil {
+		log.Error("Error encoding spans: ", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		log.Warn("Error exporting ", len(batch), " spans: ", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Warn("Error exporting ", len(batch), " spans: collector returned status ", resp.StatusCode)
+	}
+}
+
+// Child starts a span for a call made by the operation of s.
+func (s *span) Child(name string) *span {
+	if s == nil {
+		return nil
+	}
+
+	return &span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		spanID:   randomID(8),
+		parentID: s.spanID,
+		name:     name,
+		kind:     spanKindClient,
+		start:    time.Now(),
+		attrs:    make(map[string]string),
+	}
+}
+
+func (s *span) SetAttribute(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// SetError marks the span as failed if err is not nil.
+func (s *span) SetError(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// End queues the span for export. Spans are dropped if the queue is full rather
+// than delaying the request.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		log.Debug("Trace queue full, dropping span ", s.name)
+	}
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newOtlpAttribute(key, value string) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+	attr.Value.StringValue = value
+	return attr
+}
+
+// otlpRequest builds an OTLP ExportTraceServiceRequest for the spans.
+func otlpRequest(batch []*span) map[string]interface{} {
+	spans := make([]otlpSpan, 0, len(batch))
+
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+
+		for key, value := range s.attrs {
+			o.Attributes = append(o.Attributes, newOtlpAttribute(key, value))
+		}
+
+		if len(s.err) > 0 {
+			o.Status = &otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+
+		spans = append(spans, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{newOtlpAttribute("service.name", "ec2metaproxy")},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "ec2metaproxy"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,82 @@
+package metaproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/dump247/ec2metaproxy/metaproxy/ststest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracerExportsCredentialsSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	var spans []otlpSpan
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+
+		assert.Equal("/v1/traces", r.URL.Path)
+		assert.Nil(json.NewDecoder(r.Body).Decode(&req))
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, resource := range req.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	stsServer := ststest.NewServer()
+	defer stsServer.Close()
+
+	containers := newTestContainerService(map[string]ContainerInfo{
+		"172.17.0.2": {ID: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	provider := newTestProvider(stsServer, containers)
+	provider.tracer = NewTracer(collector.URL)
+
+	_, err := provider.CredentialsForIP(context.Background(), "172.17.0.2")
+	assert.Nil(err)
+	provider.tracer.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	names := make(map[string]otlpSpan)
+
+	for _, s := range spans {
+		names[s.Name] = s
+	}
+
+	root := names["CredentialsForIP"]
+	assert.Len(spans, 3)
+	assert.Equal(root.SpanID, names["ContainerForIP"].ParentSpanID)
+	assert.Equal(root.SpanID, names["AssumeRole"].ParentSpanID)
+	assert.Equal(root.TraceID, names["AssumeRole"].TraceID)
+	assert.Contains(root.Attributes, newOtlpAttribute("cache", "miss"))
+}
+
+func TestNilTracer(t *testing.T) {
+	var traces *Tracer
+
+	s := traces.Start("test")
+	s.Child("child").End()
+	s.SetAttribute("key", "value")
+	s.End()
+	traces.Stop()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	// containerMarkerFiles are created in containers by docker and podman.
+	containerMarkerFiles = []string{".dockerenv", "run/.containerenv"}
+
+	// containerCgroupRegexp matches the cgroup paths of container runtimes.
+	containerCgroupRegexp = regexp.MustCompile(`(docker|kubepods|libpod|containerd|lxc)[/-]`)
+
+	// hostInterfacePrefixes are the prefixes of the bridge and veth interfaces that
+	// container runtimes create on the host. They are not visible inside containers that
+	// have their own network namespace.
+	hostInterfacePrefixes = []string{"docker", "br-", "veth", "cni", "cbr", "podman", "flannel", "cali", "cilium", "weave", "virbr", "kube-"}
+)
+
+// checkHostNetwork detects if the proxy runs in a container without host networking,
+// where it sees the requests of all containers coming from one gateway address. It only
+// warns unless mode is strict. The check is a heuristic based on the network interfaces
+// of the container runtimes.
+func checkHostNetwork(mode, procDir string) error {
+	if mode == "off" || !runningInContainer("/", procDir) {
+		return nil
+	}
+
+	interfaces, err := net.Interfaces()
+
+	if err != nil {
+		log.Warn("Error listing network interfaces, skipping the host network check: ", err)
+		return nil
+	}
+
+	var names []string
+
+	for _, iface := range interfaces {
+		names = append(names, iface.Name)
+	}
+
+	if hasHostInterfaces(names) {
+		return nil
+	}
+
+	message := fmt.Sprintf("The proxy seems to run in a container without host networking (interfaces: %s), so it can not tell the containers apart by their IP. Run it with host networking, or set --network-check=off if the setup is intended", strings.Join(names, ", "))
+
+	if mode == "strict" {
+		return fmt.Errorf("%s", message)
+	}
+
+	log.Warn(message)
+	return nil
+}
+
+// runningInContainer checks for the marker files and cgroups of container runtimes.
+func runningInContainer(rootDir, procDir string) bool {
+	for _, name := range containerMarkerFiles {
+		if _, err := os.Stat(filepath.Join(rootDir, name)); err == nil {
+			return true
+		}
+	}
+
+	if len(os.Getenv("KUBERNETES_SERVICE_HOST")) > 0 {
+		return true
+	}
+
+	cgroup, err := ioutil.ReadFile(filepath.Join(procDir, "self", "cgroup"))
+	return err == nil && containerCgroupRegexp.Match(cgroup)
+}
+
+func hasHostInterfaces(names []string) bool {
+	for _, name := range names {
+		for _, prefix := range hostInterfacePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
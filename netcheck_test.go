@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunningInContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "netcheck")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	procDir := filepath.Join(dir, "proc")
+	os.MkdirAll(filepath.Join(procDir, "self"), 0700)
+	ioutil.WriteFile(filepath.Join(procDir, "self", "cgroup"), []byte("0::/user.slice/user-1000.slice\n"), 0600)
+
+	assert.False(runningInContainer(dir, procDir))
+
+	ioutil.WriteFile(filepath.Join(procDir, "self", "cgroup"), []byte("0::/system.slice/docker-abc.scope\n"), 0600)
+	assert.True(runningInContainer(dir, procDir))
+
+	ioutil.WriteFile(filepath.Join(procDir, "self", "cgroup"), []byte("0::/\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, ".dockerenv"), nil, 0600)
+	assert.True(runningInContainer(dir, procDir))
+}
+
+func TestHasHostInterfaces(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(hasHostInterfaces([]string{"lo", "eth0"}))
+	assert.True(hasHostInterfaces([]string{"lo", "eth0", "docker0"}))
+	assert.True(hasHostInterfaces([]string{"lo", "ens5", "veth1a2b3c"}))
+}
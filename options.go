@@ -2,14 +2,15 @@ package main
 
 import (
 	"github.com/alecthomas/kingpin"
+	"github.com/dump247/ec2metaproxy/metaproxy"
 )
 
-type roleArnValue roleArn
+type roleArnValue metaproxy.RoleArn
 
 func (r *roleArnValue) Set(value string) error {
 	if len(value) > 0 {
-		arn, err := newRoleArn(value)
-		*(*roleArn)(r) = arn
+		arn, err := metaproxy.NewRoleArn(value)
+		*(*metaproxy.RoleArn)(r) = arn
 		return err
 	}
 
@@ -20,8 +21,8 @@ func (r *roleArnValue) String() string {
 	return ""
 }
 
-func roleArnOpt(s kingpin.Settings) (target *roleArn) {
-	target = new(roleArn)
+func roleArnOpt(s kingpin.Settings) (target *metaproxy.RoleArn) {
+	target = new(metaproxy.RoleArn)
 	s.SetValue((*roleArnValue)(target))
 	return
 }
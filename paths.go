@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultAllowedPaths are the metadata paths, relative to the API version, that are
+// forwarded to the real metadata service. They exclude the user data and anything
+// that exposes host credentials.
+var defaultAllowedPaths = []string{
+	"meta-data",
+	"meta-data/ami-id",
+	"meta-data/instance-id",
+	"meta-data/instance-type",
+	"meta-data/local-hostname",
+	"meta-data/local-ipv4",
+	"meta-data/mac",
+	"meta-data/placement/*",
+	"meta-data/services/*",
+	"dynamic/instance-identity/document",
+}
+
+// defaultDeniedPaths are the metadata paths, relative to the API version, that are never
+// forwarded to the metadata service, even in passthrough mode.
+var defaultDeniedPaths = []string{
+	"user-data/*",
+	"meta-data/iam/*",
+	"meta-data/identity-credentials/*",
+	"meta-data/public-keys/*",
+}
+
+// hostCredentialsRegex matches the metadata paths that return credentials of the host
+// instance. These are never forwarded to the metadata service.
+var hostCredentialsRegex = regexp.MustCompile(`^/[^/]+/meta-data/(iam/security-credentials[^/]*|identity-credentials)(/|$)`)
+
+// cleanMetadataPath removes duplicate slashes and dot segments so that a path can not
+// dodge the path checks. A trailing slash is kept since directory listings use it.
+func cleanMetadataPath(urlPath string) string {
+	cleaned := path.Clean("/" + urlPath)
+
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// pathAllowlist decides which metadata paths are forwarded to the real metadata
+// service. A path is allowed if it equals an entry, or if an entry ends with /* and
+// the path is below it. The listings of the API versions are always allowed.
+type pathAllowlist []string
+
+func (a pathAllowlist) Allowed(urlPath string) bool {
+	subpath, versioned := versionSubpath(urlPath)
+
+	if !versioned {
+		return true
+	}
+
+	for _, entry := range a {
+		if matchPathEntry(subpath, entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathDenylist lists the metadata paths that are never forwarded to the real metadata
+// service, with the entries of pathAllowlist. Paths are matched ignoring case, so
+// variants of a path can not dodge the list.
+type pathDenylist []string
+
+func (d pathDenylist) Denied(urlPath string) bool {
+	subpath, versioned := versionSubpath(urlPath)
+
+	if !versioned {
+		return false
+	}
+
+	for _, entry := range d {
+		if matchPathEntry(strings.ToLower(subpath), strings.ToLower(entry)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// versionSubpath returns the path below the API version, without leading and trailing
+// slashes. versioned is false for the listings of the root and the API versions.
+func versionSubpath(urlPath string) (subpath string, versioned bool) {
+	parts := strings.SplitN(strings.Trim(urlPath, "/"), "/", 2)
+
+	if len(parts) == 1 {
+		return "", false
+	}
+
+	return strings.Trim(parts[1], "/"), true
+}
+
+// matchPathEntry checks if the path equals the entry, or is below an entry that ends
+// with /*.
+func matchPathEntry(subpath, entry string) bool {
+	if strings.HasSuffix(entry, "/*") {
+		dir := strings.Trim(strings.TrimSuffix(entry, "/*"), "/")
+		return subpath == dir || strings.HasPrefix(subpath, dir+"/")
+	}
+
+	return subpath == strings.Trim(entry, "/")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathAllowlist(t *testing.T) {
+	assert := assert.New(t)
+
+	allowed := pathAllowlist(defaultAllowedPaths)
+
+	assert.True(allowed.Allowed("/"))
+	assert.True(allowed.Allowed("/latest/"))
+	assert.True(allowed.Allowed("/latest/meta-data/"))
+	assert.True(allowed.Allowed("/latest/meta-data/instance-id"))
+	assert.True(allowed.Allowed("/2016-09-02/meta-data/placement"))
+	assert.True(allowed.Allowed("/latest/meta-data/placement/availability-zone"))
+
+	assert.False(allowed.Allowed("/latest/user-data"))
+	assert.False(allowed.Allowed("/latest/meta-data/iam/security-credentials/host-role"))
+	assert.False(allowed.Allowed("/latest/meta-data/placementx"))
+	assert.False(allowed.Allowed("/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance"))
+}
+
+func TestPathDenylist(t *testing.T) {
+	assert := assert.New(t)
+
+	denied := pathDenylist(defaultDeniedPaths)
+
+	assert.True(denied.Denied("/latest/user-data"))
+	assert.True(denied.Denied("/latest/user-data/"))
+	assert.True(denied.Denied("/latest/User-Data"))
+	assert.True(denied.Denied("/2016-09-02/meta-data/iam/"))
+	assert.True(denied.Denied("/latest/meta-data/IAM/security-credentials/host-role"))
+	assert.True(denied.Denied("/latest/meta-data/public-keys/0/openssh-key"))
+
+	assert.False(denied.Denied("/"))
+	assert.False(denied.Denied("/latest/"))
+	assert.False(denied.Denied("/latest/meta-data/"))
+	assert.False(denied.Denied("/latest/meta-data/instance-id"))
+	assert.False(denied.Denied("/latest/user-datax"))
+
+	assert.True(pathDenylist{"meta-data/tags/instance/Secret"}.Denied("/latest/meta-data/tags/instance/secret/"))
+}
+
+func TestHostCredentialsPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, p := range []string{
+		"/latest/meta-data/iam/security-credentials",
+		"/latest/meta-data/iam/security-credentials/host-role",
+		"//latest//meta-data/iam/security-credentials/host-role",
+		"/latest/meta-data/x/../iam/security-credentials/host-role",
+		"/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance",
+	} {
+		assert.True(hostCredentialsRegex.MatchString(cleanMetadataPath(p)), p)
+	}
+
+	assert.False(hostCredentialsRegex.MatchString(cleanMetadataPath("/latest/meta-data/iam/info")))
+	assert.Equal("/latest/meta-data/", cleanMetadataPath("/latest//meta-data/"))
+	assert.Equal("/", cleanMetadataPath("/"))
+}
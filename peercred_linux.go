@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerPid returns the process that connected to the Unix socket, from its peer
+// credentials.
+func peerPid(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err != nil {
+		return 0, err
+	} else if credErr != nil {
+		return 0, credErr
+	}
+
+	return int(ucred.Pid), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func peerPid(conn *net.UnixConn) (int, error) {
+	return 0, fmt.Errorf("Peer credentials of Unix sockets are only supported on Linux")
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+var (
+	placementRegex = regexp.MustCompile("^/(.+?)/meta-data/placement/(availability-zone|region)/?$")
+)
+
+// handlePlacement serves the region and availability zone that the SDKs use to detect
+// their region. Both are derived from the configured region instead of the host.
+func handlePlacement(item, region string, w http.ResponseWriter, r *http.Request) {
+	switch item {
+	case "availability-zone":
+		w.Write([]byte(region + "a"))
+	case "region":
+		w.Write([]byte(region))
+	default:
+		http.NotFound(w, r)
+	}
+}
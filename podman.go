@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// newPodmanContainerService resolves containers through the docker compatible API of
+// podman. Role labels are read the same way as for docker.
+func newPodmanContainerService(endpoint string, labels roleLabels, cacheTTL time.Duration) (*dockerContainerService, error) {
+	service, err := newDockerContainerService(endpoint, labels, cacheTTL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	service.platform = "podman"
+	return service, nil
+}
+
+// isUserModeNetwork reports whether the container network is provided by slirp4netns
+// or pasta, as for rootless podman containers. Their requests reach the proxy from the
+// host, so the container IP does not identify them.
+func isUserModeNetwork(container *docker.Container) bool {
+	if container.HostConfig == nil {
+		return false
+	}
+
+	mode := container.HostConfig.NetworkMode
+	return mode == "slirp4netns" || mode == "pasta" ||
+		strings.HasPrefix(mode, "slirp4netns:") || strings.HasPrefix(mode, "pasta:")
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUserModeNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isUserModeNetwork(&docker.Container{HostConfig: &docker.HostConfig{NetworkMode: "slirp4netns"}}))
+	assert.True(isUserModeNetwork(&docker.Container{HostConfig: &docker.HostConfig{NetworkMode: "slirp4netns:port_handler=slirp4netns"}}))
+	assert.True(isUserModeNetwork(&docker.Container{HostConfig: &docker.HostConfig{NetworkMode: "pasta"}}))
+	assert.False(isUserModeNetwork(&docker.Container{HostConfig: &docker.HostConfig{NetworkMode: "bridge"}}))
+	assert.False(isUserModeNetwork(&docker.Container{}))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// proxyHeaderTimeout is the maximum time to wait for the PROXY protocol header of
+	// a connection from a trusted source.
+	proxyHeaderTimeout = 5 * time.Second
+
+	// maxProxyV1HeaderLen is the maximum length of a version 1 header, including CRLF.
+	maxProxyV1HeaderLen = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseTrustedProxies parses the source ranges that are trusted to send the PROXY
+// protocol header.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy range %s: %s", cidr, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// proxyProtocolListener reads the PROXY protocol header, version 1 or 2, of the
+// connections from trusted sources, such as a NAT gateway or load balancer in front of
+// the proxy, and reports the client address of the header as the remote address of
+// the connection. Connections from other sources are never parsed, so containers can
+// not spoof the address of another container.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+
+	if !ok || !l.isTrusted(addr.IP) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *proxyProtocolListener) isTrusted(ip net.IP) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyProtocolConn parses the header on the first read or call to RemoteAddr, so
+// Accept does not block on slow clients.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+	once   sync.Once
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyHeader(c.reader)
+
+	if c.err != nil {
+		log.Warn("Error reading the PROXY protocol header from ", c.Conn.RemoteAddr(), ": ", c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader reads the header, if the connection starts with one, and returns
+// the source address. Returns nil if there is no header or it does not carry a TCP
+// source address, for example for the health checks of a load balancer.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if start, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+
+	if start, err := r.Peek(6); err == nil && string(start) == "PROXY " {
+		return readProxyV1Header(r)
+	}
+
+	return nil, nil
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+
+	for len(line) < maxProxyV1HeaderLen {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return parseProxyV1Header(strings.TrimSuffix(string(line), "\r\n"))
+		}
+	}
+
+	return nil, fmt.Errorf("PROXY protocol header is longer than %d bytes", maxProxyV1HeaderLen)
+}
+
+func parseProxyV1Header(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY protocol header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid PROXY protocol header %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are sent by the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY protocol header is too short for IPv4 addresses")
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY protocol header is too short for IPv6 addresses")
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	assert := assert.New(t)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer inner.Close()
+
+	trusted, err := parseTrustedProxies([]string{"127.0.0.0/8"})
+	assert.Nil(err)
+
+	listener := &proxyProtocolListener{Listener: inner, trusted: trusted}
+
+	accept := func(data string) (net.Addr, string) {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		assert.Nil(err)
+		defer client.Close()
+		client.Write([]byte(data))
+
+		conn, err := listener.Accept()
+		assert.Nil(err)
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn.RemoteAddr(), line
+	}
+
+	addr, line := accept("PROXY TCP4 172.17.0.2 10.0.0.1 41000 80\r\nGET / HTTP/1.1\r\n")
+	assert.Equal("172.17.0.2:41000", addr.String())
+	assert.Equal("GET / HTTP/1.1\r\n", line)
+
+	v2 := string(proxyV2Signature) + "\x21\x11\x00\x0c" + "\xac\x11\x00\x03" + "\x0a\x00\x00\x01" + "\xa0\x28" + "\x00\x50"
+	addr, line = accept(v2 + "GET / HTTP/1.1\r\n")
+	assert.Equal("172.17.0.3:41000", addr.String())
+	assert.Equal("GET / HTTP/1.1\r\n", line)
+
+	// a trusted source without a header keeps its address
+	addr, line = accept("GET / HTTP/1.1\r\n")
+	assert.Equal("127.0.0.1", remoteIP(addr.String()))
+	assert.Equal("GET / HTTP/1.1\r\n", line)
+
+	// the header of an untrusted source is not parsed
+	listener.trusted, _ = parseTrustedProxies([]string{"10.0.0.0/8"})
+	addr, line = accept("PROXY TCP4 172.17.0.2 10.0.0.1 41000 80\r\n")
+	assert.Equal("127.0.0.1", remoteIP(addr.String()))
+	assert.Equal("PROXY TCP4 172.17.0.2 10.0.0.1 41000 80\r\n", line)
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	_, err := parseTrustedProxies([]string{"10.0.0.1"})
+	assert.NotNil(t, err)
+}
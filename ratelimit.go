@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+// rateLimitSweepInterval is how often the buckets of idle containers are removed.
+const rateLimitSweepInterval = time.Minute
+
+var throttledRequests = metaproxy.Metrics.CounterVec(
+	"throttled_requests_total",
+	"Number of metadata requests rejected by the rate limit.",
+	"container")
+
+// rateLimiter is a token bucket rate limiter keyed by the container key of the client.
+type rateLimiter struct {
+	rate      float64 // tokens added per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the key, returning false if it is empty.
+func (l *rateLimiter) Allow(key string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, found := l.buckets[key]
+
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	bucket.last = now
+
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// sweep removes the buckets that have refilled, which behave the same as new buckets.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// Wrap responds 429 to requests of containers that exceed the rate. Requests whose
+// container can not be identified are limited by their IP.
+func (l *rateLimiter) Wrap(c *metaproxy.CredentialsProvider, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := containerKey(c, r)
+
+		if err != nil {
+			key = remoteIP(r.RemoteAddr)
+		}
+
+		if !l.Allow(key, time.Now()) {
+			throttledRequests.Inc(key)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(limiter.Allow("172.17.0.2", now))
+	}
+
+	assert.False(limiter.Allow("172.17.0.2", now))
+	assert.True(limiter.Allow("172.17.0.3", now), "other IPs have their own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(limiter.Allow("172.17.0.2", now))
+	assert.False(limiter.Allow("172.17.0.2", now))
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := newRateLimiter(1, 1)
+	now := time.Now()
+
+	limiter.Allow("172.17.0.2", now)
+	limiter.Allow("172.17.0.3", now.Add(rateLimitSweepInterval))
+
+	assert.Len(limiter.buckets, 1)
+}
+
+func TestRateLimiterByCgroupContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	procDir, err := ioutil.TempDir("", "proc")
+	assert.Nil(err)
+	defer os.RemoveAll(procDir)
+
+	otherID := strings.Repeat("b", 64)
+
+	// two containers on the host network, with the IP of the host
+	os.MkdirAll(filepath.Join(procDir, "net"), 0700)
+	ioutil.WriteFile(filepath.Join(procDir, "net", "tcp"), []byte(
+		"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"+
+			"   0: 0200000A:C350 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 4567 1\n"+
+			"   1: 0200000A:C351 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 4568 1\n"), 0600)
+
+	for pid, container := range map[string]string{"123": cgroupTestID, "456": otherID} {
+		os.MkdirAll(filepath.Join(procDir, pid, "fd"), 0700)
+		ioutil.WriteFile(filepath.Join(procDir, pid, "cgroup"), []byte("0::/system.slice/docker-"+container+".scope\n"), 0600)
+	}
+
+	os.Symlink("socket:[4567]", filepath.Join(procDir, "123", "fd", "3"))
+	os.Symlink("socket:[4568]", filepath.Join(procDir, "456", "fd", "3"))
+
+	service := newCgroupContainerService(&testIDService{metaproxy.NewMemoryContainerService("test", nil)}, procDir, 0)
+	credentials := metaproxy.NewCredentialsProvider(session.New(), service, metaproxy.CredentialsProviderConfig{})
+	handler := newRateLimiter(1, 1).Wrap(credentials, func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(port int) int {
+		conn := testConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: port}}
+		r := httptest.NewRequest("GET", "/latest/meta-data/", nil)
+		r.RemoteAddr = conn.remote.String()
+		w := httptest.NewRecorder()
+		handler(w, r.WithContext(withConn(r.Context(), conn)))
+		return w.Code
+	}
+
+	assert.Equal(http.StatusOK, request(50000))
+	assert.Equal(http.StatusTooManyRequests, request(50000))
+	assert.Equal(http.StatusOK, request(50001), "other containers of the IP have their own bucket")
+}
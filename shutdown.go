@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// inFlightCounter counts the requests that are being served.
+type inFlightCounter struct {
+	count int64
+}
+
+func (c *inFlightCounter) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&c.count, 1)
+		defer atomic.AddInt64(&c.count, -1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (c *inFlightCounter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// serveUntilSignal serves the listeners until the server fails or SIGTERM or SIGINT is
+// received, then drains the in-flight requests.
+func serveUntilSignal(server *http.Server, listeners []net.Listener, inFlight *inFlightCounter, timeout time.Duration) error {
+	errs := make(chan error, len(listeners))
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Info("Received ", sig, ", shutting down")
+	}
+
+	return drain(server, inFlight, timeout)
+}
+
+// drain stops accepting connections and waits up to the timeout for the in-flight
+// requests, including their STS calls, to finish.
+func drain(server *http.Server, inFlight *inFlightCounter, timeout time.Duration) error {
+	pending := inFlight.Count()
+	log.Info("Draining ", pending, " in-flight requests")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("Error draining requests, %d still in flight: %s", inFlight.Count(), err)
+	}
+
+	log.Info("Drained ", pending, " in-flight requests")
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainWaitsForInFlightRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{})
+	inFlight := &inFlightCounter{}
+	server := &http.Server{Handler: inFlight.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	go server.Serve(listener)
+
+	status := make(chan int, 1)
+
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+
+		if err != nil {
+			status <- 0
+			return
+		}
+
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	<-started
+	assert.Equal(int64(1), inFlight.Count())
+	assert.Nil(drain(server, inFlight, 5*time.Second))
+	assert.Equal(http.StatusOK, <-status)
+	assert.Equal(int64(0), inFlight.Count())
+}
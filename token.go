@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+)
+
+const (
+	metadataTokenPath      = "/latest/api/token"
+	metadataTokenHeader    = "X-aws-ec2-metadata-token"
+	metadataTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	// limits of the token TTL accepted by the EC2 metadata service
+	minMetadataTokenTTL = 1 * time.Second
+	maxMetadataTokenTTL = 6 * time.Hour
+)
+
+// metadataTokens issues and validates IMDSv2 session tokens. A token is an expiration
+// time and an HMAC of the expiration and the key of the container the token was issued
+// to, so it can not be used from another container.
+type metadataTokens struct {
+	secret []byte
+}
+
+func newMetadataTokens() (*metadataTokens, error) {
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &metadataTokens{secret}, nil
+}
+
+func (t *metadataTokens) Generate(containerKey string, expiration time.Time) string {
+	token := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(token, uint64(expiration.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(token, t.sign(containerKey, token)...))
+}
+
+func (t *metadataTokens) Validate(containerKey, token string, now time.Time) bool {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+
+	if err != nil || len(data) != 8+sha256.Size {
+		return false
+	}
+
+	if !hmac.Equal(data[8:], t.sign(containerKey, data[:8])) {
+		return false
+	}
+
+	expiration := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	return now.Before(expiration)
+}
+
+func (t *metadataTokens) sign(containerKey string, expiration []byte) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(expiration)
+	mac.Write([]byte(containerKey))
+	return mac.Sum(nil)
+}
+
+func handleTokenRequest(tokens *metadataTokens, c *metaproxy.CredentialsProvider, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ttlSeconds, err := strconv.Atoi(r.Header.Get(metadataTokenTTLHeader))
+	ttl := time.Duration(ttlSeconds) * time.Second
+
+	if err != nil || ttl < minMetadataTokenTTL || ttl > maxMetadataTokenTTL {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	key, err := containerKey(c, r)
+
+	if err != nil {
+		log.Error(remoteIP(r.RemoteAddr), " Error identifying container: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token := tokens.Generate(key, time.Now().Add(ttl))
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set(metadataTokenTTLHeader, strconv.Itoa(ttlSeconds))
+	w.Write([]byte(token))
+}
+
+// checkMetadataToken validates the IMDSv2 token of the request, if any. Requests
+// without a token are only accepted when IMDSv1 is allowed. Returns false if the
+// request was rejected.
+func checkMetadataToken(tokens *metadataTokens, c *metaproxy.CredentialsProvider, requireToken bool, w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get(metadataTokenHeader)
+
+	if len(token) == 0 && !requireToken {
+		return true
+	}
+
+	key, err := containerKey(c, r)
+
+	if err != nil {
+		log.Error(remoteIP(r.RemoteAddr), " Error identifying container: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	if !tokens.Validate(key, token, time.Now()) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
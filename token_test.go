@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dump247/ec2metaproxy/metaproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// testConnService identifies the connections by the order they were opened in, like
+// the peers of a Unix socket that all have the same remote address.
+type testConnService struct {
+	*metaproxy.MemoryContainerService
+	keys map[net.Conn]string
+	next []string
+	lock sync.Mutex
+}
+
+func (s *testConnService) ContainerKeyForConn(conn net.Conn) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if key, found := s.keys[conn]; found {
+		return key, nil
+	}
+
+	key := s.next[0]
+	s.next = s.next[1:]
+	s.keys[conn] = key
+	return key, nil
+}
+
+// testPeer is a client connection that sends its requests on the same connection.
+type testPeer struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (p *testPeer) Do(method, token string) (*http.Response, string) {
+	path := "/latest/meta-data/"
+
+	if method == "PUT" {
+		path = metadataTokenPath
+	}
+
+	req, _ := http.NewRequest(method, "http://169.254.169.254"+path, nil)
+	req.Header.Set(metadataTokenTTLHeader, "60")
+
+	if len(token) > 0 {
+		req.Header.Set(metadataTokenHeader, token)
+	}
+
+	req.Write(p.conn)
+	resp, err := http.ReadResponse(p.reader, req)
+
+	if err != nil {
+		panic(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestMetadataTokenValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, err := newMetadataTokens()
+	assert.Nil(err)
+
+	now := time.Now()
+	token := tokens.Generate("172.17.0.2", now.Add(time.Minute))
+
+	assert.True(tokens.Validate("172.17.0.2", token, now))
+	assert.False(tokens.Validate("172.17.0.3", token, now))
+	assert.False(tokens.Validate("172.17.0.2", token, now.Add(2*time.Minute)))
+	assert.False(tokens.Validate("172.17.0.2", token[1:], now))
+	assert.False(tokens.Validate("172.17.0.2", "", now))
+}
+
+func TestMetadataTokenFromOtherProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, _ := newMetadataTokens()
+	other, _ := newMetadataTokens()
+	now := time.Now()
+
+	assert.False(tokens.Validate("172.17.0.2", other.Generate("172.17.0.2", now.Add(time.Minute)), now))
+}
+
+func TestMetadataTokenFromOtherSocketPeer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "socket")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	listener, err := listenUnix(filepath.Join(dir, "metadata.sock"))
+	assert.Nil(err)
+
+	service := &testConnService{MemoryContainerService: metaproxy.NewMemoryContainerService("test", nil), keys: make(map[net.Conn]string), next: []string{"container-a", "container-b"}}
+	credentials := metaproxy.NewCredentialsProvider(session.New(), service, metaproxy.CredentialsProviderConfig{})
+	tokens, _ := newMetadataTokens()
+
+	server := &http.Server{ConnContext: withConn, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metadataTokenPath {
+			handleTokenRequest(tokens, credentials, w, r)
+		} else if checkMetadataToken(tokens, credentials, true, w, r) {
+			w.Write([]byte("ok"))
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	peers := make([]*testPeer, 2)
+
+	for i := range peers {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		assert.Nil(err)
+		defer conn.Close()
+		peers[i] = &testPeer{conn, bufio.NewReader(conn)}
+
+		// identify the peers in order
+		resp, _ := peers[i].Do("GET", "")
+		assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp, token := peers[0].Do("PUT", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, _ = peers[0].Do("GET", token)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, _ = peers[1].Do("GET", token)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode, "the token of another peer")
+}